@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signAt is Sign with the timestamp and nonce chosen by the test.
+func signAt(key string, issued time.Time, nonce, network, address, source string) string {
+	timestamp := strconv.FormatInt(issued.Unix(), 10)
+	sig := mac([]byte(key), timestamp, nonce, network, address, source)
+	return fmt.Sprintf("%s.%s.%s", timestamp, nonce, base64.RawURLEncoding.EncodeToString(sig))
+}
+
+func TestVerify(t *testing.T) {
+	const network, address, source = "tcp", "192.0.2.1:22", "198.51.100.7:50000"
+	now := time.Now()
+	nonce := hex.EncodeToString([]byte("0123456789abcdef"))
+
+	tests := []struct {
+		name     string
+		keys     []string
+		token    string
+		network  string
+		address  string
+		source   string
+		expected error
+	}{
+		{"valid", []string{"key"}, Sign("key", network, address, source), network, address, source, nil},
+		{"rotated key", []string{"new", "key"}, Sign("key", network, address, source), network, address, source, nil},
+		{"wrong key", []string{"key"}, Sign("other", network, address, source), network, address, source, ErrInvalid},
+		{"missing", []string{"key"}, "", network, address, source, ErrMissing},
+		{"malformed", []string{"key"}, "a.b", network, address, source, ErrInvalid},
+		{"other network", []string{"key"}, Sign("key", network, address, source), "udp", address, source, ErrInvalid},
+		{"other destination", []string{"key"}, Sign("key", network, address, source), network, "192.0.2.1:23", source, ErrInvalid},
+		{"other source", []string{"key"}, Sign("key", network, address, source), network, address, "203.0.113.1:1", ErrInvalid},
+		{"unsigned source", []string{"key"}, Sign("key", network, address, ""), network, address, source, ErrInvalid},
+		{"stale", []string{"key"}, signAt("key", now.Add(-MaxSkew-2*time.Second), nonce, network, address, source), network, address, source, ErrExpired},
+		{"future", []string{"key"}, signAt("key", now.Add(MaxSkew+2*time.Second), nonce, network, address, source), network, address, source, ErrExpired},
+		{"within skew", []string{"key"}, signAt("key", now.Add(-MaxSkew/2), nonce, network, address, source), network, address, source, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewVerifier(tt.keys).Verify(tt.token, tt.network, tt.address, tt.source)
+			if !errors.Is(err, tt.expected) {
+				t.Fatalf("got %v, want %v", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	v := NewVerifier([]string{"old", "new"})
+	token := Sign("old", "tcp", "192.0.2.1:22", "")
+	if err := v.Verify(token, "tcp", "192.0.2.1:22", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(token, "tcp", "192.0.2.1:22", ""); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("replayed token: %v", err)
+	}
+	// 每个 token 的随机数不同，同一目标的新签名仍然有效。
+	if err := v.Verify(Sign("new", "tcp", "192.0.2.1:22", ""), "tcp", "192.0.2.1:22", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNilVerifier(t *testing.T) {
+	if v := NewVerifier(nil); v.Verify("", "tcp", "192.0.2.1:22", "") != nil {
+		t.Fatal("a verifier without keys rejected a request")
+	}
+}
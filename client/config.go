@@ -3,6 +3,8 @@ package client
 import (
 	"fmt"
 	"github.com/fmnx/cftun/client/tun/transport/argo"
+	"github.com/fmnx/cftun/e2e"
+	"github.com/fmnx/cftun/log"
 	"strings"
 )
 
@@ -20,11 +22,19 @@ type Config struct {
 	PoolSize  int32     `yaml:"pool-size" json:"pool-size"`
 	GlobalUrl string    `yaml:"global-url" json:"global-url"`
 	Scheme    string    `yaml:"scheme" json:"scheme"`
+	AuthKey   string    `yaml:"auth-key" json:"auth-key"`
+	E2EKey    string    `yaml:"e2e-public-key" json:"e2e-public-key"`
 	Tunnels   []*Tunnel `yaml:"tunnels" json:"tunnels"`
 	Tun       *Tun      `yaml:"tun" json:"tun"`
 }
 
 func (c *Config) Run() {
+	if c.E2EKey != "" {
+		if _, err := e2e.ParseKey(c.E2EKey); err != nil {
+			log.Fatalln("Invalid e2e-public-key: %v", err)
+		}
+	}
+
 	if c.Tun != nil && c.Tun.Enable {
 		params := &argo.Params{
 			Scheme:   c.getScheme(),
@@ -32,6 +42,8 @@ func (c *Config) Run() {
 			Url:      c.GlobalUrl,
 			Port:     c.getPort(),
 			PoolSize: c.getPoolSize(),
+			AuthKey:  c.AuthKey,
+			E2EKey:   c.E2EKey,
 		}
 		c.Tun.Run(params)
 	}
@@ -23,7 +23,7 @@ type TcpConnector struct {
 }
 
 func handleTcp(ws *Websocket, conn net.Conn) {
-	wsConn, err := ws.createWebsocketStream()
+	wsConn, err := ws.createWebsocketStream(conn.RemoteAddr())
 	if err != nil {
 		_ = conn.Close()
 		return
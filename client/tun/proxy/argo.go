@@ -42,6 +42,9 @@ func (a *Argo) Dial(metadata *M.Metadata) (net.Conn, error) {
 
 	conn := &argoConn{
 		Conn: c,
+		sign: func() string {
+			return a.ws.Sign(metadata.Network.String(), metadata.DestinationAddress())
+		},
 	}
 
 	conn.parseHeader(metadata)
@@ -51,13 +54,25 @@ func (a *Argo) Dial(metadata *M.Metadata) (net.Conn, error) {
 
 type argoConn struct {
 	net.Conn
-	header     []byte
-	hdrLen     int
+	header []byte
+	hdrLen int
+	// sign returns the token of the destination, it is signed when the first packet is sent so that it is
+	// fresh however long the connection waited in the pool.
+	sign       func() string
 	mu         sync.Mutex
 	headerSent bool
+	// replied is only used by the reader.
+	replied bool
 }
 
 func (w *argoConn) Read(p []byte) (n int, err error) {
+	if !w.replied {
+		// 服务端先回复首个数据包的处理结果，拒绝时带有原因。
+		w.replied = true
+		if err = argo.ReadReply(w.Conn); err != nil {
+			return 0, err
+		}
+	}
 	n, err = w.Conn.Read(p)
 	if err != nil {
 		return 0, err
@@ -100,8 +115,17 @@ func (w *argoConn) parseHeader(metadata *M.Metadata) {
 }
 
 func (w *argoConn) addHeader(p []byte) []byte {
-	buf := make([]byte, len(p)+w.hdrLen)
+	token := w.sign()
+	hdrLen := w.hdrLen
+	if token != "" {
+		hdrLen += 1 + len(token)
+	}
+	buf := make([]byte, len(p)+hdrLen)
 	copy(buf, w.header)
-	copy(buf[w.hdrLen:], p)
+	if token != "" {
+		buf[w.hdrLen] = byte(len(token))
+		copy(buf[w.hdrLen+1:], token)
+	}
+	copy(buf[hdrLen:], p)
 	return buf
 }
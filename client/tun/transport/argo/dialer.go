@@ -3,8 +3,10 @@ package argo
 import (
 	"errors"
 	"fmt"
+	"github.com/fmnx/cftun/auth"
 	"github.com/fmnx/cftun/client/tun/dialer"
 	"github.com/fmnx/cftun/client/tun/metadata"
+	"github.com/fmnx/cftun/e2e"
 	"github.com/gorilla/websocket"
 	"net"
 	"net/http"
@@ -21,10 +23,13 @@ type Params struct {
 	Url      string `json:"url"`
 	Port     int    `json:"port"`
 	PoolSize int32  `json:"pool-size"`
+	AuthKey  string `json:"auth-key"`
+	E2EKey   string `json:"e2e-public-key"`
 }
 
 type Websocket struct {
 	params   *Params
+	e2eKey   *[32]byte
 	headers  http.Header
 	wsDialer *websocket.Dialer
 	Url      string
@@ -73,6 +78,9 @@ func NewWebsocket(params *Params) *Websocket {
 		stopChan:  make(chan struct{}),
 		connPool:  make(chan net.Conn, params.PoolSize),
 	}
+	if params.E2EKey != "" {
+		ws.e2eKey, _ = e2e.ParseKey(params.E2EKey)
+	}
 	return ws
 }
 
@@ -109,7 +117,13 @@ func (w *Websocket) preDial() {
 
 func (w *Websocket) header(metadata *metadata.Metadata) http.Header {
 	if metadata == nil {
-		return w.headers
+		// 预建连接的目标地址随首个数据包发送，握手时签名的目标为空，首个数据包另带目标的签名。
+		header := w.headers.Clone()
+		header.Set(ReplyHeader, "1")
+		if w.params.AuthKey != "" {
+			header.Set(auth.Header, auth.Sign(w.params.AuthKey, "", "", ""))
+		}
+		return header
 	}
 
 	header := make(http.Header, len(w.headers))
@@ -117,20 +131,56 @@ func (w *Websocket) header(metadata *metadata.Metadata) http.Header {
 	header.Set("User-Agent", "DEV")
 	header.Set("Forward-Dest", metadata.DestinationAddress())
 	header.Set("Forward-Proto", metadata.Network.String())
+	if metadata.SrcIP.IsValid() {
+		header.Set("Forward-Src", metadata.SourceAddress())
+	}
+	if w.params.AuthKey != "" {
+		header.Set(auth.Header, auth.Sign(w.params.AuthKey, metadata.Network.String(), metadata.DestinationAddress(),
+			header.Get("Forward-Src")))
+	}
 	return header
 }
 
+// Sign returns the token binding a destination to the auth key, the first packet of a pre-dialed connection
+// carries it as the handshake could not. It is empty without an auth key.
+func (w *Websocket) Sign(network, address string) string {
+	if w.params.AuthKey == "" {
+		return ""
+	}
+	return auth.Sign(w.params.AuthKey, network, address, "")
+}
+
 func (w *Websocket) connect(metadata *metadata.Metadata) (net.Conn, error) {
-	wsConn, resp, err := w.wsDialer.Dial(w.Url, w.header(metadata))
+	header := w.header(metadata)
+	var handshake *e2e.ClientHandshake
+	if w.e2eKey != nil {
+		var err error
+		if handshake, err = e2e.NewClientHandshake(w.e2eKey); err != nil {
+			return nil, err
+		}
+		header = header.Clone()
+		header.Set(e2e.Header, handshake.PublicKey())
+	}
+
+	wsConn, resp, err := w.wsDialer.Dial(w.Url, header)
 	if resp != nil && resp.Body != nil {
 		_ = resp.Body.Close()
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, StreamErrorFromResponse(resp, err)
 	}
 
-	return &GorillaConn{Conn: wsConn}, nil
+	var conn net.Conn = &GorillaConn{Conn: wsConn}
+	if handshake != nil {
+		session, err := handshake.Finish(resp.Header.Get(e2e.ResponseHeader))
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = session.WrapConn(conn)
+	}
+	return conn, nil
 }
 
 func (w *Websocket) Dial(metadata *metadata.Metadata) (conn net.Conn, headerSent bool, err error) {
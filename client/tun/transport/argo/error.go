@@ -0,0 +1,69 @@
+package argo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+)
+
+// ErrorHeader carries the reason a stream was refused, it matches cfd.ErrorHeader on the server.
+const ErrorHeader = "Cftun-Error"
+
+// ReplyHeader asks the server to reply to the first packet of a pre-dialed stream, it matches cfd.ReplyHeader.
+const ReplyHeader = "Forward-Reply"
+
+const (
+	replyOK      = 0
+	replyRefused = 1
+)
+
+// StreamError is returned when the server refuses to open a stream,
+// for example because the origin is unreachable or the destination is denied.
+type StreamError struct {
+	Status int
+	Reason string
+}
+
+func (e *StreamError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("stream refused: %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("stream refused: %d %s", e.Status, e.Reason)
+}
+
+// StreamErrorFromResponse converts a failed websocket handshake into a StreamError.
+func StreamErrorFromResponse(resp *http.Response, err error) error {
+	if resp != nil && errors.Is(err, websocket.ErrBadHandshake) {
+		return &StreamError{
+			Status: resp.StatusCode,
+			Reason: resp.Header.Get(ErrorHeader),
+		}
+	}
+	return err
+}
+
+// ReadReply reads the reply of the server to the first packet of a pre-dialed stream. A refusal is returned
+// as a StreamError, as if the handshake had been rejected.
+func ReadReply(r io.Reader) error {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return err
+	}
+	switch b[0] {
+	case replyOK:
+		return nil
+	case replyRefused:
+		if _, err := io.ReadFull(r, b[1:]); err != nil {
+			return err
+		}
+		reason := make([]byte, b[3])
+		if _, err := io.ReadFull(r, reason); err != nil {
+			return err
+		}
+		return &StreamError{Status: int(b[1])<<8 | int(b[2]), Reason: string(reason)}
+	default:
+		return fmt.Errorf("invalid stream reply: %d", b[0])
+	}
+}
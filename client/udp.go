@@ -142,7 +142,7 @@ func processOutboundQueue() {
 }
 
 func NewConn(ws *Websocket, listener net.PacketConn, srcAddr net.Addr, udpTimeout int, udpConns *sync.Map) *Connector {
-	remoteConn, err := ws.createWebsocketStream()
+	remoteConn, err := ws.createWebsocketStream(srcAddr)
 	if err != nil {
 		log.Errorln(err.Error())
 		return nil
@@ -2,7 +2,9 @@ package client
 
 import (
 	"fmt"
+	"github.com/fmnx/cftun/auth"
 	"github.com/fmnx/cftun/client/tun/transport/argo"
+	"github.com/fmnx/cftun/e2e"
 	"github.com/fmnx/cftun/log"
 	"github.com/gorilla/websocket"
 	"net"
@@ -15,6 +17,8 @@ type Websocket struct {
 	wsDialer *websocket.Dialer
 	url      string
 	headers  http.Header
+	authKey  string
+	e2eKey   *[32]byte
 }
 
 func NewWebsocket(config *Config, tunnel *Tunnel) *Websocket {
@@ -51,26 +55,58 @@ func NewWebsocket(config *Config, tunnel *Tunnel) *Websocket {
 	headers.Set("Forward-Dest", tunnel.Remote)
 	headers.Set("Forward-Proto", tunnel.Protocol)
 
-	return &Websocket{
+	ws := &Websocket{
 		wsDialer: wsDialer,
 		headers:  headers,
 		url:      fmt.Sprintf("%s://%s", config.getScheme(), tunnel.Url),
+		authKey:  config.AuthKey,
 	}
+	if config.E2EKey != "" {
+		ws.e2eKey, _ = e2e.ParseKey(config.E2EKey)
+	}
+	return ws
 
 }
 
-func (w *Websocket) createWebsocketStream() (net.Conn, error) {
-	wsConn, resp, err := w.wsDialer.Dial(w.url, w.headers)
+func (w *Websocket) createWebsocketStream(srcAddr net.Addr) (net.Conn, error) {
+	headers := w.headers.Clone()
+	if srcAddr != nil {
+		headers.Set("Forward-Src", srcAddr.String())
+	}
+	if w.authKey != "" {
+		headers.Set(auth.Header, auth.Sign(w.authKey, headers.Get("Forward-Proto"), headers.Get("Forward-Dest"),
+			headers.Get("Forward-Src")))
+	}
+	var handshake *e2e.ClientHandshake
+	if w.e2eKey != nil {
+		var err error
+		if handshake, err = e2e.NewClientHandshake(w.e2eKey); err != nil {
+			return nil, err
+		}
+		headers.Set(e2e.Header, handshake.PublicKey())
+	}
+	wsConn, resp, err := w.wsDialer.Dial(w.url, headers)
 
 	if resp != nil && resp.Body != nil {
 		_ = resp.Body.Close()
 	}
 
 	if err != nil {
-		log.Errorln(err.Error())
+		err = argo.StreamErrorFromResponse(resp, err)
+		log.Errorln("%s -> %s: %v", w.headers.Get("Forward-Proto"), w.headers.Get("Forward-Dest"), err)
 		return nil, err
 	}
 
-	return &argo.GorillaConn{Conn: wsConn}, nil
+	var conn net.Conn = &argo.GorillaConn{Conn: wsConn}
+	if handshake != nil {
+		session, err := handshake.Finish(resp.Header.Get(e2e.ResponseHeader))
+		if err != nil {
+			_ = conn.Close()
+			log.Errorln(err.Error())
+			return nil, err
+		}
+		conn = session.WrapConn(conn)
+	}
+	return conn, nil
 
 }
@@ -0,0 +1,114 @@
+package e2e
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxRecordSize keeps every record below the 2 byte length prefix.
+const maxRecordSize = 16 << 10
+
+var errRecordTooLarge = errors.New("e2e record too large")
+
+// Session holds the keys of one stream, one AEAD per direction.
+type Session struct {
+	send cipher.AEAD
+	recv cipher.AEAD
+}
+
+// Wrap encrypts everything written to rw and decrypts everything read from it.
+// Each Write is sent as one or more records and each Read returns at most one record,
+// so datagram boundaries survive as long as they fit in a record.
+func (s *Session) Wrap(rw io.ReadWriter) *Stream {
+	return &Stream{rw: rw, send: s.send, recv: s.recv}
+}
+
+// WrapConn is Wrap for a net.Conn, keeping its addresses and deadlines.
+func (s *Session) WrapConn(conn net.Conn) net.Conn {
+	return &secureConn{Conn: conn, stream: s.Wrap(conn)}
+}
+
+type Stream struct {
+	rw   io.ReadWriter
+	send cipher.AEAD
+	recv cipher.AEAD
+
+	writeMu   sync.Mutex
+	sendNonce uint64
+
+	// for use by Read only
+	recvNonce uint64
+	readBuf   []byte
+}
+
+func nonce(counter uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	if len(s.readBuf) == 0 {
+		var hdr [2]byte
+		if _, err := io.ReadFull(s.rw, hdr[:]); err != nil {
+			return 0, err
+		}
+		record := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(s.rw, record); err != nil {
+			return 0, err
+		}
+		plaintext, err := s.recv.Open(record[:0], nonce(s.recvNonce), record, nil)
+		if err != nil {
+			return 0, err
+		}
+		s.recvNonce++
+		s.readBuf = plaintext
+	}
+	n := copy(p, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordSize {
+			chunk = chunk[:maxRecordSize]
+		}
+		size := len(chunk) + s.send.Overhead()
+		if size > 0xffff {
+			return written, errRecordTooLarge
+		}
+		buf := make([]byte, 2, 2+size)
+		binary.BigEndian.PutUint16(buf, uint16(size))
+		buf = s.send.Seal(buf, nonce(s.sendNonce), chunk, nil)
+		s.sendNonce++
+		if _, err := s.rw.Write(buf); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+type secureConn struct {
+	net.Conn
+	stream *Stream
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	return c.stream.Read(p)
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	return c.stream.Write(p)
+}
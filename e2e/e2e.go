@@ -0,0 +1,166 @@
+package e2e
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+const (
+	// Header carries the client's ephemeral public key.
+	Header = "Forward-Key"
+	// ResponseHeader carries the server's ephemeral public key.
+	ResponseHeader = "Forward-Server-Key"
+
+	info = "cftun e2e v1"
+)
+
+var ErrHandshake = errors.New("end-to-end handshake failed")
+
+// ParseKey decodes a base64 X25519 key, the same format as `wg genkey` and `wg pubkey`.
+func ParseKey(s string) (*[32]byte, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != 32 {
+		return nil, fmt.Errorf("invalid key length: %d", len(buf))
+	}
+	return (*[32]byte)(buf), nil
+}
+
+func newEphemeral() (priv, pub *[32]byte, err error) {
+	priv = new([32]byte)
+	if _, err = rand.Read(priv[:]); err != nil {
+		return nil, nil, err
+	}
+	pub = new([32]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return priv, pub, nil
+}
+
+func dh(priv, pub *[32]byte) ([]byte, error) {
+	return curve25519.X25519(priv[:], pub[:])
+}
+
+// deriveSession mixes the static and ephemeral shared secrets into one key per direction.
+func deriveSession(staticSecret, ephemeralSecret []byte, clientEphemeral, serverEphemeral, serverStatic *[32]byte, isClient bool) (*Session, error) {
+	salt := make([]byte, 0, 96)
+	salt = append(salt, clientEphemeral[:]...)
+	salt = append(salt, serverEphemeral[:]...)
+	salt = append(salt, serverStatic[:]...)
+
+	kdf := hkdf.New(sha256.New, append(staticSecret, ephemeralSecret...), salt, []byte(info))
+	c2s := make([]byte, chacha20poly1305.KeySize)
+	s2c := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, c2s); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(kdf, s2c); err != nil {
+		return nil, err
+	}
+
+	if !isClient {
+		c2s, s2c = s2c, c2s
+	}
+	send, err := chacha20poly1305.New(c2s)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := chacha20poly1305.New(s2c)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{send: send, recv: recv}, nil
+}
+
+// ClientHandshake authenticates the server by its pinned static public key.
+type ClientHandshake struct {
+	serverStatic *[32]byte
+	priv         *[32]byte
+	pub          *[32]byte
+}
+
+func NewClientHandshake(serverStatic *[32]byte) (*ClientHandshake, error) {
+	priv, pub, err := newEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	return &ClientHandshake{serverStatic: serverStatic, priv: priv, pub: pub}, nil
+}
+
+// PublicKey returns the value of Header.
+func (h *ClientHandshake) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(h.pub[:])
+}
+
+// Finish derives the session from the value of ResponseHeader.
+func (h *ClientHandshake) Finish(serverKey string) (*Session, error) {
+	if serverKey == "" {
+		return nil, fmt.Errorf("%w: server did not answer the handshake", ErrHandshake)
+	}
+	serverEphemeral, err := ParseKey(serverKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrHandshake, err.Error())
+	}
+	staticSecret, err := dh(h.priv, h.serverStatic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrHandshake, err.Error())
+	}
+	ephemeralSecret, err := dh(h.priv, serverEphemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrHandshake, err.Error())
+	}
+	return deriveSession(staticSecret, ephemeralSecret, h.pub, serverEphemeral, h.serverStatic, true)
+}
+
+// Server holds the server's static keypair.
+type Server struct {
+	priv *[32]byte
+	pub  *[32]byte
+}
+
+func NewServer(privateKey *[32]byte) *Server {
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, privateKey)
+	return &Server{priv: privateKey, pub: pub}
+}
+
+// PublicKey returns the static public key clients have to pin.
+func (s *Server) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.pub[:])
+}
+
+// Accept answers a client handshake, returning the session and the value of ResponseHeader.
+func (s *Server) Accept(clientKey string) (*Session, string, error) {
+	if clientKey == "" {
+		return nil, "", fmt.Errorf("%w: client did not start the handshake", ErrHandshake)
+	}
+	clientEphemeral, err := ParseKey(clientKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrHandshake, err.Error())
+	}
+	priv, pub, err := newEphemeral()
+	if err != nil {
+		return nil, "", err
+	}
+	staticSecret, err := dh(s.priv, clientEphemeral)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrHandshake, err.Error())
+	}
+	ephemeralSecret, err := dh(priv, clientEphemeral)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrHandshake, err.Error())
+	}
+	session, err := deriveSession(staticSecret, ephemeralSecret, clientEphemeral, pub, s.pub, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return session, base64.StdEncoding.EncodeToString(pub[:]), nil
+}
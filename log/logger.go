@@ -0,0 +1,43 @@
+package log
+
+import "strings"
+
+// Logger prefixes every message, e.g. with the name of a tunnel. A nil *Logger logs without prefix.
+type Logger struct {
+	prefix string
+}
+
+// WithPrefix returns a Logger writing "[name] " before each message, or nil when name is empty.
+func WithPrefix(name string) *Logger {
+	if name == "" {
+		return nil
+	}
+	return &Logger{prefix: "[" + strings.ReplaceAll(name, "%", "%%") + "] "}
+}
+
+func (l *Logger) format(format string) string {
+	if l == nil {
+		return format
+	}
+	return l.prefix + format
+}
+
+func (l *Logger) Infoln(format string, v ...any) {
+	Infoln(l.format(format), v...)
+}
+
+func (l *Logger) Warnln(format string, v ...any) {
+	Warnln(l.format(format), v...)
+}
+
+func (l *Logger) Errorln(format string, v ...any) {
+	Errorln(l.format(format), v...)
+}
+
+func (l *Logger) Debugln(format string, v ...any) {
+	Debugln(l.format(format), v...)
+}
+
+func (l *Logger) Fatalln(format string, v ...any) {
+	Fatalln(l.format(format), v...)
+}
@@ -1,3 +1,6 @@
+// See curveX25519MLKEM768 in server/cfd/tls.go.
+//
+//go:debug tlsmlkem=1
 package main
 
 import (
@@ -42,6 +45,7 @@ func parseConfig(configFile string) (*RawConfig, error) {
 var (
 	configFile         string
 	token              string
+	credentialsFile    string
 	isQuick            bool
 	proxy4             bool
 	proxy6             bool
@@ -58,6 +62,7 @@ var (
 func init() {
 	flag.StringVar(&configFile, "config", "./config.json", "")
 	flag.StringVar(&token, "token", "", "")
+	flag.StringVar(&credentialsFile, "credentials-file", "", "")
 	flag.BoolVar(&isQuick, "quick", false, "")
 	flag.BoolVar(&proxy4, "proxy4", false, "")
 	flag.BoolVar(&proxy6, "proxy6", false, "")
@@ -68,6 +73,7 @@ func init() {
 		fmt.Println("Usage:")
 		fmt.Printf("  -config\tSpecify the path to the config file.(default: \"./config.json\")\n")
 		fmt.Printf("  -token\tWhen a token is provided, the configuration file will be ignored and the program will run in server mode only.\n")
+		fmt.Printf("  -credentials-file\tRun a named tunnel from a cloudflared credentials file, like -token.\n")
 		fmt.Printf("  -quick\tTemporary server, no Cloudflare account required, based on try.cloudflare.com.\n")
 		fmt.Printf("  -proxy4\tUse the WARP proxy for IPv4 traffic; Ignored when using a configuration file.\n")
 		fmt.Printf("  -proxy6\tUse the WARP proxy for IPv4 traffic; Ignored when using a configuration file.\n")
@@ -83,14 +89,15 @@ func main() {
 		printVersion(bInfo)
 		return
 	}
-	if token != "" || isQuick { // command line.
+	var srv *server.Config
+	if token != "" || credentialsFile != "" || isQuick { // command line.
 		var warp *server.Warp
 		if proxy4 || proxy6 {
 			warp = &server.Warp{
-				Auto:   true,
-				Port:   uint16(port),
-				Proxy4: proxy4,
-				Proxy6: proxy6,
+				WarpAccount: server.WarpAccount{Auto: true},
+				Port:        uint16(port),
+				Proxy4:      proxy4,
+				Proxy6:      proxy6,
 			}
 		}
 		if isQuick {
@@ -98,10 +105,11 @@ func main() {
 		} else if token == "quick" {
 			isQuick = true
 		}
-		srv := &server.Config{
-			Token:  token,
-			HaConn: 4,
-			Warp:   warp,
+		srv = &server.Config{
+			Token:           token,
+			CredentialsFile: credentialsFile,
+			HaConn:          4,
+			Warp:            warp,
 		}
 		go srv.Run(bInfo, quickData)
 	} else {
@@ -124,12 +132,12 @@ func main() {
 
 		time.Sleep(100 * time.Millisecond)
 
-		s := rawConfig.Server
-		if s != nil {
-			if s.Token == "quick" {
+		srv = rawConfig.Server
+		if srv != nil {
+			if srv.Token == "quick" {
 				isQuick = true
 			}
-			go s.Run(bInfo, quickData)
+			go srv.Run(bInfo, quickData)
 		}
 
 	}
@@ -142,6 +150,9 @@ func main() {
 			if isQuick {
 				quickData.Save()
 			}
+			if srv != nil {
+				shutdown(srv, sigCh)
+			}
 			if tunName != "" {
 				client.DeleteTunDevice(tunName)
 			}
@@ -150,6 +161,19 @@ func main() {
 	}
 }
 
+// shutdown drains the tunnel connections, a second signal exits immediately.
+func shutdown(srv *server.Config, sigCh <-chan os.Signal) {
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-sigCh:
+	}
+}
+
 func printVersion(buildInfo *server.BuildInfo) {
 	fmt.Printf("GoOS: %s\nGoArch: %s\nGoVersion: %s\nBuildType: %s\nCftunVersion: %s\nBuildDate: %s\n",
 		buildInfo.GoOS, buildInfo.GoArch, buildInfo.GoVersion, buildInfo.BuildType, Version, BuildDate)
@@ -1,3 +1,6 @@
+// Built on its own by build.sh, go build in this directory builds main.go.
+//go:build ignore
+
 package main
 
 import (
@@ -1,3 +1,9 @@
+// Built on its own by build.sh, go build in this directory builds main.go.
+//go:build ignore
+
+// See curveX25519MLKEM768 in server/cfd/tls.go.
+//
+//go:debug tlsmlkem=1
 package main
 
 import (
@@ -38,6 +44,7 @@ func parseConfig(configFile string) (*server.Config, error) {
 var (
 	configFile         string
 	token              string
+	credentialsFile    string
 	isQuick            bool
 	proxy4             bool
 	proxy6             bool
@@ -53,6 +60,7 @@ var (
 func init() {
 	flag.StringVar(&configFile, "config", "./config.json", "")
 	flag.StringVar(&token, "token", "", "")
+	flag.StringVar(&credentialsFile, "credentials-file", "", "")
 	flag.BoolVar(&isQuick, "quick", false, "")
 	flag.BoolVar(&proxy4, "proxy4", false, "")
 	flag.BoolVar(&proxy6, "proxy6", false, "")
@@ -64,6 +72,7 @@ func init() {
 		fmt.Println("Usage:")
 		fmt.Printf("  -config\tSpecify the path to the config file.(default: \"./config.json\")\n")
 		fmt.Printf("  -token\tWhen a token is provided, the configuration file will be ignored.\n")
+		fmt.Printf("  -credentials-file\tRun a named tunnel from a cloudflared credentials file, like -token.\n")
 		fmt.Printf("  -quick\tTemporary server, no Cloudflare account required, based on try.cloudflare.com.\n")
 		fmt.Printf("  -proxy4\tUse the WARP proxy for IPv4 traffic; Ignored when using a configuration file.\n")
 		fmt.Printf("  -proxy6\tUse the WARP proxy for IPv6 traffic; Ignored when using a configuration file.\n")
@@ -81,14 +90,14 @@ func main() {
 	}
 	
 	var srv *server.Config
-	if token != "" || isQuick {
+	if token != "" || credentialsFile != "" || isQuick {
 		var warp *server.Warp
 		if proxy4 || proxy6 {
 			warp = &server.Warp{
-				Auto:   true,
-				Port:   uint16(port),
-				Proxy4: proxy4,
-				Proxy6: proxy6,
+				WarpAccount: server.WarpAccount{Auto: true},
+				Port:        uint16(port),
+				Proxy4:      proxy4,
+				Proxy6:      proxy6,
 			}
 		}
 		if isQuick {
@@ -97,9 +106,10 @@ func main() {
 			isQuick = true
 		}
 		srv = &server.Config{
-			Token:  token,
-			HaConn: 4,
-			Warp:   warp,
+			Token:           token,
+			CredentialsFile: credentialsFile,
+			HaConn:          4,
+			Warp:            warp,
 		}
 	} else {
 		var err error
@@ -125,11 +135,25 @@ func main() {
 			if isQuick {
 				quickData.Save()
 			}
+			shutdown(srv, sigCh)
 			return
 		}
 	}
 }
 
+// shutdown drains the tunnel connections, a second signal exits immediately.
+func shutdown(srv *server.Config, sigCh <-chan os.Signal) {
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-sigCh:
+	}
+}
+
 func printVersion(buildInfo *server.BuildInfo) {
 	fmt.Printf("GoOS: %s\nGoArch: %s\nGoVersion: %s\nBuildType: %s\nCftunVersion: %s\nBuildDate: %s\n",
 		buildInfo.GoOS, buildInfo.GoArch, buildInfo.GoVersion, buildInfo.BuildType, Version, BuildDate)
@@ -0,0 +1,31 @@
+package cfd
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff is a capped exponential backoff with jitter.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+
+	retries int
+}
+
+// Duration returns the next delay, a random value between half and all of Base*2^retries capped at Max.
+func (b *Backoff) Duration() time.Duration {
+	d := b.Base
+	for i := 0; i < b.retries && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.retries++
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (b *Backoff) Reset() {
+	b.retries = 0
+}
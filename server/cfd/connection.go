@@ -4,25 +4,102 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/fmnx/cftun/auth"
+	"github.com/fmnx/cftun/e2e"
 	"github.com/fmnx/cftun/log"
 	"github.com/quic-go/quic-go"
+	"io"
 	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type DialFunc func(network string, address string) (net.Conn, error)
 
 type Proxy struct {
-	DialFunc DialFunc
-	Proxy4   bool
-	Proxy6   bool
+	Egress             *Egress
+	ProxyProtocol      string
+	ProxyProtocolDests []string
+	Policy             *Policy
+	Auth               *auth.Verifier
+	E2E                *e2e.Server
+	Services           *Services
+	Metrics            *Metrics
+	// RemoteConfig applies the configurations pushed by the edge.
+	RemoteConfig bool
+	// Log prefixes the messages of the tunnel, nil logs without prefix.
+	Log *log.Logger
+
+	ingress atomic.Pointer[Ingress]
+
+	// configMu serializes remote configuration updates, configVersion is valid once configApplied.
+	configMu      sync.Mutex
+	configApplied bool
+	configVersion int32
 }
 
-func (d *Proxy) Dial(network, address string) (net.Conn, error) {
-	if isIPv6 := address[0] == '['; (isIPv6 && d.Proxy6) || (!isIPv6 && d.Proxy4) {
-		return d.DialFunc(network, address)
+// SetIngress replaces the ingress rules, it is safe to call while serving.
+func (d *Proxy) SetIngress(ingress *Ingress) {
+	d.ingress.Store(ingress)
+}
+
+func (d *Proxy) Ingress() *Ingress {
+	return d.ingress.Load()
+}
+
+// Dial connects to address through its outbound, addrs are the addresses returned by Policy.Check.
+func (d *Proxy) Dial(network, address string, addrs ...netip.Addr) (net.Conn, error) {
+	return d.dial("", network, address, addrs)
+}
+
+// dial records the latency under the service when set, under the outbound otherwise. The destination itself
+// comes from the client and is never used as a label.
+func (d *Proxy) dial(service, network, address string, addrs []netip.Addr) (conn net.Conn, err error) {
+	start := time.Now()
+	var outbound *Outbound
+	defer func() {
+		route := "none"
+		switch {
+		case service != "":
+			route = ServicePrefix + service
+		case outbound != nil:
+			route = outbound.Name
+		}
+		d.Metrics.dialed(route, time.Since(start), err)
+	}()
+	conn, outbound, err = d.Egress.dial(network, address, addrs)
+	return conn, err
+}
+
+// DialTimeout is Dial giving up after timeout, the outbounds themselves have no deadline.
+func (d *Proxy) DialTimeout(network, address string, timeout time.Duration, addrs ...netip.Addr) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := d.Dial(network, address, addrs...)
+		ch <- result{conn, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-ch; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %s %s: timeout after %s", network, address, timeout)
 	}
-	return net.Dial(network, address)
 }
 
 type QuicConnection struct {
@@ -32,7 +109,13 @@ type QuicConnection struct {
 	rpcTimeout  time.Duration
 	gracePeriod time.Duration
 
-	proxy *Proxy
+	proxy     *Proxy
+	datagrams *datagramMuxer
+
+	onRegistered func(*ConnectionDetails)
+	// shutdown is closed to unregister the connection and drain its streams.
+	shutdown <-chan struct{}
+	streams  activeStreams
 }
 
 func NewTunnelConnection(
@@ -41,17 +124,21 @@ func NewTunnelConnection(
 	rpcTimeout time.Duration,
 	gracePeriod time.Duration,
 	proxy *Proxy,
+	datagramVersion string,
 ) (*QuicConnection, error) {
-	return &QuicConnection{
+	q := &QuicConnection{
 		conn:        conn,
 		connIndex:   connIndex,
 		rpcTimeout:  rpcTimeout,
 		gracePeriod: gracePeriod,
 		proxy:       proxy,
-	}, nil
+	}
+	q.datagrams = newDatagramMuxer(q, datagramVersion)
+	return q, nil
 }
 
 func (q *QuicConnection) Serve(ctx context.Context, credentials *Credentials, connOptions *ConnectionOptions) error {
+	defer q.Close()
 	c, err := q.conn.OpenStream()
 	if err != nil {
 		return fmt.Errorf("failed to open a registration control stream: %w", err)
@@ -60,29 +147,43 @@ func (q *QuicConnection) Serve(ctx context.Context, credentials *Credentials, co
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	for {
-		connectionDetail, err := RegisterConnection(
-			ctx,
-			c,
-			q.connIndex,
-			credentials,
-			connOptions)
+	registration := NewRegistrationClient(ctx, c, cloudflaredServer(q.proxy, q.datagrams))
+	defer registration.Close()
 
-		if err != nil {
-			log.Errorln(err.Error())
-		}
-		if connectionDetail != nil && connectionDetail.TunnelIsRemotelyManaged {
-			println(connectionDetail.Location)
-			break
-		}
-		time.Sleep(1 * time.Second)
+	connectionDetail, err := registration.RegisterConnection(ctx, q.connIndex, credentials, connOptions)
+	if err != nil {
+		return fmt.Errorf("failed to register connection %d: %w", q.connIndex, err)
+	}
+	q.proxy.Log.Infoln("Registered connection %d at %s, remotely managed: %t",
+		q.connIndex, connectionDetail.Location, connectionDetail.TunnelIsRemotelyManaged)
+	if q.onRegistered != nil {
+		q.onRegistered(connectionDetail)
 	}
 
-	return q.acceptStream(ctx)
+	go q.datagrams.serve(ctx)
+
+	// 优雅关闭：先注销连接，边缘不再分配新请求，再停止接受新流并等待已有流结束。
+	acceptCtx, stopAccept := context.WithCancel(ctx)
+	defer stopAccept()
+	var shuttingDown atomic.Bool
+	go func() {
+		select {
+		case <-q.shutdown:
+			shuttingDown.Store(true)
+			unregister(registration, q.connIndex, q.rpcTimeout, q.proxy.Log)
+			stopAccept()
+		case <-acceptCtx.Done():
+		}
+	}()
+
+	err = q.acceptStream(acceptCtx)
+	if shuttingDown.Load() {
+		q.streams.drain(q.connIndex, q.gracePeriod, q.proxy.Log)
+	}
+	return err
 }
 
 func (q *QuicConnection) acceptStream(ctx context.Context) error {
-	defer q.Close()
 	for {
 		quicStream, err := q.conn.AcceptStream(ctx)
 		if err != nil {
@@ -91,7 +192,11 @@ func (q *QuicConnection) acceptStream(ctx context.Context) error {
 			}
 			return fmt.Errorf("failed to accept QUIC stream: %w", err)
 		}
-		go q.handleQuicStream(quicStream)
+		q.streams.add()
+		go func() {
+			defer q.streams.done()
+			q.handleQuicStream(quicStream)
+		}()
 	}
 }
 
@@ -102,87 +207,156 @@ func (q *QuicConnection) handleQuicStream(quicStream quic.Stream) {
 	}
 	defer stream.Close()
 
+	signature, err := readSignature(stream)
+	if err != nil {
+		q.proxy.Log.Warnln("Failed to read stream signature: %v", err)
+		return
+	}
+	if signature == rpcStreamProtocolSignature {
+		q.serveRPCStream(ctx, stream)
+		return
+	}
+
 	noCloseStream := &nopCloserReadWriter{ReadWriteCloser: stream}
 
-	n, err := noCloseStream.Read(make([]byte, 6)) //ignore 6 byte
-	if err != nil || n != 6 {
-		println(err.Error())
+	requestServerStream := &RequestServerStream{ReadWriteCloser: noCloseStream}
+
+	request, err := requestServerStream.ReadConnectRequestData()
+	if err != nil {
+		return
+	}
+	q.proxy.handleRequest(ctx, requestServerStream, request)
+}
+
+// handleRequest serves one edge request, whichever transport it arrived on.
+func (d *Proxy) handleRequest(ctx context.Context, requestServerStream *RequestServerStream, request *ConnectRequest) {
+	var (
+		remoteConn net.Conn
+		err        error
+	)
+	d.Metrics.streamStarted(request.Type.String())
+	defer d.Metrics.streamFinished(request.Type.String())
+
+	// 带有 Forward-* 头的 websocket 请求来自客户端，始终交给中继处理。
+	if rule := d.Ingress().match(request); request.Type == ConnectionTypeHTTP ||
+		(request.Type == ConnectionTypeWebsocket && rule != nil && !rule.relay && !request.IsRelay()) {
+		d.serveIngress(ctx, requestServerStream, request, rule)
 		return
 	}
 
-	requestServerStream := &RequestServerStream{ReadWriteCloser: noCloseStream}
+	// 未签名的 Forward-Src 可以任意伪造，只在启用认证时使用。
+	source := request.Source(d.Auth != nil)
+	network, address := request.Network(), request.Address()
+	reject := func(status int, reason string, err error) {
+		d.Log.Warnln("Rejected stream from %s: %v", source, err)
+		_ = requestServerStream.Reject(status, reason)
+	}
 
-	var remoteConn net.Conn
-	network, address, err := requestServerStream.Accept()
+	if err = d.Auth.Verify(request.Auth(), network, address, request.ForwardedSource()); err != nil {
+		reject(http.StatusForbidden, ReasonAuthFailed, err)
+		return
+	}
+	service, err := d.Services.Lookup(network, address)
 	if err != nil {
+		reject(http.StatusBadGateway, ReasonUnknownService, err)
 		return
 	}
-	if network != "" && address != "" {
-		remoteConn, err = q.DialWithRetry(network, address, 3)
+	var checked []netip.Addr
+	if service == nil && network != "" && address != "" {
+		if checked, err = d.Policy.Check(network, address); err != nil {
+			reject(http.StatusForbidden, ReasonPolicyDenied, err)
+			return
+		}
+	}
+	var (
+		session *e2e.Session
+		extra   []Metadata
+	)
+	if d.E2E != nil {
+		var serverKey string
+		session, serverKey, err = d.E2E.Accept(request.E2EKey())
 		if err != nil {
+			reject(http.StatusForbidden, ReasonHandshakeFailed, err)
 			return
 		}
+		extra = append(extra, Metadata{"HttpHeader:" + e2e.ResponseHeader, serverKey})
+	}
+
+	// 先连接源站再确认升级，源站不可达时客户端能收到明确的错误。
+	if service != nil {
+		remoteConn, address, err = d.DialService(network, service)
+	} else if network != "" && address != "" {
+		remoteConn, err = d.DialWithRetry(network, address, 3, checked...)
+	}
+	if err != nil {
+		status, reason := dialFailure(err)
+		reject(status, reason, err)
+		return
+	}
+	if remoteConn != nil {
+		if err = d.writeProxyHeader(remoteConn, network, address, source); err != nil {
+			_ = remoteConn.Close()
+			reject(http.StatusBadGateway, ReasonDialFailed, err)
+			return
+		}
+	}
+	if err = requestServerStream.Accept(request, extra...); err != nil {
+		if remoteConn != nil {
+			_ = remoteConn.Close()
+		}
+		return
 	}
 
 	wsCtx, cancel := context.WithCancel(ctx)
 	wsConn := NewConn(wsCtx, requestServerStream)
+	var ws io.ReadWriter = wsConn
+	if session != nil {
+		// 与客户端一致，加密的是 websocket 消息的内容。
+		ws = session.Wrap(wsConn)
+	}
 	defer wsConn.Close()
 	defer cancel()
 
-	q.handleConn(ctx, cancel, wsConn, remoteConn)
+	d.handleConn(ctx, cancel, wsConn, ws, remoteConn, source, request.WantsReply())
 
 }
 
-func (q *QuicConnection) handleConn(ctx context.Context, cancel context.CancelFunc, wsConn *Conn, remoteConn net.Conn) {
+// handleConn relays between ws, the payload of wsConn, and remoteConn. Without remoteConn the destination
+// is read from the first packet, and the outcome is replied to clients that asked for it.
+func (d *Proxy) handleConn(ctx context.Context, cancel context.CancelFunc, wsConn *Conn, ws io.ReadWriter, remoteConn net.Conn, source string, reply bool) {
 	buf := make([]byte, 32<<10)
 
 	if remoteConn == nil {
-		nr, err := wsConn.Read(buf)
-		if err != nil {
+		var payload []byte
+		var err error
+		if remoteConn, payload, err = d.dialFirstPacket(ws, buf, source, reply); err != nil {
 			return
 		}
-		packet, err := Decode(buf[:nr])
-		if err != nil {
-			return
-		}
-		network := packet.protocol()
-		address := packet.address()
-		remoteConn, err = q.DialWithRetry(network, address, 3)
-		if err != nil {
-			return
-		}
-
-		nw, err := remoteConn.Write(packet.Payload)
-		if err != nil {
-			return
-		}
-		if nw != len(packet.Payload) {
+		nw, err := remoteConn.Write(payload)
+		if err != nil || nw != len(payload) {
+			_ = remoteConn.Close()
 			return
 		}
+		d.Metrics.received(nw)
 	}
 
-	go handleRemoteConn(ctx, cancel, remoteConn, wsConn)
+	go handleRemoteConn(ctx, cancel, remoteConn, wsConn, ws, d.Metrics)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			nr, err := wsConn.Read(buf)
+			nr, err := ws.Read(buf)
 			if err != nil {
 				return
 			}
 
-			//if nr == 2 && buf[0] == 137 && buf[1] == 0 {
-			//	println("recv client ping msg")
-			//	_, _ = wsConn.Write([]byte{'p', 'o', 'n', 'g'})
-			//	continue
-			//}
-
 			nw, err := remoteConn.Write(buf[:nr])
 			if err != nil {
 				return
 			}
+			d.Metrics.received(nw)
 			if nw != nr {
 				return
 			}
@@ -192,23 +366,97 @@ func (q *QuicConnection) handleConn(ctx context.Context, cancel context.CancelFu
 
 }
 
-func handleRemoteConn(ctx context.Context, cancel context.CancelFunc, remoteConn net.Conn, wsConn *Conn) {
+// dialFirstPacket connects to the destination carried by the first packet of a pre-dialed stream and returns
+// the payload that followed it. The upgrade has already been accepted, so with reply a refusal is sent in
+// band with the status and reason Reject would have used.
+func (d *Proxy) dialFirstPacket(ws io.ReadWriter, buf []byte, source string, reply bool) (net.Conn, []byte, error) {
+	nr, err := ws.Read(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	packet, err := Decode(buf[:nr])
+	if err != nil {
+		return nil, nil, err
+	}
+	network, address := packet.protocol(), packet.address()
+	reject := func(status int, reason string, err error) (net.Conn, []byte, error) {
+		d.Log.Warnln("Rejected stream from %s: %v", source, err)
+		if reply {
+			_ = writeReply(ws, status, reason)
+		}
+		return nil, nil, err
+	}
+
+	// 握手时签名的目标为空，需要校验首个数据包中目标地址的签名。
+	if d.Auth != nil {
+		var token string
+		if token, packet.Payload, err = cutToken(packet.Payload); err == nil {
+			err = d.Auth.Verify(token, network, address, "")
+		}
+		if err != nil {
+			return reject(http.StatusForbidden, ReasonAuthFailed, err)
+		}
+	}
+	checked, err := d.Policy.Check(network, address)
+	if err != nil {
+		return reject(http.StatusForbidden, ReasonPolicyDenied, err)
+	}
+	remoteConn, err := d.DialWithRetry(network, address, 3, checked...)
+	if err != nil {
+		status, reason := dialFailure(err)
+		return reject(status, reason, err)
+	}
+	if err = d.writeProxyHeader(remoteConn, network, address, source); err != nil {
+		_ = remoteConn.Close()
+		return reject(http.StatusBadGateway, ReasonDialFailed, err)
+	}
+	if reply {
+		if err = writeReply(ws, http.StatusOK, ""); err != nil {
+			_ = remoteConn.Close()
+			return nil, nil, err
+		}
+	}
+	return remoteConn, packet.Payload, nil
+}
+
+// cutToken splits the length-prefixed auth token from the payload of a first packet.
+func cutToken(payload []byte) (string, []byte, error) {
+	if len(payload) == 0 || len(payload) < 1+int(payload[0]) {
+		return "", nil, auth.ErrMissing
+	}
+	n := 1 + int(payload[0])
+	return string(payload[1:n]), payload[n:], nil
+}
+
+// writeReply answers the first packet of a pre-dialed stream: a replyOK byte, or replyRefused followed by
+// the HTTP status, the length of the reason and the reason.
+func writeReply(w io.Writer, status int, reason string) error {
+	if status == http.StatusOK {
+		_, err := w.Write([]byte{replyOK})
+		return err
+	}
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	b := []byte{replyRefused, byte(status >> 8), byte(status), byte(len(reason))}
+	_, err := w.Write(append(b, reason...))
+	return err
+}
+
+func handleRemoteConn(ctx context.Context, cancel context.CancelFunc, remoteConn net.Conn, wsConn *Conn, ws io.Writer, metrics *Metrics) {
 	var err error
 
 	defer func() {
 		cancel()
 		wsConn.Close()
 		_ = remoteConn.Close()
-		//if err != nil {
-		//	fmt.Printf("handleRemoteConn exit: %v\n", err)
-		//
-		//}
 	}()
 
 	setReadDeadline := func(c net.Conn) error { return nil }
-	if _, ok := remoteConn.(*net.UDPConn); ok {
+	// WARP 和出口代理的 UDP 连接不是 *net.UDPConn，按远端地址类型判断。
+	if remoteAddr, ok := remoteConn.RemoteAddr().(*net.UDPAddr); ok {
 		udpTimeout := 60 * time.Second
-		if remoteConn.RemoteAddr().(*net.UDPAddr).Port == 53 { // DNS query
+		if remoteAddr.Port == 53 { // DNS query
 			udpTimeout = 1 * time.Second
 		}
 		setReadDeadline = func(c net.Conn) error {
@@ -231,10 +479,11 @@ func handleRemoteConn(ctx context.Context, cancel context.CancelFunc, remoteConn
 			if err != nil {
 				return
 			}
-			nw, err = wsConn.Write(buf[:nr])
+			nw, err = ws.Write(buf[:nr])
 			if err != nil {
 				return
 			}
+			metrics.sent(nw)
 			if nw != nr {
 				err = errors.New("short write")
 				return
@@ -247,14 +496,14 @@ func (q *QuicConnection) Close() {
 	_ = q.conn.CloseWithError(0, "")
 }
 
-func (q *QuicConnection) DialWithRetry(network, address string, maxRetries int) (net.Conn, error) {
+func (d *Proxy) DialWithRetry(network, address string, maxRetries int, addrs ...netip.Addr) (net.Conn, error) {
 	var (
 		conn net.Conn
 		err  error
 	)
 
 	for i := 0; i < maxRetries; i++ {
-		conn, err = q.proxy.Dial(network, address)
+		conn, err = d.Dial(network, address, addrs...)
 		if err == nil {
 			return conn, nil
 		}
@@ -263,14 +512,26 @@ func (q *QuicConnection) DialWithRetry(network, address string, maxRetries int)
 			return nil, fmt.Errorf("non-retryable error: %w", err)
 		}
 
-		fmt.Printf("Attempt %d failed: %v. Retrying...\n", i+1, err)
-
+		d.Log.Warnln("Dial %s %s attempt %d failed: %v, retrying", network, address, i+1, err)
 		time.Sleep(100 * time.Millisecond)
 	}
 
 	return nil, fmt.Errorf("after %d retries: %w", maxRetries, err)
 }
 
+// dialFailure maps a dial error to the HTTP status and reason reported to the client.
+func dialFailure(err error) (int, string) {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, ReasonDialTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, ReasonDialRefused
+	default:
+		return http.StatusBadGateway, ReasonDialFailed
+	}
+}
+
 func isRetryableError(err error) bool {
 	if neterr, ok := err.(net.Error); ok {
 		return neterr.Timeout()
@@ -0,0 +1,340 @@
+package cfd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/uuid"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DatagramV2 = "v2"
+	DatagramV3 = "v3"
+
+	FeatureDatagramV2 = "support_datagram_v2"
+	FeatureDatagramV3 = "support_datagram_v3_2"
+)
+
+// Datagram v2 carries the session ID and the type after the payload.
+const (
+	datagramV2TypeUDP byte = iota
+	datagramV2TypeIP
+	datagramV2TypeIPWithTrace
+	datagramV2TypeTracingSpan
+)
+
+// Datagram v3 carries the type first, sessions are registered with datagrams instead of RPCs.
+const (
+	datagramV3TypeRegistration         byte = 0x0
+	datagramV3TypePayload              byte = 0x1
+	datagramV3TypeICMP                 byte = 0x2
+	datagramV3TypeRegistrationResponse byte = 0x3
+
+	datagramV3FlagIPv6    byte = 0x01
+	datagramV3FlagTraced  byte = 0x02
+	datagramV3FlagBundled byte = 0x04
+
+	datagramV3ResponseOK               byte = 0x00
+	datagramV3ResponseUnreachable      byte = 0x01
+	datagramV3ResponseUnableToBind     byte = 0x02
+	datagramV3ResponseTooManySessions  byte = 0x03
+	datagramV3ResponseErrorWithMessage byte = 0xff
+)
+
+const (
+	sessionIDLength = 16
+	// maxDatagramPayload leaves room for the datagram headers within the edge MTU.
+	maxDatagramPayload = 1280
+	// defaultSessionIdle is used when the edge gives no idle hint.
+	defaultSessionIdle = 210 * time.Second
+	sessionDialTimeout = 5 * time.Second
+)
+
+var errDatagramTooShort = errors.New("datagram too short")
+
+// DatagramFeatures returns the features announced to the edge for version.
+func DatagramFeatures(version string) []string {
+	if version == DatagramV3 {
+		return []string{FeatureDatagramV2, FeatureDatagramV3}
+	}
+	return []string{FeatureDatagramV2}
+}
+
+type udpSession struct {
+	id         uuid.UUID
+	conn       net.Conn
+	idle       time.Duration
+	lastActive atomic.Int64
+	closed     atomic.Bool
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// datagramMuxer maps the UDP sessions of one edge connection to origin sockets.
+type datagramMuxer struct {
+	q  *QuicConnection
+	v3 bool
+
+	mu       sync.Mutex
+	sessions map[uuid.UUID]*udpSession
+}
+
+func newDatagramMuxer(q *QuicConnection, version string) *datagramMuxer {
+	return &datagramMuxer{
+		q:        q,
+		v3:       version == DatagramV3,
+		sessions: make(map[uuid.UUID]*udpSession),
+	}
+}
+
+// register dials dst for a new session, registering an existing session again is a no-op.
+func (m *datagramMuxer) register(id uuid.UUID, dst netip.AddrPort, idle time.Duration) error {
+	m.mu.Lock()
+	_, ok := m.sessions[id]
+	m.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	address := dst.String()
+	if _, err := m.q.proxy.Policy.Check("udp", address); err != nil {
+		return err
+	}
+	conn, err := m.q.proxy.DialTimeout("udp", address, sessionDialTimeout)
+	if err != nil {
+		return err
+	}
+	if idle <= 0 {
+		idle = defaultSessionIdle
+	}
+	session := &udpSession{id: id, conn: conn, idle: idle}
+	session.touch()
+
+	m.mu.Lock()
+	if _, ok = m.sessions[id]; ok {
+		m.mu.Unlock()
+		_ = conn.Close()
+		return nil
+	}
+	m.sessions[id] = session
+	m.mu.Unlock()
+	m.q.proxy.Metrics.streamStarted(streamUDP)
+
+	go m.serveSession(session)
+	return nil
+}
+
+// unregister closes the session, remote tells whether the edge asked for it.
+func (m *datagramMuxer) unregister(id uuid.UUID, reason string, remote bool) {
+	m.mu.Lock()
+	session, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	if !ok || session.closed.Swap(true) {
+		return
+	}
+	_ = session.conn.Close()
+	m.q.proxy.Metrics.streamFinished(streamUDP)
+
+	// v3 sessions simply expire at the edge, v2 sessions have to be unregistered.
+	if !remote && !m.v3 {
+		if err := m.q.unregisterUdpSession(id, reason); err != nil {
+			m.q.proxy.Log.Warnln("Failed to unregister UDP session %s: %v", id, err)
+		}
+	}
+}
+
+func (m *datagramMuxer) closeAll() {
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions = make(map[uuid.UUID]*udpSession)
+	m.mu.Unlock()
+	for _, session := range sessions {
+		if !session.closed.Swap(true) {
+			_ = session.conn.Close()
+			m.q.proxy.Metrics.streamFinished(streamUDP)
+		}
+	}
+}
+
+func (m *datagramMuxer) lookup(id uuid.UUID) *udpSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[id]
+}
+
+// serveSession forwards origin replies to the edge until the session is idle for too long.
+func (m *datagramMuxer) serveSession(session *udpSession) {
+	buf := make([]byte, maxDatagramPayload+1)
+	for {
+		if err := session.conn.SetReadDeadline(time.Now().Add(session.idle)); err != nil {
+			m.unregister(session.id, err.Error(), false)
+			return
+		}
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if time.Since(time.Unix(0, session.lastActive.Load())) < session.idle {
+					continue
+				}
+				err = fmt.Errorf("session idle for %s", session.idle)
+			}
+			if !session.closed.Load() {
+				m.unregister(session.id, err.Error(), false)
+			}
+			return
+		}
+		if n > maxDatagramPayload {
+			continue
+		}
+		session.touch()
+		if m.q.conn.SendDatagram(m.payloadDatagram(session.id, buf[:n])) == nil {
+			m.q.proxy.Metrics.sent(n)
+		}
+	}
+}
+
+func (m *datagramMuxer) payloadDatagram(id uuid.UUID, payload []byte) []byte {
+	msg := make([]byte, 0, len(payload)+sessionIDLength+1)
+	if m.v3 {
+		msg = append(msg, datagramV3TypePayload)
+		msg = append(msg, id[:]...)
+		return append(msg, payload...)
+	}
+	msg = append(msg, payload...)
+	msg = append(msg, id[:]...)
+	return append(msg, datagramV2TypeUDP)
+}
+
+// serve reads datagrams from the edge until the connection is closed.
+func (m *datagramMuxer) serve(ctx context.Context) {
+	defer m.closeAll()
+	for {
+		msg, err := m.q.conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		if m.v3 {
+			err = m.handleV3(msg)
+		} else {
+			err = m.handleV2(msg)
+		}
+		if err != nil {
+			m.q.proxy.Log.Warnln("Dropped datagram: %v", err)
+		}
+	}
+}
+
+func (m *datagramMuxer) forward(id uuid.UUID, payload []byte) {
+	session := m.lookup(id)
+	if session == nil {
+		return
+	}
+	session.touch()
+	if n, err := session.conn.Write(payload); err == nil {
+		m.q.proxy.Metrics.received(n)
+	}
+}
+
+func (m *datagramMuxer) handleV2(msg []byte) error {
+	if len(msg) < sessionIDLength+1 {
+		return errDatagramTooShort
+	}
+	n := len(msg) - sessionIDLength - 1
+	switch msg[len(msg)-1] {
+	case datagramV2TypeUDP:
+		id, _ := uuid.FromBytes(msg[n : n+sessionIDLength])
+		m.forward(id, msg[:n])
+	case datagramV2TypeIP, datagramV2TypeIPWithTrace, datagramV2TypeTracingSpan:
+		// ICMP and tracing are not supported, drop silently.
+	default:
+		return fmt.Errorf("unknown datagram v2 type %d", msg[len(msg)-1])
+	}
+	return nil
+}
+
+func (m *datagramMuxer) handleV3(msg []byte) error {
+	if len(msg) < 1+sessionIDLength {
+		return errDatagramTooShort
+	}
+	switch msg[0] {
+	case datagramV3TypeRegistration:
+		return m.handleV3Registration(msg)
+	case datagramV3TypePayload:
+		id, _ := uuid.FromBytes(msg[1 : 1+sessionIDLength])
+		m.forward(id, msg[1+sessionIDLength:])
+	case datagramV3TypeICMP:
+	default:
+		return fmt.Errorf("unknown datagram v3 type %d", msg[0])
+	}
+	return nil
+}
+
+// handleV3Registration parses type, flags, port, idle seconds, session ID, IP and the optional bundled payload.
+func (m *datagramMuxer) handleV3Registration(msg []byte) error {
+	const headerLength = 1 + 1 + 2 + 2 + sessionIDLength
+	if len(msg) < headerLength+4 {
+		return errDatagramTooShort
+	}
+	flags := msg[1]
+	port := binary.BigEndian.Uint16(msg[2:4])
+	idle := time.Duration(binary.BigEndian.Uint16(msg[4:6])) * time.Second
+	id, _ := uuid.FromBytes(msg[6 : 6+sessionIDLength])
+
+	ipLength := 4
+	if flags&datagramV3FlagIPv6 != 0 {
+		ipLength = 16
+	}
+	if len(msg) < headerLength+ipLength {
+		return errDatagramTooShort
+	}
+	ip, _ := netip.AddrFromSlice(msg[headerLength : headerLength+ipLength])
+	var payload []byte
+	if flags&datagramV3FlagBundled != 0 {
+		payload = append(payload, msg[headerLength+ipLength:]...)
+	}
+
+	// 拨号可能较慢，不阻塞数据报的读取。
+	go func() {
+		dst := netip.AddrPortFrom(ip.Unmap(), port)
+		if err := m.register(id, dst, idle); err != nil {
+			m.q.proxy.Log.Warnln("Failed to register UDP session %s to %s: %v", id, dst, err)
+			m.respondV3(id, registrationFailure(err), err.Error())
+			return
+		}
+		m.respondV3(id, datagramV3ResponseOK, "")
+		if len(payload) > 0 {
+			m.forward(id, payload)
+		}
+	}()
+	return nil
+}
+
+func registrationFailure(err error) byte {
+	if errors.Is(err, ErrPolicyDenied) {
+		return datagramV3ResponseErrorWithMessage
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return datagramV3ResponseUnreachable
+	}
+	return datagramV3ResponseUnableToBind
+}
+
+func (m *datagramMuxer) respondV3(id uuid.UUID, response byte, message string) {
+	msg := make([]byte, 0, 2+sessionIDLength+2+len(message))
+	msg = append(msg, datagramV3TypeRegistrationResponse, response)
+	msg = append(msg, id[:]...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(message)))
+	msg = append(msg, message...)
+	_ = m.q.conn.SendDatagram(msg)
+}
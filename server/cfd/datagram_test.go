@@ -0,0 +1,239 @@
+package cfd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"github.com/fmnx/cftun/uuid"
+	"github.com/quic-go/quic-go"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+	capnp "zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/rpc"
+)
+
+// udpEchoOrigin returns the address of a UDP server echoing every datagram back.
+func udpEchoOrigin(t *testing.T) netip.AddrPort {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return netip.MustParseAddrPort(pc.LocalAddr().String())
+}
+
+// quicPair returns both ends of a local QUIC connection, the tunnel side dialed and the edge side accepted.
+func quicPair(t *testing.T) (quic.Connection, quic.Connection) {
+	t.Helper()
+	ts := httptest.NewTLSServer(nil)
+	certificates := ts.TLS.Certificates
+	ts.Close()
+
+	config := &quic.Config{EnableDatagrams: true, MaxIdleTimeout: 10 * time.Second}
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: certificates, NextProtos: []string{"argotunnel"}}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"argotunnel"}}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edge, err := ln.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = edge.CloseWithError(0, "")
+		_ = conn.CloseWithError(0, "")
+	})
+	return conn, edge
+}
+
+// quicEdge stands in for the edge: it accepts the QUIC connection of a QuicConnection serving proxy with the
+// datagram version and returns the edge side.
+func quicEdge(t *testing.T, proxy *Proxy, version string) quic.Connection {
+	t.Helper()
+	conn, edge := quicPair(t)
+	q, _ := NewTunnelConnection(conn, 0, 5*time.Second, time.Second, proxy, version)
+	serveCtx, stop := context.WithCancel(context.Background())
+	go q.datagrams.serve(serveCtx)
+	go func() { _ = q.acceptStream(serveCtx) }()
+	t.Cleanup(stop)
+	return edge
+}
+
+func receiveDatagram(t *testing.T, edge quic.Connection) []byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, err := edge.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func v3Registration(id uuid.UUID, dst netip.AddrPort, payload []byte) []byte {
+	flags := byte(0)
+	if dst.Addr().Is6() {
+		flags |= datagramV3FlagIPv6
+	}
+	if payload != nil {
+		flags |= datagramV3FlagBundled
+	}
+	msg := []byte{datagramV3TypeRegistration, flags}
+	msg = binary.BigEndian.AppendUint16(msg, dst.Port())
+	msg = binary.BigEndian.AppendUint16(msg, 30)
+	msg = append(msg, id[:]...)
+	msg = append(msg, dst.Addr().AsSlice()...)
+	return append(msg, payload...)
+}
+
+func TestDatagramV3Session(t *testing.T) {
+	origin := udpEchoOrigin(t)
+	edge := quicEdge(t, &Proxy{}, DatagramV3)
+	id, _ := uuid.NewRandom()
+
+	if err := edge.SendDatagram(v3Registration(id, origin, []byte("bundled"))); err != nil {
+		t.Fatal(err)
+	}
+	response := receiveDatagram(t, edge)
+	if response[0] != datagramV3TypeRegistrationResponse || response[1] != datagramV3ResponseOK ||
+		!bytes.Equal(response[2:2+sessionIDLength], id[:]) {
+		t.Fatalf("registration response %x", response)
+	}
+	// 注册时捆绑的负载也要转发给源站。
+	payload := append(append([]byte{datagramV3TypePayload}, id[:]...), "bundled"...)
+	if msg := receiveDatagram(t, edge); !bytes.Equal(msg, payload) {
+		t.Fatalf("received %x, want %x", msg, payload)
+	}
+
+	payload = append(append([]byte{datagramV3TypePayload}, id[:]...), "ping"...)
+	if err := edge.SendDatagram(payload); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveDatagram(t, edge); !bytes.Equal(msg, payload) {
+		t.Fatalf("received %x, want %x", msg, payload)
+	}
+}
+
+func TestDatagramV3PolicyDenied(t *testing.T) {
+	origin := udpEchoOrigin(t)
+	edge := quicEdge(t, &Proxy{Policy: safePolicy(nil)}, DatagramV3)
+	id, _ := uuid.NewRandom()
+
+	if err := edge.SendDatagram(v3Registration(id, origin, nil)); err != nil {
+		t.Fatal(err)
+	}
+	response := receiveDatagram(t, edge)
+	if response[0] != datagramV3TypeRegistrationResponse || response[1] != datagramV3ResponseErrorWithMessage {
+		t.Fatalf("registration response %x", response)
+	}
+	length := binary.BigEndian.Uint16(response[2+sessionIDLength:])
+	if message := string(response[4+sessionIDLength:]); int(length) != len(message) || message == "" {
+		t.Fatalf("registration message %q with length %d", message, length)
+	}
+}
+
+// callSessionManager calls a SessionManager method on a new RPC stream, as the edge does for v2 sessions.
+func callSessionManager(t *testing.T, edge quic.Connection, methodID uint16, name string, size capnp.ObjectSize, params func(capnp.Struct) error) capnp.Struct {
+	t.Helper()
+	stream, err := edge.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err = writeRPCStreamPreamble(stream); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := rpc.NewConn(rpc.StreamTransport(stream), rpc.ConnLog(nil))
+	defer conn.Close()
+	results, err := conn.Bootstrap(ctx).Call(&capnp.Call{
+		Ctx: ctx,
+		Method: capnp.Method{
+			InterfaceID:   sessionManagerInterfaceID,
+			MethodID:      methodID,
+			InterfaceName: sessionManagerInterfaceName,
+			MethodName:    name,
+		},
+		ParamsSize: size,
+		ParamsFunc: params,
+	}).Struct()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestDatagramV2Session(t *testing.T) {
+	origin := udpEchoOrigin(t)
+	proxy := &Proxy{}
+	edge := quicEdge(t, proxy, DatagramV2)
+	id, _ := uuid.NewRandom()
+
+	results := callSessionManager(t, edge, 0, "registerUdpSession", capnp.ObjectSize{DataSize: 16, PointerCount: 3},
+		func(s capnp.Struct) error {
+			if err := s.SetData(0, id[:]); err != nil {
+				return err
+			}
+			if err := s.SetData(1, origin.Addr().AsSlice()); err != nil {
+				return err
+			}
+			s.SetUint16(0, origin.Port())
+			s.SetUint64(8, uint64(30*time.Second))
+			return nil
+		})
+	ptr, err := results.Ptr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errPtr, _ := ptr.Struct().Ptr(0); errPtr.Text() != "" {
+		t.Fatalf("registration failed: %s", errPtr.Text())
+	}
+
+	payload := append(append([]byte("ping"), id[:]...), datagramV2TypeUDP)
+	if err = edge.SendDatagram(payload); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveDatagram(t, edge); !bytes.Equal(msg, payload) {
+		t.Fatalf("received %x, want %x", msg, payload)
+	}
+
+	callSessionManager(t, edge, 1, "unregisterUdpSession", capnp.ObjectSize{PointerCount: 2},
+		func(s capnp.Struct) error {
+			if err := s.SetData(0, id[:]); err != nil {
+				return err
+			}
+			return s.SetText(1, "done")
+		})
+	// 会话注销后的数据报被丢弃。
+	if err = edge.SendDatagram(payload); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if msg, err := edge.ReceiveDatagram(ctx); err == nil {
+		t.Fatalf("received %x after the session was unregistered", msg)
+	}
+}
@@ -0,0 +1,138 @@
+package cfd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	srvService = "v2-origintunneld"
+	srvProto   = "tcp"
+	srvName    = "argotunnel.com"
+
+	dotServerName = "cloudflare-dns.com"
+	dotServerAddr = "1.1.1.1:853"
+	srvTimeout    = 5 * time.Second
+	dotTimeout    = 15 * time.Second
+	regionTimeout = 5 * time.Second
+
+	EdgeIPVersionAuto = "auto"
+	EdgeIPVersion4    = "4"
+	EdgeIPVersion6    = "6"
+)
+
+var errNoEdgeAddrs = errors.New("no edge addresses found")
+
+// Region is the set of edge addresses behind one SRV target.
+type Region struct {
+	Name  string
+	Addrs []netip.AddrPort
+}
+
+// dotResolver resolves through Cloudflare's DNS-over-TLS for networks that tamper with plain DNS.
+func dotResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: dotTimeout}
+			conn, err := dialer.DialContext(ctx, "tcp", dotServerAddr)
+			if err != nil {
+				return nil, err
+			}
+			return tls.Client(conn, &tls.Config{ServerName: dotServerName}), nil
+		},
+	}
+}
+
+// edgeResolver is the part of net.Resolver used by discovery.
+type edgeResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// DiscoverEdge resolves the edge regions from the SRV record, restricted to region (e.g. "us") when set.
+func DiscoverEdge(region, ipVersion string, logger *log.Logger) ([]*Region, error) {
+	return discoverEdge(region, ipVersion, logger, net.DefaultResolver, dotResolver())
+}
+
+// discoverEdge looks up the SRV record with system, falling back to dot. The regions are resolved with the
+// resolver that answered. Every lookup has its own timeout, a slow system resolver does not use up the time
+// of the fallback.
+func discoverEdge(region, ipVersion string, logger *log.Logger, system, dot edgeResolver) ([]*Region, error) {
+	service := srvService
+	if region != "" {
+		service = region + "-" + srvService
+	}
+	lookupSRV := func(resolver edgeResolver, timeout time.Duration) ([]*net.SRV, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, srvs, err := resolver.LookupSRV(ctx, service, srvProto, srvName)
+		return srvs, err
+	}
+
+	resolver := system
+	srvs, err := lookupSRV(resolver, srvTimeout)
+	if err != nil {
+		logger.Warnln("Failed to look up edge SRV records, retrying over DNS-over-TLS: %v", err)
+		resolver = dot
+		if srvs, err = lookupSRV(resolver, dotTimeout); err != nil {
+			return nil, fmt.Errorf("edge discovery: %w", err)
+		}
+	}
+
+	var regions []*Region
+	for _, srv := range srvs {
+		name := strings.TrimSuffix(srv.Target, ".")
+		ctx, cancel := context.WithTimeout(context.Background(), regionTimeout)
+		ips, err := resolver.LookupNetIP(ctx, "ip", name)
+		cancel()
+		if err != nil {
+			logger.Warnln("Failed to resolve edge region %s: %v", name, err)
+			continue
+		}
+		r := &Region{Name: name, Addrs: filterEdgeAddrs(ips, srv.Port, ipVersion)}
+		if len(r.Addrs) > 0 {
+			regions = append(regions, r)
+		}
+	}
+	if len(regions) == 0 {
+		return nil, errNoEdgeAddrs
+	}
+	return regions, nil
+}
+
+// filterEdgeAddrs keeps the addresses of ipVersion, auto lists IPv4 before IPv6.
+func filterEdgeAddrs(ips []netip.Addr, port uint16, ipVersion string) []netip.AddrPort {
+	var v4, v6 []netip.AddrPort
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			v4 = append(v4, netip.AddrPortFrom(ip, port))
+		} else {
+			v6 = append(v6, netip.AddrPortFrom(ip, port))
+		}
+	}
+	switch ipVersion {
+	case EdgeIPVersion4:
+		return v4
+	case EdgeIPVersion6:
+		return v6
+	default:
+		return append(v4, v6...)
+	}
+}
+
+// fallbackEdge guesses an edge address when discovery fails.
+func fallbackEdge(index int, ipVersion string) netip.AddrPort {
+	if ipVersion == EdgeIPVersion6 {
+		return netip.MustParseAddrPort(fmt.Sprintf("[2606:4700:a0::%d]:7844", index%10+1))
+	}
+	return netip.MustParseAddrPort(fmt.Sprintf("198.41.192.%d:7844", index%10+1))
+}
@@ -0,0 +1,137 @@
+package cfd
+
+import (
+	"context"
+	"errors"
+	"github.com/fmnx/cftun/log"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers discovery lookups and records the time left to each of them.
+type fakeResolver struct {
+	srvs   []*net.SRV
+	srvErr error
+	ips    map[string][]netip.Addr
+	left   []time.Duration
+}
+
+func (r *fakeResolver) record(ctx context.Context) {
+	deadline, _ := ctx.Deadline()
+	r.left = append(r.left, time.Until(deadline))
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, _, _, _ string) (string, []*net.SRV, error) {
+	r.record(ctx)
+	return "", r.srvs, r.srvErr
+}
+
+func (r *fakeResolver) LookupNetIP(ctx context.Context, _, host string) ([]netip.Addr, error) {
+	r.record(ctx)
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return ips, nil
+}
+
+func TestDiscoverEdgeFallsBackToDoT(t *testing.T) {
+	system := &fakeResolver{srvErr: errors.New("refused")}
+	dot := &fakeResolver{
+		srvs: []*net.SRV{{Target: "region1.v2.argotunnel.com.", Port: 7844}, {Target: "region2.v2.argotunnel.com.", Port: 7844}},
+		ips: map[string][]netip.Addr{
+			"region1.v2.argotunnel.com": {netip.MustParseAddr("198.41.192.1"), netip.MustParseAddr("2606:4700:a0::1")},
+		},
+	}
+	regions, err := discoverEdge("", EdgeIPVersionAuto, nil, system, dot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 无法解析的区域被跳过。
+	want := []*Region{{Name: "region1.v2.argotunnel.com", Addrs: []netip.AddrPort{
+		netip.MustParseAddrPort("198.41.192.1:7844"), netip.MustParseAddrPort("[2606:4700:a0::1]:7844"),
+	}}}
+	if !reflect.DeepEqual(regions, want) {
+		t.Fatalf("regions %v, want %v", regions, want)
+	}
+	if len(system.left) != 1 || len(dot.left) != 3 {
+		t.Fatalf("system resolver used %d times and DoT %d times, want 1 and 3", len(system.left), len(dot.left))
+	}
+	// 每次查询都有独立的超时。
+	if dot.left[0] <= srvTimeout || dot.left[0] > dotTimeout {
+		t.Fatalf("DoT lookup had %s left, want its own %s", dot.left[0], dotTimeout)
+	}
+	for _, left := range dot.left[1:] {
+		if left <= regionTimeout-time.Second || left > regionTimeout {
+			t.Fatalf("region lookup had %s left, want its own %s", left, regionTimeout)
+		}
+	}
+}
+
+func TestDiscoverEdgeFails(t *testing.T) {
+	var logger *log.Logger
+	system := &fakeResolver{srvErr: errors.New("refused")}
+	dot := &fakeResolver{srvErr: errors.New("timeout")}
+	if _, err := discoverEdge("", EdgeIPVersionAuto, logger, system, dot); err == nil {
+		t.Fatal("discovery succeeded without SRV records")
+	}
+
+	system = &fakeResolver{
+		srvs: []*net.SRV{{Target: "region1.v2.argotunnel.com.", Port: 7844}},
+		ips:  map[string][]netip.Addr{"region1.v2.argotunnel.com": {netip.MustParseAddr("198.41.192.1")}},
+	}
+	if _, err := discoverEdge("", EdgeIPVersion6, logger, system, dot); !errors.Is(err, errNoEdgeAddrs) {
+		t.Fatalf("got %v, want %v", err, errNoEdgeAddrs)
+	}
+	if len(dot.left) != 1 {
+		t.Fatal("DoT used although the system resolver answered")
+	}
+}
+
+func TestFilterEdgeAddrs(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("2606:4700:a0::1"),
+		netip.MustParseAddr("198.41.192.1"),
+		netip.MustParseAddr("::ffff:198.41.200.1"),
+	}
+	v4 := []netip.AddrPort{netip.MustParseAddrPort("198.41.192.1:7844"), netip.MustParseAddrPort("198.41.200.1:7844")}
+	v6 := []netip.AddrPort{netip.MustParseAddrPort("[2606:4700:a0::1]:7844")}
+	tests := []struct {
+		ipVersion string
+		expected  []netip.AddrPort
+	}{
+		{EdgeIPVersionAuto, append(append([]netip.AddrPort(nil), v4...), v6...)},
+		{EdgeIPVersion4, v4},
+		{EdgeIPVersion6, v6},
+	}
+	for _, tt := range tests {
+		if got := filterEdgeAddrs(ips, 7844, tt.ipVersion); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: got %v, want %v", tt.ipVersion, got, tt.expected)
+		}
+	}
+}
+
+func TestEdgePoolInterleavesRegions(t *testing.T) {
+	p := NewEdgePool(nil, "", "")
+	p.discover = func(_, _ string, _ *log.Logger) ([]*Region, error) {
+		return []*Region{
+			{Name: "a", Addrs: []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:7844"), netip.MustParseAddrPort("192.0.2.2:7844")}},
+			{Name: "b", Addrs: []netip.AddrPort{netip.MustParseAddrPort("198.51.100.1:7844")}},
+		}, nil
+	}
+	var got []netip.AddrPort
+	for i := 0; i < 3; i++ {
+		got = append(got, p.Get(i))
+	}
+	want := []netip.AddrPort{
+		netip.MustParseAddrPort("192.0.2.1:7844"),
+		netip.MustParseAddrPort("198.51.100.1:7844"),
+		netip.MustParseAddrPort("192.0.2.2:7844"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("connections got %v, want %v", got, want)
+	}
+}
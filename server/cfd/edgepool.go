@@ -0,0 +1,204 @@
+package cfd
+
+import (
+	"github.com/fmnx/cftun/log"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// maxEdgeFailures marks an address as failing, discovery is refreshed once every address is.
+	maxEdgeFailures = 3
+	// rediscoverInterval limits how often a failing pool is discovered again.
+	rediscoverInterval = time.Minute
+)
+
+type edgeAddr struct {
+	addr     netip.AddrPort
+	region   int
+	failures int
+	// users is the number of HA connections on the address.
+	users int
+}
+
+// EdgePool hands out edge addresses to HA connections, keeping them on distinct IPs
+// and moving a connection away from an address that keeps failing.
+type EdgePool struct {
+	mu        sync.Mutex
+	static    bool
+	region    string
+	ipVersion string
+	regions   int
+	addrs     []*edgeAddr
+	assigned  map[int]*edgeAddr
+	// lastFailed is the address each connection failed on last, it is skipped when possible.
+	lastFailed map[int]netip.AddrPort
+
+	lastDiscovery time.Time
+	// discovering is closed when the running discovery ends, nil when none runs.
+	discovering chan struct{}
+	discover    func(region, ipVersion string, logger *log.Logger) ([]*Region, error)
+
+	// Log prefixes the messages of the tunnel, nil logs without prefix.
+	Log *log.Logger
+}
+
+// NewEdgePool uses the configured addresses when given, otherwise it discovers the edge.
+func NewEdgePool(static []netip.AddrPort, region, ipVersion string) *EdgePool {
+	p := &EdgePool{
+		static:    len(static) > 0,
+		region:    region,
+		ipVersion: ipVersion,
+		regions:   1,
+		assigned:  make(map[int]*edgeAddr),
+
+		lastFailed: make(map[int]netip.AddrPort),
+		discover:   DiscoverEdge,
+	}
+	for _, addr := range static {
+		p.addrs = append(p.addrs, &edgeAddr{addr: addr})
+	}
+	return p
+}
+
+// Get returns the address of connIndex, assigning the healthiest free address when it has none.
+func (p *EdgePool) Get(connIndex int) netip.AddrPort {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if a, ok := p.assigned[connIndex]; ok {
+		return a.addr
+	}
+	p.refresh()
+	if len(p.addrs) == 0 {
+		return fallbackEdge(connIndex, p.ipVersion)
+	}
+
+	region := connIndex % p.regions
+	var best *edgeAddr
+	for _, a := range p.addrs {
+		if len(p.addrs) > 1 && a.addr == p.lastFailed[connIndex] {
+			continue
+		}
+		if best == nil || p.better(a, best, region) {
+			best = a
+		}
+	}
+	if best.users > 0 {
+		p.Log.Warnln("Connection %d shares edge address %s, no free address left", connIndex, best.addr)
+	}
+	best.users++
+	p.assigned[connIndex] = best
+	return best.addr
+}
+
+// better prefers addresses that are not failing, then less used ones, then fewer failures,
+// then the region of the connection.
+func (p *EdgePool) better(a, b *edgeAddr, region int) bool {
+	if aOK, bOK := a.failures < maxEdgeFailures, b.failures < maxEdgeFailures; aOK != bOK {
+		return aOK
+	}
+	if a.users != b.users {
+		return a.users < b.users
+	}
+	if a.failures != b.failures {
+		return a.failures < b.failures
+	}
+	return a.region == region && b.region != region
+}
+
+// ReportFailure counts a failed connection to addr and releases it, so the next Get rotates.
+func (p *EdgePool) ReportFailure(connIndex int, addr netip.AddrPort) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, a := range p.addrs {
+		if a.addr != addr {
+			continue
+		}
+		a.failures++
+		p.lastFailed[connIndex] = addr
+		if p.assigned[connIndex] == a {
+			delete(p.assigned, connIndex)
+			a.users--
+		}
+		p.Log.Warnln("Connection %d: edge address %s failed %d times, rotating", connIndex, addr, a.failures)
+	}
+}
+
+// ReportSuccess clears the failures of addr once a connection registered on it.
+func (p *EdgePool) ReportSuccess(addr netip.AddrPort) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, a := range p.addrs {
+		if a.addr == addr {
+			a.failures = 0
+		}
+	}
+}
+
+// refresh discovers the edge when the pool is empty or every address is failing. It is called with p.mu held
+// and releases it during the lookups, which can take several seconds, so other connections are not blocked.
+func (p *EdgePool) refresh() {
+	if p.static {
+		return
+	}
+	// 已有发现在进行时等待其结果，不重复查询。
+	for p.discovering != nil {
+		done := p.discovering
+		p.mu.Unlock()
+		<-done
+		p.mu.Lock()
+	}
+	if len(p.addrs) > 0 {
+		for _, a := range p.addrs {
+			if a.failures < maxEdgeFailures {
+				return
+			}
+		}
+		if time.Since(p.lastDiscovery) < rediscoverInterval {
+			return
+		}
+	}
+
+	p.lastDiscovery = time.Now()
+	done := make(chan struct{})
+	p.discovering = done
+	p.mu.Unlock()
+	regions, err := p.discover(p.region, p.ipVersion, p.Log)
+	p.mu.Lock()
+	p.discovering = nil
+	close(done)
+	if err != nil {
+		p.Log.Warnln("Failed to discover edge addresses: %v", err)
+		return
+	}
+
+	assigned := make(map[netip.AddrPort][]int)
+	for connIndex, a := range p.assigned {
+		assigned[a.addr] = append(assigned[a.addr], connIndex)
+	}
+	p.assigned = make(map[int]*edgeAddr)
+	// 交错排列各区域的地址，使相邻的 HA 连接落在不同区域。
+	var addrs []*edgeAddr
+	for i := 0; ; i++ {
+		added := false
+		for r, region := range regions {
+			if i >= len(region.Addrs) {
+				continue
+			}
+			a := &edgeAddr{addr: region.Addrs[i], region: r}
+			for _, connIndex := range assigned[a.addr] {
+				a.users++
+				p.assigned[connIndex] = a
+			}
+			addrs = append(addrs, a)
+			added = true
+		}
+		if !added {
+			break
+		}
+	}
+	p.addrs = addrs
+	p.regions = len(regions)
+}
@@ -0,0 +1,52 @@
+package cfd
+
+import (
+	"github.com/fmnx/cftun/log"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEdgePoolDiscoversOutsideTheLock(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var discoveries atomic.Int32
+	p := NewEdgePool(nil, "", "")
+	p.discover = func(_, _ string, _ *log.Logger) ([]*Region, error) {
+		if discoveries.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return []*Region{
+			{Name: "a", Addrs: []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:7844")}},
+			{Name: "b", Addrs: []netip.AddrPort{netip.MustParseAddrPort("192.0.2.2:7844")}},
+		}, nil
+	}
+
+	got := make(chan netip.AddrPort, 2)
+	go func() { got <- p.Get(0) }()
+	<-started
+	go func() { got <- p.Get(1) }()
+
+	// 发现进行中，其他连接报告结果不应被阻塞。
+	reported := make(chan struct{})
+	go func() {
+		p.ReportFailure(2, netip.MustParseAddrPort("192.0.2.9:7844"))
+		p.ReportSuccess(netip.MustParseAddrPort("192.0.2.9:7844"))
+		close(reported)
+	}()
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("reporting blocked while the edge was being discovered")
+	}
+
+	close(release)
+	first, second := <-got, <-got
+	if first == second || !first.IsValid() || !second.IsValid() {
+		t.Fatalf("connections got %s and %s, want distinct discovered addresses", first, second)
+	}
+	if n := discoveries.Load(); n != 1 {
+		t.Fatalf("discovered %d times, want once", n)
+	}
+}
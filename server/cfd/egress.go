@@ -0,0 +1,225 @@
+package cfd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver looks up the addresses of a host in order of preference.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+// Outbound is a way out of the server for origin connections.
+type Outbound struct {
+	Name string
+	Dial DialFunc
+	// Resolve dials the resolved address instead of the host name, for dialers without a resolver such as WARP.
+	Resolve bool
+	// RemoteDNS keeps host names for the outbound to resolve, such as a proxy, even with a Resolver.
+	RemoteDNS bool
+}
+
+var DirectOutbound = &Outbound{Name: "direct", Dial: net.Dial}
+
+// BindOutbound dials directly from the local address ip.
+func BindOutbound(ip netip.Addr) *Outbound {
+	return &Outbound{
+		Name: "bind " + ip.String(),
+		Dial: func(network, address string) (net.Conn, error) {
+			dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip.AsSlice()}}
+			if strings.HasPrefix(network, "udp") {
+				dialer.LocalAddr = &net.UDPAddr{IP: ip.AsSlice()}
+			}
+			return dialer.Dial(network, address)
+		},
+	}
+}
+
+// EgressRule sends the destinations matching every non-empty condition to Outbound.
+// Domains match the host and its subdomains, Prefixes match the preferred address of the host.
+type EgressRule struct {
+	Network  string
+	Prefixes []netip.Prefix
+	Ports    []PortRange
+	Domains  []string
+	Outbound *Outbound
+}
+
+func (r *EgressRule) match(network, host string, port uint16, addr netip.Addr) bool {
+	if r.Network != "" && r.Network != network {
+		return false
+	}
+
+	if len(r.Ports) > 0 {
+		matched := false
+		for _, portRange := range r.Ports {
+			if portRange.contains(port) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Domains) > 0 {
+		matched := false
+		for _, domain := range r.Domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Prefixes) > 0 {
+		matched := false
+		for _, prefix := range r.Prefixes {
+			if addr.IsValid() && prefix.Contains(addr) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Egress chooses the outbound of each destination. Rules are evaluated in order and the first match wins,
+// destinations matching no rule use Default.
+type Egress struct {
+	Rules   []*EgressRule
+	Default *Outbound
+	// Resolver resolves the host names of every outbound but RemoteDNS ones, nil uses the system
+	// resolver only where an address is needed.
+	Resolver Resolver
+}
+
+// Route returns the outbound for the destination and the addresses to dial through it in order. Once a
+// host name has been resolved its addresses are dialed, the preferred one first so the connection uses the
+// family the rules chose, unless the outbound resolves names itself. addrs are the addresses the policy
+// already resolved the host name to, they are used instead of a lookup. The outbound is returned with the
+// error when resolving the host name fails.
+func (e *Egress) Route(network, address string, addrs []netip.Addr) (*Outbound, []string, error) {
+	if e == nil {
+		e = &Egress{}
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid port %s", portStr)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	// addr 为首选地址，用于匹配 CIDR 规则。
+	var addr netip.Addr
+	var lookupErr error
+	resolved := false
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addr, resolved = ip.Unmap(), true
+		addrs = []netip.Addr{addr}
+	} else if len(addrs) > 0 {
+		addr, resolved = addrs[0], true
+	}
+	resolve := func() {
+		if !resolved {
+			resolved = true
+			if addrs, lookupErr = lookupHost(e.Resolver, host); lookupErr == nil {
+				addr = addrs[0]
+			}
+		}
+	}
+
+	outbound := e.Default
+	for _, rule := range e.Rules {
+		if len(rule.Prefixes) > 0 {
+			resolve()
+		}
+		if rule.match(network, host, uint16(port), addr) {
+			outbound = rule.Outbound
+			break
+		}
+	}
+	if outbound == nil {
+		outbound = DirectOutbound
+	}
+
+	if outbound.RemoteDNS && !outbound.Resolve {
+		return outbound, []string{address}, nil
+	}
+	if outbound.Resolve || e.Resolver != nil {
+		resolve()
+		if lookupErr != nil {
+			return outbound, nil, fmt.Errorf("%s outbound: %w", outbound.Name, lookupErr)
+		}
+	}
+	if !addr.IsValid() {
+		return outbound, []string{address}, nil
+	}
+	addresses := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addresses = append(addresses, net.JoinHostPort(addr.String(), portStr))
+	}
+	return outbound, addresses, nil
+}
+
+// Dial routes the destination and dials its addresses in order until one connects.
+func (e *Egress) Dial(network, address string, addrs []netip.Addr) (net.Conn, error) {
+	conn, _, err := e.dial(network, address, addrs)
+	return conn, err
+}
+
+// dial is Dial also returning the outbound, nil when the destination could not be routed.
+func (e *Egress) dial(network, address string, addrs []netip.Addr) (net.Conn, *Outbound, error) {
+	outbound, addresses, err := e.Route(network, address, addrs)
+	if err != nil {
+		return nil, outbound, err
+	}
+	for _, target := range addresses {
+		var conn net.Conn
+		if conn, err = outbound.Dial(network, target); err == nil {
+			return conn, outbound, nil
+		}
+	}
+	return nil, outbound, err
+}
+
+// lookupHost resolves host with resolver, or the system resolver when nil. Addresses are in order of preference.
+func lookupHost(resolver Resolver, host string) ([]netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var addrs []netip.Addr
+	var err error
+	if resolver != nil {
+		addrs, err = resolver.LookupNetIP(ctx, host)
+	} else {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address for %s", host)
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return addrs, nil
+}
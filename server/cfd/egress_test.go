@@ -0,0 +1,80 @@
+package cfd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+type staticResolver []netip.Addr
+
+func (r staticResolver) LookupNetIP(_ context.Context, _ string) ([]netip.Addr, error) {
+	return append([]netip.Addr(nil), r...), nil
+}
+
+func TestRouteAddresses(t *testing.T) {
+	resolver := staticResolver{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	proxy := &Outbound{Name: "proxy", RemoteDNS: true}
+	direct := &Outbound{Name: "direct"}
+	egress := &Egress{
+		Rules: []*EgressRule{
+			{Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, Ports: []PortRange{{443, 443}}, Outbound: proxy},
+		},
+		Default:  direct,
+		Resolver: resolver,
+	}
+
+	tests := []struct {
+		name      string
+		address   string
+		outbound  *Outbound
+		addresses []string
+	}{
+		// 规则为匹配 CIDR 解析了域名，远程解析的出口仍应收到域名。
+		{"remote dns keeps the host name", "example.com:443", proxy, []string{"example.com:443"}},
+		{"every address is dialed", "example.com:80", direct, []string{"192.0.2.1:80", "[2001:db8::1]:80"}},
+		{"ip literal", "192.0.2.9:80", direct, []string{"192.0.2.9:80"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outbound, addresses, err := egress.Route("tcp", tt.address, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outbound != tt.outbound {
+				t.Fatalf("outbound %s, want %s", outbound.Name, tt.outbound.Name)
+			}
+			if !reflect.DeepEqual(addresses, tt.addresses) {
+				t.Fatalf("addresses %v, want %v", addresses, tt.addresses)
+			}
+		})
+	}
+}
+
+func TestEgressDialFallsBack(t *testing.T) {
+	var dialed []string
+	outbound := &Outbound{Name: "test", Dial: func(network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		if address == "192.0.2.1:80" {
+			return nil, errors.New("unreachable")
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}}
+	egress := &Egress{
+		Default:  outbound,
+		Resolver: staticResolver{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+	}
+	conn, err := egress.Dial("tcp", "example.com:80", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if want := []string{"192.0.2.1:80", "[2001:db8::1]:80"}; !reflect.DeepEqual(dialed, want) {
+		t.Fatalf("dialed %v, want %v", dialed, want)
+	}
+}
@@ -0,0 +1,310 @@
+package cfd
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http2"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HTTP2ServerName = "h2.cftunnel.com"
+
+	MaxConcurrentStreams = math.MaxUint32
+
+	internalUpgradeHeader = "Cf-Cloudflared-Proxy-Connection-Upgrade"
+	tcpStreamHeader       = "Cf-Cloudflared-Proxy-Src"
+	requestUserHeaders    = "Cf-Cloudflared-Request-Headers"
+	responseUserHeaders   = "Cf-Cloudflared-Response-Headers"
+	responseMetaHeader    = "Cf-Cloudflared-Response-Meta"
+
+	controlStreamUpgrade = "control-stream"
+	websocketUpgrade     = "websocket"
+	configurationUpdate  = "update-configuration"
+
+	responseMetaOrigin      = `{"src":"origin"}`
+	responseMetaCloudflared = `{"src":"cloudflared"}`
+)
+
+var errHTTP2Closed = errors.New("http2 connection closed")
+
+// HTTP2Connection serves the edge over TLS/TCP, the edge is the HTTP/2 client.
+type HTTP2Connection struct {
+	conn      net.Conn
+	connIndex uint8
+
+	rpcTimeout  time.Duration
+	gracePeriod time.Duration
+
+	proxy *Proxy
+
+	credentials *Credentials
+	connOptions *ConnectionOptions
+	controlErr  chan error
+
+	onRegistered func(*ConnectionDetails)
+	shutdown     <-chan struct{}
+	streams      activeStreams
+	registration atomic.Pointer[RegistrationClient]
+}
+
+func NewHTTP2Connection(
+	conn net.Conn,
+	connIndex uint8,
+	rpcTimeout time.Duration,
+	gracePeriod time.Duration,
+	proxy *Proxy,
+) *HTTP2Connection {
+	return &HTTP2Connection{
+		conn:        conn,
+		connIndex:   connIndex,
+		rpcTimeout:  rpcTimeout,
+		gracePeriod: gracePeriod,
+		proxy:       proxy,
+		controlErr:  make(chan error, 1),
+	}
+}
+
+func (h *HTTP2Connection) Serve(ctx context.Context, credentials *Credentials, connOptions *ConnectionOptions) error {
+	h.credentials = credentials
+	h.connOptions = connOptions
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.shutdown:
+			if registration := h.registration.Load(); registration != nil {
+				unregister(registration, h.connIndex, h.rpcTimeout, h.proxy.Log)
+			}
+			h.streams.drain(h.connIndex, h.gracePeriod, h.proxy.Log)
+		case <-ctx.Done():
+		}
+		_ = h.conn.Close()
+	}()
+
+	server := &http2.Server{MaxConcurrentStreams: MaxConcurrentStreams}
+	server.ServeConn(h.conn, &http2.ServeConnOpts{Context: ctx, Handler: h})
+
+	select {
+	case err := <-h.controlErr:
+		return err
+	default:
+		return errHTTP2Closed
+	}
+}
+
+func (h *HTTP2Connection) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stream, err := newHTTP2Stream(w, r)
+	if err != nil {
+		h.proxy.Log.Errorln(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer stream.Close()
+
+	switch r.Header.Get(internalUpgradeHeader) {
+	case controlStreamUpgrade:
+		h.serveControlStream(r.Context(), stream)
+	case configurationUpdate:
+		if err = stream.writeHeader(http.StatusOK, nil, ""); err != nil {
+			return
+		}
+		serveCloudflaredRPC(r.Context(), stream, cloudflaredServer(h.proxy, nil))
+	default:
+		h.streams.add()
+		defer h.streams.done()
+		rss := &RequestServerStream{ReadWriteCloser: stream, respond: stream.respond}
+		h.proxy.handleRequest(r.Context(), rss, connectRequestFromHTTP2(r))
+	}
+}
+
+// serveControlStream registers the connection and holds the stream open while it is in use.
+func (h *HTTP2Connection) serveControlStream(ctx context.Context, stream *http2Stream) {
+	if err := stream.writeHeader(http.StatusOK, nil, ""); err != nil {
+		return
+	}
+
+	registration := NewRegistrationClient(ctx, stream, cloudflaredServer(h.proxy, nil))
+	defer registration.Close()
+	registerCtx, cancel := context.WithTimeout(ctx, h.rpcTimeout)
+	details, err := registration.RegisterConnection(registerCtx, h.connIndex, h.credentials, h.connOptions)
+	cancel()
+	if err != nil {
+		h.controlErr <- fmt.Errorf("failed to register http2 connection: %w", err)
+		_ = h.conn.Close()
+		return
+	}
+	h.proxy.Log.Infoln("Registered http2 connection %d at %s, remotely managed: %t",
+		h.connIndex, details.Location, details.TunnelIsRemotelyManaged)
+	h.registration.Store(registration)
+	if h.onRegistered != nil {
+		h.onRegistered(details)
+	}
+	<-ctx.Done()
+}
+
+// connectRequestFromHTTP2 translates an edge request into the form the QUIC transport delivers.
+func connectRequestFromHTTP2(r *http.Request) *ConnectRequest {
+	request := &ConnectRequest{Type: ConnectionTypeHTTP}
+	switch {
+	case strings.EqualFold(r.Header.Get(internalUpgradeHeader), websocketUpgrade):
+		request.Type = ConnectionTypeWebsocket
+	case r.Header.Get(tcpStreamHeader) != "":
+		request.Type = ConnectionTypeTCP
+	}
+
+	if request.Type == ConnectionTypeTCP {
+		request.Dest = r.Host
+	} else {
+		dest := *r.URL
+		dest.Scheme = "https"
+		dest.Host = r.Host
+		request.Dest = dest.String()
+	}
+
+	request.Metadata = append(request.Metadata,
+		Metadata{"HttpMethod", r.Method},
+		Metadata{"HttpHost", r.Host},
+	)
+	header, err := deserializeHeaders(r.Header.Get(requestUserHeaders))
+	if err != nil || r.Header.Get(requestUserHeaders) == "" {
+		header = r.Header
+	}
+	for key, values := range header {
+		if strings.HasPrefix(key, "Cf-Cloudflared-") {
+			continue
+		}
+		for _, value := range values {
+			request.Metadata = append(request.Metadata, Metadata{"HttpHeader:" + key, value})
+		}
+	}
+	return request
+}
+
+// serializeHeaders encodes header as base64 name:value pairs joined by ";".
+func serializeHeaders(header http.Header) string {
+	var pairs []string
+	for key, values := range header {
+		for _, value := range values {
+			pairs = append(pairs, base64.RawStdEncoding.EncodeToString([]byte(key))+":"+
+				base64.RawStdEncoding.EncodeToString([]byte(value)))
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+func deserializeHeaders(s string) (http.Header, error) {
+	header := make(http.Header)
+	if s == "" {
+		return header, nil
+	}
+	for _, pair := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid serialized header %q", pair)
+		}
+		nameBytes, err := base64.RawStdEncoding.DecodeString(name)
+		if err != nil {
+			return nil, err
+		}
+		valueBytes, err := base64.RawStdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		header.Add(http.CanonicalHeaderKey(string(nameBytes)), string(valueBytes))
+	}
+	return header, nil
+}
+
+// http2Stream is one HTTP/2 request used as a bidirectional stream.
+type http2Stream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	body    io.ReadCloser
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newHTTP2Stream(w http.ResponseWriter, r *http.Request) (*http2Stream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("http2 response writer does not support flushing")
+	}
+	return &http2Stream{w: w, flusher: flusher, body: r.Body}, nil
+}
+
+func (s *http2Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *http2Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := s.w.Write(p)
+	if err == nil {
+		s.flusher.Flush()
+	}
+	return n, err
+}
+
+// Close stops further writes, the response writer must not be used after the handler returns.
+func (s *http2Stream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.body.Close()
+}
+
+func (s *http2Stream) writeHeader(status int, userHeader http.Header, meta string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return io.ErrClosedPipe
+	}
+	if userHeader != nil {
+		s.w.Header().Set(responseUserHeaders, serializeHeaders(userHeader))
+	}
+	if meta != "" {
+		s.w.Header().Set(responseMetaHeader, meta)
+	}
+	s.w.WriteHeader(status)
+	s.flusher.Flush()
+	return nil
+}
+
+// respond carries the response metadata in HTTP/2 headers, HTTP/2 has no 101 so upgrades answer 200.
+func (s *http2Stream) respond(respErr error, metadata []Metadata) error {
+	if respErr != nil {
+		return s.writeHeader(http.StatusBadGateway, nil, responseMetaCloudflared)
+	}
+	status := http.StatusOK
+	userHeader := make(http.Header)
+	for _, m := range metadata {
+		if m.Key == "HttpStatus" {
+			if code, err := strconv.Atoi(m.Val); err == nil {
+				status = code
+			}
+		} else if key, ok := strings.CutPrefix(m.Key, "HttpHeader:"); ok {
+			userHeader.Add(key, m.Val)
+		}
+	}
+	if status == http.StatusSwitchingProtocols {
+		status = http.StatusOK
+	}
+	return s.writeHeader(status, userHeader, responseMetaOrigin)
+}
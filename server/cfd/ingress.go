@@ -0,0 +1,328 @@
+package cfd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// IngressRelay routes matching websocket requests to the cftun relay.
+	IngressRelay = "cftun"
+
+	httpStatusPrefix = "http_status:"
+	unixPrefix       = "unix:"
+	unixTLSPrefix    = "unix+tls:"
+)
+
+// hopHeaders are not forwarded between the edge and HTTP origins.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// IngressRule routes requests for a hostname and path to an origin service:
+// http://, https://, unix:, unix+tls:, http_status:<code> or cftun.
+type IngressRule struct {
+	Hostname    string
+	Path        string
+	Service     string
+	NoTLSVerify bool
+}
+
+type ingressRule struct {
+	hostname  string
+	path      *regexp.Regexp
+	service   string
+	status    int
+	relay     bool
+	origin    *url.URL
+	unix      string
+	tlsConfig *tls.Config
+	transport *http.Transport
+}
+
+// Ingress is an ordered list of rules, the first match wins.
+type Ingress struct {
+	rules []*ingressRule
+}
+
+func NewIngress(rules []IngressRule) (*Ingress, error) {
+	ingress := &Ingress{}
+	for i, r := range rules {
+		rule, err := newIngressRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("ingress rule #%d: %w", i+1, err)
+		}
+		ingress.rules = append(ingress.rules, rule)
+	}
+	return ingress, nil
+}
+
+func newIngressRule(r IngressRule) (*ingressRule, error) {
+	rule := &ingressRule{
+		hostname: strings.ToLower(r.Hostname),
+		service:  r.Service,
+	}
+	if r.Path != "" {
+		re, err := regexp.Compile(r.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", r.Path, err)
+		}
+		rule.path = re
+	}
+
+	switch service := r.Service; {
+	case service == IngressRelay:
+		rule.relay = true
+		return rule, nil
+	case strings.HasPrefix(service, httpStatusPrefix):
+		status, err := strconv.Atoi(strings.TrimPrefix(service, httpStatusPrefix))
+		if err != nil || status < 100 || status > 999 {
+			return nil, fmt.Errorf("invalid service %q", service)
+		}
+		rule.status = status
+		return rule, nil
+	case strings.HasPrefix(service, unixTLSPrefix):
+		rule.unix = strings.TrimPrefix(service, unixTLSPrefix)
+		rule.origin = &url.URL{Scheme: "https", Host: "localhost"}
+	case strings.HasPrefix(service, unixPrefix):
+		rule.unix = strings.TrimPrefix(service, unixPrefix)
+		rule.origin = &url.URL{Scheme: "http", Host: "localhost"}
+	default:
+		origin, err := url.Parse(service)
+		if err != nil || (origin.Scheme != "http" && origin.Scheme != "https") || origin.Host == "" {
+			return nil, fmt.Errorf("invalid service %q", service)
+		}
+		rule.origin = origin
+	}
+
+	rule.tlsConfig = &tls.Config{InsecureSkipVerify: r.NoTLSVerify}
+	rule.transport = &http.Transport{
+		DialContext:         rule.dialContext,
+		TLSClientConfig:     rule.tlsConfig,
+		ForceAttemptHTTP2:   rule.unix == "",
+		MaxIdleConnsPerHost: 16,
+	}
+	return rule, nil
+}
+
+func (r *ingressRule) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	if r.unix != "" {
+		return dialer.DialContext(ctx, "unix", r.unix)
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (r *ingressRule) match(host, path string) bool {
+	if r.hostname != "" && r.hostname != "*" {
+		if strings.HasPrefix(r.hostname, "*.") {
+			if !strings.HasSuffix(host, r.hostname[1:]) {
+				return false
+			}
+		} else if r.hostname != host {
+			return false
+		}
+	}
+	return r.path == nil || r.path.MatchString(path)
+}
+
+// match returns the first rule for request, or nil when no rule matches.
+func (i *Ingress) match(request *ConnectRequest) *ingressRule {
+	if i == nil {
+		return nil
+	}
+	host := request.Host()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	path := "/"
+	if u, err := url.Parse(request.Dest); err == nil && u.Path != "" {
+		path = u.Path
+	}
+	for _, rule := range i.rules {
+		if rule.match(host, path) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// originRequest rebuilds the edge request for the origin of rule.
+func (r *ingressRule) originRequest(ctx context.Context, request *ConnectRequest, body io.Reader) (*http.Request, error) {
+	dest, err := url.Parse(request.Dest)
+	if err != nil {
+		return nil, err
+	}
+	target := *r.origin
+	target.Path = strings.TrimSuffix(target.Path, "/") + dest.Path
+	target.RawQuery = dest.RawQuery
+
+	method := request.Method()
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	// 只有 Content-Length 给出的长度才是已知的，否则（包括 chunked）按未知长度转发到流结束。
+	header := request.Header()
+	contentLength, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	switch {
+	case request.Type == ConnectionTypeWebsocket, body == nil:
+		body, contentLength = nil, 0
+	case err != nil || contentLength < 0:
+		contentLength = -1
+	case contentLength > 0:
+		body = io.LimitReader(body, contentLength)
+	default:
+		body = nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = contentLength
+	if request.Type != ConnectionTypeWebsocket {
+		for _, h := range hopHeaders {
+			header.Del(h)
+		}
+	}
+	req.Header = header
+	req.Host = request.Host()
+	if r.unix != "" && req.Host == "" {
+		req.Host = "localhost"
+	}
+	return req, nil
+}
+
+func responseMetadata(status int, header http.Header, websocket bool) []Metadata {
+	metadata := []Metadata{{"HttpStatus", strconv.Itoa(status)}}
+	for key, values := range header {
+		if !websocket && isHopHeader(key) {
+			continue
+		}
+		for _, value := range values {
+			metadata = append(metadata, Metadata{"HttpHeader:" + key, value})
+		}
+	}
+	return metadata
+}
+
+func isHopHeader(key string) bool {
+	for _, h := range hopHeaders {
+		if strings.EqualFold(h, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveIngress answers a request routed by an ingress rule instead of the relay.
+func (d *Proxy) serveIngress(ctx context.Context, rss *RequestServerStream, request *ConnectRequest, rule *ingressRule) {
+	switch {
+	case rule == nil:
+		_ = rss.WriteConnectResponseData(nil, Metadata{"HttpStatus", strconv.Itoa(http.StatusNotFound)})
+	case rule.status != 0:
+		_ = rss.WriteConnectResponseData(nil, Metadata{"HttpStatus", strconv.Itoa(rule.status)})
+	case request.Type == ConnectionTypeWebsocket:
+		if err := rule.proxyWebsocket(ctx, rss, request); err != nil {
+			d.Log.Errorln("Ingress %s: %v", rule.service, err)
+		}
+	default:
+		if err := rule.proxyHTTP(ctx, rss, request); err != nil {
+			d.Log.Errorln("Ingress %s: %v", rule.service, err)
+		}
+	}
+}
+
+func (r *ingressRule) proxyHTTP(ctx context.Context, rss *RequestServerStream, request *ConnectRequest) error {
+	req, err := r.originRequest(ctx, request, rss)
+	if err != nil {
+		_ = rss.WriteConnectResponseData(err)
+		return err
+	}
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		_ = rss.WriteConnectResponseData(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = rss.WriteConnectResponseData(nil, responseMetadata(resp.StatusCode, resp.Header, false)...); err != nil {
+		return err
+	}
+	_, err = io.Copy(rss, resp.Body)
+	return err
+}
+
+func (r *ingressRule) proxyWebsocket(ctx context.Context, rss *RequestServerStream, request *ConnectRequest) error {
+	req, err := r.originRequest(ctx, request, nil)
+	if err != nil {
+		_ = rss.WriteConnectResponseData(err)
+		return err
+	}
+
+	address := r.origin.Host
+	if r.origin.Port() == "" {
+		port := "80"
+		if r.origin.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(r.origin.Hostname(), port)
+	}
+	conn, err := r.dialContext(ctx, "tcp", address)
+	if err != nil {
+		_ = rss.WriteConnectResponseData(err)
+		return err
+	}
+	defer conn.Close()
+	if r.origin.Scheme == "https" {
+		tlsConfig := r.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" && r.unix == "" {
+			tlsConfig.ServerName = r.origin.Hostname()
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	if err = req.Write(conn); err != nil {
+		_ = rss.WriteConnectResponseData(err)
+		return err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = rss.WriteConnectResponseData(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = rss.WriteConnectResponseData(nil, responseMetadata(resp.StatusCode, resp.Header, true)...); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_, err = io.Copy(rss, resp.Body)
+		return err
+	}
+
+	go func() {
+		_, _ = io.Copy(conn, rss)
+		_ = conn.Close()
+	}()
+	_, err = io.Copy(rss, br)
+	return err
+}
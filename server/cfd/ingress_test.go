@@ -0,0 +1,64 @@
+package cfd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOriginRequestBody(t *testing.T) {
+	type received struct {
+		body          string
+		contentLength int64
+	}
+	got := make(chan received, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{string(body), r.ContentLength}
+	}))
+	defer ts.Close()
+	ingress, err := NewIngress([]IngressRule{{Service: ts.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := ingress.rules[0]
+
+	tests := []struct {
+		name    string
+		method  string
+		headers []Metadata
+		body    string
+		want    received
+	}{
+		// 没有 Content-Length 也不是 chunked 时长度未知，请求体要完整转发。
+		{"unknown length", http.MethodPost, nil, "hello", received{"hello", -1}},
+		{"known length", http.MethodPost, []Metadata{{"HttpHeader:Content-Length", "3"}}, "abcdef", received{"abc", 3}},
+		{"chunked", http.MethodPost, []Metadata{{"HttpHeader:Transfer-Encoding", "chunked"}}, "chunks", received{"chunks", -1}},
+		{"zero length", http.MethodPost, []Metadata{{"HttpHeader:Content-Length", "0"}}, "ignored", received{"", 0}},
+		{"empty body", http.MethodGet, nil, "", received{"", 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &ConnectRequest{
+				Dest:     "https://app.example.com/upload",
+				Type:     ConnectionTypeHTTP,
+				Metadata: append([]Metadata{{"HttpMethod", tt.method}, {"HttpHost", "app.example.com"}}, tt.headers...),
+			}
+			req, err := rule.originRequest(context.Background(), request, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if r := <-got; r != tt.want {
+				t.Fatalf("origin received %q with length %d, want %q with length %d", r.body, r.contentLength, tt.want.body, tt.want.contentLength)
+			}
+		})
+	}
+}
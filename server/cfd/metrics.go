@@ -0,0 +1,367 @@
+package cfd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxDialRoutes bounds the route label, further outbounds and services are counted as "other".
+	maxDialRoutes = 512
+
+	streamUDP = "udp"
+)
+
+// dialBuckets are the upper bounds in seconds of the dial latency histogram.
+var dialBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// WarpState is the state of the WARP device at the time of a scrape.
+type WarpState struct {
+	LastHandshake time.Time
+	RxBytes       uint64
+	TxBytes       uint64
+	// Healthy is false once the health checks fail, Fallback while traffic goes directly instead.
+	Healthy   bool
+	Fallback  bool
+	Account   string
+	Endpoint  string
+	LastProbe time.Time
+	LastError string
+}
+
+type connectionMetric struct {
+	protocol string
+	edge     netip.AddrPort
+	location string
+}
+
+type dialMetric struct {
+	buckets  []uint64
+	count    uint64
+	sum      float64
+	failures uint64
+}
+
+// Metrics collects tunnel statistics and serves them in the Prometheus text format.
+// A nil *Metrics records nothing.
+type Metrics struct {
+	// Tunnel labels every sample when several tunnels are served.
+	Tunnel string
+	// Warp reports the WARP device, nil when WARP is not used.
+	Warp func() WarpState
+
+	mu                   sync.Mutex
+	connections          map[uint8]connectionMetric
+	registrations        uint64
+	registrationFailures uint64
+	activeStreams        map[string]int64
+	totalStreams         map[string]uint64
+	dials                map[string]*dialMetric
+
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		connections:   make(map[uint8]connectionMetric),
+		activeStreams: make(map[string]int64),
+		totalStreams:  make(map[string]uint64),
+		dials:         make(map[string]*dialMetric),
+	}
+}
+
+func (m *Metrics) connectionRegistered(connIndex uint8, protocol string, edge netip.AddrPort, location string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.connections[connIndex] = connectionMetric{protocol: protocol, edge: edge, location: location}
+	m.mu.Unlock()
+}
+
+func (m *Metrics) connectionClosed(connIndex uint8) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.connections, connIndex)
+	m.mu.Unlock()
+}
+
+// ConnectionCount returns the number of registered HA connections.
+func (m *Metrics) ConnectionCount() int {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.connections)
+}
+
+func (m *Metrics) registrationAttempted() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.registrations++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) registrationFailed() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.registrationFailures++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) streamStarted(protocol string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.activeStreams[protocol]++
+	m.totalStreams[protocol]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) streamFinished(protocol string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.activeStreams[protocol]--
+	m.mu.Unlock()
+}
+
+func (m *Metrics) dialed(route string, latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dial, ok := m.dials[route]
+	if !ok {
+		if len(m.dials) >= maxDialRoutes {
+			route = "other"
+			dial = m.dials[route]
+		}
+		if dial == nil {
+			dial = &dialMetric{buckets: make([]uint64, len(dialBuckets))}
+			m.dials[route] = dial
+		}
+	}
+	if err != nil {
+		dial.failures++
+		return
+	}
+	seconds := latency.Seconds()
+	for i, le := range dialBuckets {
+		if seconds <= le {
+			dial.buckets[i]++
+		}
+	}
+	dial.count++
+	dial.sum += seconds
+}
+
+// received counts bytes from the edge to origins, sent counts the other direction.
+func (m *Metrics) received(n int) {
+	if m != nil {
+		m.bytesIn.Add(uint64(n))
+	}
+}
+
+func (m *Metrics) sent(n int) {
+	if m != nil {
+		m.bytesOut.Add(uint64(n))
+	}
+}
+
+// MetricsHandler serves the metrics of one or more tunnels in the Prometheus text format.
+type MetricsHandler []*Metrics
+
+func (h MetricsHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	// 每个指标族要连续输出所有隧道的样本，因此先锁住全部隧道。
+	for _, m := range h {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+	h.writeText(w)
+}
+
+// writeText writes every metric family once, with a sample per tunnel.
+func (h MetricsHandler) writeText(w io.Writer) {
+	writeHeader(w, "cftun_ha_connections", "gauge", "Number of registered HA connections.")
+	for _, m := range h {
+		fmt.Fprintf(w, "cftun_ha_connections%s %d\n", m.labels(), len(m.connections))
+	}
+	writeHeader(w, "cftun_ha_connection_info", "gauge", "Registered HA connection with its edge location and address.")
+	for _, m := range h {
+		indexes := make([]int, 0, len(m.connections))
+		for connIndex := range m.connections {
+			indexes = append(indexes, int(connIndex))
+		}
+		sort.Ints(indexes)
+		for _, connIndex := range indexes {
+			c := m.connections[uint8(connIndex)]
+			fmt.Fprintf(w, "cftun_ha_connection_info%s 1\n", m.labels("conn_index", strconv.Itoa(connIndex),
+				"protocol", c.protocol, "edge_address", c.edge.String(), "location", c.location))
+		}
+	}
+
+	writeHeader(w, "cftun_registration_attempts_total", "counter", "Connection registration attempts.")
+	for _, m := range h {
+		fmt.Fprintf(w, "cftun_registration_attempts_total%s %d\n", m.labels(), m.registrations)
+	}
+	writeHeader(w, "cftun_registration_failures_total", "counter", "Connection attempts that did not register.")
+	for _, m := range h {
+		fmt.Fprintf(w, "cftun_registration_failures_total%s %d\n", m.labels(), m.registrationFailures)
+	}
+
+	writeHeader(w, "cftun_active_streams", "gauge", "Streams being served by protocol.")
+	for _, m := range h {
+		for _, protocol := range sortedKeys(m.activeStreams) {
+			fmt.Fprintf(w, "cftun_active_streams%s %d\n", m.labels("protocol", protocol), m.activeStreams[protocol])
+		}
+	}
+	writeHeader(w, "cftun_streams_total", "counter", "Streams served by protocol.")
+	for _, m := range h {
+		for _, protocol := range sortedKeys(m.totalStreams) {
+			fmt.Fprintf(w, "cftun_streams_total%s %d\n", m.labels("protocol", protocol), m.totalStreams[protocol])
+		}
+	}
+
+	writeHeader(w, "cftun_dial_duration_seconds", "histogram", "Latency of successful dials by outbound or service.")
+	for _, m := range h {
+		for _, route := range sortedKeys(m.dials) {
+			dial := m.dials[route]
+			for i, le := range dialBuckets {
+				fmt.Fprintf(w, "cftun_dial_duration_seconds_bucket%s %d\n",
+					m.labels("route", route, "le", strconv.FormatFloat(le, 'g', -1, 64)), dial.buckets[i])
+			}
+			fmt.Fprintf(w, "cftun_dial_duration_seconds_bucket%s %d\n", m.labels("route", route, "le", "+Inf"), dial.count)
+			fmt.Fprintf(w, "cftun_dial_duration_seconds_sum%s %g\n", m.labels("route", route), dial.sum)
+			fmt.Fprintf(w, "cftun_dial_duration_seconds_count%s %d\n", m.labels("route", route), dial.count)
+		}
+	}
+	writeHeader(w, "cftun_dial_failures_total", "counter", "Failed dials by outbound or service.")
+	for _, m := range h {
+		for _, route := range sortedKeys(m.dials) {
+			fmt.Fprintf(w, "cftun_dial_failures_total%s %d\n", m.labels("route", route), m.dials[route].failures)
+		}
+	}
+
+	writeHeader(w, "cftun_received_bytes_total", "counter", "Bytes received from the edge and written to origins.")
+	for _, m := range h {
+		fmt.Fprintf(w, "cftun_received_bytes_total%s %d\n", m.labels(), m.bytesIn.Load())
+	}
+	writeHeader(w, "cftun_sent_bytes_total", "counter", "Bytes read from origins and sent to the edge.")
+	for _, m := range h {
+		fmt.Fprintf(w, "cftun_sent_bytes_total%s %d\n", m.labels(), m.bytesOut.Load())
+	}
+
+	var warps []*Metrics
+	states := make(map[*Metrics]WarpState)
+	for _, m := range h {
+		if m.Warp != nil {
+			warps = append(warps, m)
+			states[m] = m.Warp()
+		}
+	}
+	if len(warps) == 0 {
+		return
+	}
+	writeHeader(w, "cftun_warp_up", "gauge", "Whether the WARP device completed a handshake in the last 3 minutes.")
+	for _, m := range warps {
+		up := 0
+		// WireGuard 每 2 分钟重新握手，超过 3 分钟未握手视为断开。
+		if lastHandshake := states[m].LastHandshake; !lastHandshake.IsZero() && time.Since(lastHandshake) < 3*time.Minute {
+			up = 1
+		}
+		fmt.Fprintf(w, "cftun_warp_up%s %d\n", m.labels(), up)
+	}
+	writeHeader(w, "cftun_warp_healthy", "gauge", "Whether the WARP health checks pass.")
+	for _, m := range warps {
+		fmt.Fprintf(w, "cftun_warp_healthy%s %d\n", m.labels(), boolGauge(states[m].Healthy))
+	}
+	writeHeader(w, "cftun_warp_fallback", "gauge", "Whether WARP traffic goes directly because the tunnel is down.")
+	for _, m := range warps {
+		fmt.Fprintf(w, "cftun_warp_fallback%s %d\n", m.labels(), boolGauge(states[m].Fallback))
+	}
+	writeHeader(w, "cftun_warp_last_handshake_timestamp_seconds", "gauge", "Unix time of the last WARP handshake.")
+	for _, m := range warps {
+		var lastHandshake int64
+		if !states[m].LastHandshake.IsZero() {
+			lastHandshake = states[m].LastHandshake.Unix()
+		}
+		fmt.Fprintf(w, "cftun_warp_last_handshake_timestamp_seconds%s %d\n", m.labels(), lastHandshake)
+	}
+	writeHeader(w, "cftun_warp_received_bytes_total", "counter", "Bytes received by the WARP device.")
+	for _, m := range warps {
+		fmt.Fprintf(w, "cftun_warp_received_bytes_total%s %d\n", m.labels(), states[m].RxBytes)
+	}
+	writeHeader(w, "cftun_warp_sent_bytes_total", "counter", "Bytes sent by the WARP device.")
+	for _, m := range warps {
+		fmt.Fprintf(w, "cftun_warp_sent_bytes_total%s %d\n", m.labels(), states[m].TxBytes)
+	}
+}
+
+// labels formats the tunnel label followed by the given name and value pairs.
+func (m *Metrics) labels(pairs ...string) string {
+	if m.Tunnel != "" {
+		pairs = append([]string{"tunnel", m.Tunnel}, pairs...)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteByte('=')
+		b.WriteString(quoteLabel(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func boolGauge(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
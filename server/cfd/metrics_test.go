@@ -0,0 +1,31 @@
+package cfd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDialedIsLabelledByRoute(t *testing.T) {
+	outbound := &Outbound{Name: "test", Dial: func(network, address string) (net.Conn, error) {
+		return nil, errors.New("not dialing")
+	}}
+	metrics := NewMetrics()
+	proxy := &Proxy{Egress: &Egress{Default: outbound}, Metrics: metrics}
+
+	// 客户端可以任意指定目标，标签不能随目标增长。
+	for i := 0; i < 2*maxDialRoutes; i++ {
+		_, _ = proxy.Dial("tcp", fmt.Sprintf("192.0.2.%d:%d", i%256, 1000+i))
+	}
+	_, _, _ = proxy.DialService("tcp", NewService("db", []string{"192.0.2.1:5432"}))
+	_, _ = proxy.Dial("tcp", "not an address")
+
+	if got, want := sortedKeys(metrics.dials), []string{"none", "svc:db", "test"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("routes %v, want %v", got, want)
+	}
+	if failures := metrics.dials["test"].failures; failures != 2*maxDialRoutes {
+		t.Fatalf("%d failures under test, want %d", failures, 2*maxDialRoutes)
+	}
+}
@@ -0,0 +1,179 @@
+package cfd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var ErrPolicyDenied = errors.New("destination denied by policy")
+
+// SafeDefaultDenyPrefixes blocks loopback, link-local ranges and well-known cloud metadata addresses. The
+// unspecified addresses are included, connecting to them reaches the local host.
+var SafeDefaultDenyPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fd00:ec2::254/128"),
+	netip.MustParsePrefix("100.100.100.200/32"),
+}
+
+// SafeDefaultDenyHosts blocks well-known cloud metadata hostnames.
+var SafeDefaultDenyHosts = []string{
+	"metadata",
+	"metadata.google.internal",
+	"metadata.azure.internal",
+}
+
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+func ParsePortRange(s string) (PortRange, error) {
+	from, to, found := strings.Cut(s, "-")
+	start, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	end := start
+	if found {
+		end, err = strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || end < start {
+			return PortRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return PortRange{From: uint16(start), To: uint16(end)}, nil
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+// PolicyRule matches a destination when every non-empty condition matches.
+type PolicyRule struct {
+	Allow    bool
+	Network  string
+	Prefixes []netip.Prefix
+	Ports    []PortRange
+	Hosts    []string
+}
+
+func (r *PolicyRule) match(network, host string, port uint16, ips []netip.Addr) bool {
+	if r.Network != "" && r.Network != network {
+		return false
+	}
+
+	if len(r.Ports) > 0 {
+		matched := false
+		for _, portRange := range r.Ports {
+			if portRange.contains(port) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Hosts) > 0 {
+		matched := false
+		for _, pattern := range r.Hosts {
+			if ok, _ := path.Match(pattern, host); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Prefixes) > 0 {
+		matched := false
+		for _, ip := range ips {
+			for _, prefix := range r.Prefixes {
+				if prefix.Contains(ip) {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Policy decides which destinations clients may ask the server to connect to.
+// Rules are evaluated in order and the first match wins.
+type Policy struct {
+	Rules        []*PolicyRule
+	DefaultAllow bool
+	// Resolver resolves host names for CIDR rules, nil uses the system resolver.
+	Resolver Resolver
+}
+
+func (p *Policy) needResolve() bool {
+	for _, rule := range p.Rules {
+		if len(rule.Prefixes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an error wrapping ErrPolicyDenied when the destination is not allowed. Otherwise it returns
+// the addresses a host name was checked against, which must be dialed instead of resolving the name again,
+// so that a DNS answer changing in between cannot reach a denied address. They are nil when the name was
+// not resolved.
+func (p *Policy) Check(network, address string) ([]netip.Addr, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrPolicyDenied, err.Error())
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid port %s", ErrPolicyDenied, portStr)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var ips, checked []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = append(ips, ip.Unmap())
+	} else if p.needResolve() {
+		// 域名需要解析后再匹配 CIDR 规则，防止通过域名绕过地址限制。
+		if ips, err = lookupHost(p.Resolver, host); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrPolicyDenied, err.Error())
+		}
+		checked = ips
+	}
+
+	for _, rule := range p.Rules {
+		if rule.match(network, host, uint16(port), ips) {
+			if rule.Allow {
+				return checked, nil
+			}
+			return nil, fmt.Errorf("%w: %s %s", ErrPolicyDenied, network, address)
+		}
+	}
+
+	if p.DefaultAllow {
+		return checked, nil
+	}
+	return nil, fmt.Errorf("%w: %s %s", ErrPolicyDenied, network, address)
+}
@@ -0,0 +1,78 @@
+package cfd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+// rebindingResolver answers each lookup with the next address, like a DNS server rebinding a name.
+type rebindingResolver struct {
+	mu    sync.Mutex
+	addrs []netip.Addr
+}
+
+func (r *rebindingResolver) LookupNetIP(_ context.Context, _ string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addr := r.addrs[0]
+	if len(r.addrs) > 1 {
+		r.addrs = r.addrs[1:]
+	}
+	return []netip.Addr{addr}, nil
+}
+
+func safePolicy(resolver Resolver) *Policy {
+	return &Policy{
+		Rules: []*PolicyRule{
+			{Prefixes: SafeDefaultDenyPrefixes},
+			{Hosts: SafeDefaultDenyHosts},
+		},
+		DefaultAllow: true,
+		Resolver:     resolver,
+	}
+}
+
+func TestPolicyDeniesLoopback(t *testing.T) {
+	resolver := &rebindingResolver{addrs: []netip.Addr{netip.MustParseAddr("127.0.0.1")}}
+	policy := safePolicy(resolver)
+	for _, address := range []string{
+		"127.0.0.1:22", "127.1.2.3:80", "[::1]:22", "localhost:22", "169.254.169.254:80",
+		"0.0.0.0:22", "0.1.2.3:22", "[::]:22", "[::ffff:0.0.0.0]:22",
+	} {
+		if _, err := policy.Check("tcp", address); !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%s: expected a denial, got %v", address, err)
+		}
+	}
+	if _, err := policy.Check("tcp", "192.0.2.1:443"); err != nil {
+		t.Errorf("192.0.2.1:443: %v", err)
+	}
+}
+
+func TestPolicyCheckedAddressesAreDialed(t *testing.T) {
+	public, loopback := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("127.0.0.1")
+	resolver := &rebindingResolver{addrs: []netip.Addr{public, loopback}}
+
+	checked, err := safePolicy(resolver).Check("tcp", "rebind.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checked) != 1 || checked[0] != public {
+		t.Fatalf("checked %v, want %v", checked, public)
+	}
+
+	var dialed string
+	outbound := &Outbound{Name: "test", Dial: func(network, address string) (net.Conn, error) {
+		dialed = address
+		return nil, errors.New("not dialing")
+	}}
+	// 再次解析会得到回环地址，拨号必须使用检查过的地址。
+	proxy := &Proxy{Egress: &Egress{Default: outbound, Resolver: resolver}}
+	_, _ = proxy.Dial("tcp", "rebind.example:443", checked...)
+	if dialed != "192.0.2.1:443" {
+		t.Fatalf("dialed %s, want the checked 192.0.2.1:443", dialed)
+	}
+}
@@ -1,6 +1,7 @@
 package cfd
 
 import (
+	"errors"
 	"io"
 )
 
@@ -8,6 +9,9 @@ type protocolSignature [6]byte
 
 var (
 	dataStreamProtocolSignature = protocolSignature{0x0A, 0x36, 0xCD, 0x12, 0xA1, 0x3E}
+	rpcStreamProtocolSignature  = protocolSignature{0x52, 0xBB, 0x82, 0x5C, 0xDB, 0x65}
+
+	errUnknownSignature = errors.New("unknown stream signature")
 )
 
 type protocolVersion string
@@ -18,6 +22,17 @@ const (
 	protocolVersionLength = 2
 )
 
+func readSignature(stream io.Reader) (protocolSignature, error) {
+	var signature protocolSignature
+	if _, err := io.ReadFull(stream, signature[:]); err != nil {
+		return signature, err
+	}
+	if signature != dataStreamProtocolSignature && signature != rpcStreamProtocolSignature {
+		return signature, errUnknownSignature
+	}
+	return signature, nil
+}
+
 func readVersion(stream io.Reader) (string, error) {
 	version := make([]byte, 2)
 	_, err := stream.Read(version)
@@ -37,6 +52,14 @@ func writeDataStreamPreamble(stream io.Writer) error {
 	return writeVersion(stream)
 }
 
+func writeRPCStreamPreamble(stream io.Writer) error {
+	if err := writeSignature(stream, rpcStreamProtocolSignature); err != nil {
+		return err
+	}
+
+	return writeVersion(stream)
+}
+
 func writeSignature(stream io.Writer, signature protocolSignature) error {
 	_, err := stream.Write(signature[:])
 	return err
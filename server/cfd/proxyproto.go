@@ -0,0 +1,119 @@
+package cfd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// parseSource 解析客户端上报的源地址，Cf-Connecting-Ip 只有 IP 没有端口。
+func parseSource(source string) netip.AddrPort {
+	if addrPort, err := netip.ParseAddrPort(source); err == nil {
+		return addrPort
+	}
+	if addr, err := netip.ParseAddr(source); err == nil {
+		return netip.AddrPortFrom(addr, 0)
+	}
+	return netip.AddrPort{}
+}
+
+func parseAddr(addr net.Addr) netip.AddrPort {
+	if addr == nil {
+		return netip.AddrPort{}
+	}
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return addrPort
+}
+
+// useProxyProtocol reports whether a PROXY header should be sent to the origin at address.
+func (d *Proxy) useProxyProtocol(network, address string) bool {
+	if d.ProxyProtocol == "" || network != "tcp" {
+		return false
+	}
+	if len(d.ProxyProtocolDests) == 0 {
+		return true
+	}
+	for _, dest := range d.ProxyProtocolDests {
+		if dest == address {
+			return true
+		}
+	}
+	return false
+}
+
+// writeProxyHeader sends a HAProxy PROXY header carrying the real client address to the origin.
+func (d *Proxy) writeProxyHeader(remoteConn net.Conn, network, address, source string) error {
+	if !d.useProxyProtocol(network, address) {
+		return nil
+	}
+
+	src := parseSource(source)
+	dst := parseAddr(remoteConn.RemoteAddr())
+
+	var header []byte
+	switch d.ProxyProtocol {
+	case ProxyProtocolV1:
+		header = proxyHeaderV1(src, dst)
+	case ProxyProtocolV2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("unsupported proxy protocol version: %s", d.ProxyProtocol)
+	}
+
+	_, err := remoteConn.Write(header)
+	return err
+}
+
+// sameFamily unmaps both addresses and reports whether they are valid and of the same family. The header
+// cannot describe a connection across families, the origin then uses the real connection endpoints.
+func sameFamily(src, dst netip.AddrPort) (netip.AddrPort, netip.AddrPort, bool) {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	return src, dst, src.IsValid() && dst.IsValid() && src.Addr().Is4() == dst.Addr().Is4()
+}
+
+func proxyHeaderV1(src, dst netip.AddrPort) []byte {
+	src, dst, ok := sameFamily(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if src.Addr().Is6() {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, src.Addr().String(), dst.Addr().String(), src.Port(), dst.Port()))
+}
+
+func proxyHeaderV2(src, dst netip.AddrPort) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 52))
+	buf.Write(proxyProtocolV2Signature)
+
+	src, dst, ok := sameFamily(src, dst)
+	if !ok {
+		// LOCAL command, the origin uses the real connection endpoints.
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	family, addrLen := byte(0x11), uint16(12)
+	if src.Addr().Is6() {
+		family, addrLen = 0x21, 36
+	}
+	buf.Write([]byte{0x21, family})
+	_ = binary.Write(buf, binary.BigEndian, addrLen)
+	buf.Write(src.Addr().AsSlice())
+	buf.Write(dst.Addr().AsSlice())
+	_ = binary.Write(buf, binary.BigEndian, src.Port())
+	_ = binary.Write(buf, binary.BigEndian, dst.Port())
+	return buf.Bytes()
+}
@@ -0,0 +1,95 @@
+package cfd
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst string
+		expected string
+	}{
+		{"ipv4", "198.51.100.7:50000", "192.0.2.1:22", "PROXY TCP4 198.51.100.7 192.0.2.1 50000 22\r\n"},
+		{"ipv6", "[2001:db8::7]:50000", "[2001:db8::1]:22", "PROXY TCP6 2001:db8::7 2001:db8::1 50000 22\r\n"},
+		{"mapped ipv4", "[::ffff:198.51.100.7]:50000", "192.0.2.1:22", "PROXY TCP4 198.51.100.7 192.0.2.1 50000 22\r\n"},
+		{"mixed families", "198.51.100.7:50000", "[2001:db8::1]:22", "PROXY UNKNOWN\r\n"},
+		{"missing source", "", "192.0.2.1:22", "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(proxyHeaderV1(parseSource(tt.src), parseSource(tt.dst))); got != tt.expected {
+				t.Fatalf("got %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	local := append(append([]byte(nil), proxyProtocolV2Signature...), 0x20, 0x00, 0x00, 0x00)
+	ipv4 := append(append([]byte(nil), proxyProtocolV2Signature...), 0x21, 0x11, 0x00, 12,
+		198, 51, 100, 7, 192, 0, 2, 1, 0xc3, 0x50, 0x00, 22)
+	ipv6 := append(append([]byte(nil), proxyProtocolV2Signature...), 0x21, 0x21, 0x00, 36)
+	ipv6 = append(ipv6, netip.MustParseAddr("2001:db8::7").AsSlice()...)
+	ipv6 = append(ipv6, netip.MustParseAddr("2001:db8::1").AsSlice()...)
+	ipv6 = append(ipv6, 0xc3, 0x50, 0x00, 22)
+
+	tests := []struct {
+		name     string
+		src, dst string
+		expected []byte
+	}{
+		{"ipv4", "198.51.100.7:50000", "192.0.2.1:22", ipv4},
+		{"ipv6", "[2001:db8::7]:50000", "[2001:db8::1]:22", ipv6},
+		{"mapped ipv4", "198.51.100.7:50000", "[::ffff:192.0.2.1]:22", ipv4},
+		{"mixed families", "[2001:db8::7]:50000", "192.0.2.1:22", local},
+		{"missing source", "", "192.0.2.1:22", local},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxyHeaderV2(parseSource(tt.src), parseSource(tt.dst)); !bytes.Equal(got, tt.expected) {
+				t.Fatalf("got %x, want %x", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderSource(t *testing.T) {
+	origin := echoOrigin(t)
+	request := &ConnectRequest{Metadata: []Metadata{
+		{"HttpHeader:Forward-Src", "203.0.113.66:1234"},
+		{"HttpHeader:Cf-Connecting-Ip", "198.51.100.7"},
+	}}
+	tests := []struct {
+		name     string
+		signed   bool
+		expected string
+	}{
+		// 未签名的 Forward-Src 不可信，使用 Cloudflare 看到的地址。
+		{"unsigned", false, "PROXY TCP4 198.51.100.7 127.0.0.1 0 "},
+		{"signed", true, "PROXY TCP4 203.0.113.66 127.0.0.1 1234 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			proxy := &Proxy{ProxyProtocol: ProxyProtocolV1}
+			if err = proxy.writeProxyHeader(conn, "tcp", origin, request.Source(tt.signed)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len(tt.expected))
+			if _, err = conn.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != tt.expected {
+				t.Fatalf("header %q, want prefix %q", buf, tt.expected)
+			}
+		})
+	}
+}
@@ -50,14 +50,50 @@ func (d *ConnectionDetails) UnmarshalCapnproto(s capnp.Struct) error {
 	return nil
 }
 
-func RegisterConnection(ctx context.Context, stream io.ReadWriteCloser, connIndex byte, credentials *Credentials, connOptions *ConnectionOptions) (*ConnectionDetails, error) {
-	client := rpc.NewConn(rpc.StreamTransport(stream), rpc.ConnLog(nil)).Bootstrap(ctx)
+const (
+	registrationInterfaceID   = 0xf71695ec7fe85497
+	registrationInterfaceName = "tunnelrpc/proto/tunnelrpc.capnp:RegistrationServer"
+)
+
+// RegistrationClient calls the RegistrationServer of the edge over the control stream.
+type RegistrationClient struct {
+	conn   *rpc.Conn
+	client capnp.Client
+}
+
+// NewRegistrationClient exports main to the edge on the control stream.
+func NewRegistrationClient(ctx context.Context, stream io.ReadWriteCloser, main capnp.Client) *RegistrationClient {
+	conn := rpc.NewConn(rpc.StreamTransport(stream), rpc.MainInterface(main), rpc.ConnLog(nil))
+	return &RegistrationClient{conn: conn, client: conn.Bootstrap(ctx)}
+}
+
+func (r *RegistrationClient) Close() error {
+	return r.conn.Close()
+}
+
+// UnregisterConnection asks the edge to stop routing new requests to this connection.
+func (r *RegistrationClient) UnregisterConnection(ctx context.Context) error {
 	call := &capnp.Call{
 		Ctx: ctx,
 		Method: capnp.Method{
-			InterfaceID:   0xf71695ec7fe85497,
+			InterfaceID:   registrationInterfaceID,
+			MethodID:      1,
+			InterfaceName: registrationInterfaceName,
+			MethodName:    "unregisterConnection",
+		},
+		ParamsSize: capnp.ObjectSize{},
+	}
+	_, err := r.client.Call(call).Struct()
+	return err
+}
+
+func (r *RegistrationClient) RegisterConnection(ctx context.Context, connIndex byte, credentials *Credentials, connOptions *ConnectionOptions) (*ConnectionDetails, error) {
+	call := &capnp.Call{
+		Ctx: ctx,
+		Method: capnp.Method{
+			InterfaceID:   registrationInterfaceID,
 			MethodID:      0,
-			InterfaceName: "tunnelrpc/proto/tunnelrpc.capnp:RegistrationServer",
+			InterfaceName: registrationInterfaceName,
 			MethodName:    "registerConnection",
 		},
 		Options:    capnp.CallOptions{},
@@ -86,6 +122,16 @@ func RegisterConnection(ctx context.Context, stream io.ReadWriteCloser, connInde
 			clientStruct, _ := capnp.NewStruct(optionsStruct.Segment(), capnp.ObjectSize{DataSize: 0, PointerCount: 4})
 			c := connOptions.Client
 			_ = clientStruct.SetData(0, c.ClientID)
+			if len(c.Features) > 0 {
+				features, err := capnp.NewTextList(clientStruct.Segment(), int32(len(c.Features)))
+				if err != nil {
+					return err
+				}
+				for i, feature := range c.Features {
+					_ = features.Set(i, feature)
+				}
+				_ = clientStruct.SetPtr(1, features.List.ToPtr())
+			}
 			_ = clientStruct.SetText(2, c.Version)
 			_ = clientStruct.SetText(3, c.Arch)
 
@@ -95,7 +141,7 @@ func RegisterConnection(ctx context.Context, stream io.ReadWriteCloser, connInde
 		},
 	}
 
-	respStruct, err := capnp.NewPipeline(client.Call(call)).GetPipeline(0).Struct()
+	respStruct, err := capnp.NewPipeline(r.client.Call(call)).GetPipeline(0).Struct()
 	if err != nil {
 		return nil, err
 	}
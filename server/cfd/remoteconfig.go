@@ -0,0 +1,145 @@
+package cfd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	capnp "zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/server"
+)
+
+const (
+	FeatureAllowRemoteConfig = "allow_remote_config"
+
+	configurationManagerInterfaceID   = 0xb48edfbdaa25db04
+	configurationManagerInterfaceName = "tunnelrpc/proto/tunnelrpc.capnp:ConfigurationManager"
+)
+
+var ErrRemoteConfigDisabled = errors.New("remote configuration is disabled")
+
+// Features returns the features announced to the edge, the edge only pushes configurations when
+// remoteConfig announces allow_remote_config.
+func Features(datagramVersion string, remoteConfig bool) []string {
+	features := DatagramFeatures(datagramVersion)
+	if remoteConfig {
+		features = append(features, FeatureAllowRemoteConfig)
+	}
+	return features
+}
+
+type remoteOriginRequest struct {
+	NoTLSVerify *bool `json:"noTLSVerify,omitempty"`
+}
+
+type remoteIngressRule struct {
+	Hostname      string              `json:"hostname,omitempty"`
+	Path          string              `json:"path,omitempty"`
+	Service       string              `json:"service,omitempty"`
+	OriginRequest remoteOriginRequest `json:"originRequest"`
+}
+
+// remoteConfig is the configuration edited in the Zero Trust dashboard, only ingress is applied.
+type remoteConfig struct {
+	OriginRequest remoteOriginRequest `json:"originRequest"`
+	Ingress       []remoteIngressRule `json:"ingress"`
+}
+
+func parseRemoteConfig(data []byte) (*Ingress, error) {
+	var config remoteConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid remote configuration: %w", err)
+	}
+
+	rules := make([]IngressRule, 0, len(config.Ingress))
+	for _, r := range config.Ingress {
+		noTLSVerify := config.OriginRequest.NoTLSVerify
+		if r.OriginRequest.NoTLSVerify != nil {
+			noTLSVerify = r.OriginRequest.NoTLSVerify
+		}
+		rules = append(rules, IngressRule{
+			Hostname:    r.Hostname,
+			Path:        r.Path,
+			Service:     r.Service,
+			NoTLSVerify: noTLSVerify != nil && *noTLSVerify,
+		})
+	}
+	ingress, err := NewIngress(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	// The dashboard always ends with a catch-all http_status rule, which would answer
+	// websocket requests too. Keep the relay reachable behind it.
+	if n := len(ingress.rules); n > 0 {
+		last := ingress.rules[n-1]
+		if (last.hostname == "" || last.hostname == "*") && last.path == nil && last.status != 0 {
+			last.relay = true
+		}
+	}
+	return ingress, nil
+}
+
+// UpdateConfiguration applies a configuration pushed by the edge and returns the latest applied version.
+// Versions that are not newer than the applied one are acknowledged without change, every version is
+// refused unless RemoteConfig is set.
+func (d *Proxy) UpdateConfiguration(version int32, config []byte) (int32, error) {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+
+	latest := int32(-1)
+	if d.configApplied {
+		latest = d.configVersion
+	}
+	if !d.RemoteConfig {
+		d.Log.Warnln("Ignored remote configuration version %d, remote-config is not enabled", version)
+		return latest, ErrRemoteConfigDisabled
+	}
+	if version <= latest {
+		return latest, nil
+	}
+
+	ingress, err := parseRemoteConfig(config)
+	if err != nil {
+		d.Log.Errorln("Failed to apply remote configuration version %d: %v", version, err)
+		return latest, err
+	}
+	d.SetIngress(ingress)
+	d.configApplied = true
+	d.configVersion = version
+	d.Log.Infoln("Applied remote configuration version %d with %d ingress rules", version, len(ingress.rules))
+	return version, nil
+}
+
+func updateConfigurationMethod(proxy *Proxy) server.Method {
+	return server.Method{
+		Method: capnp.Method{
+			InterfaceID:   configurationManagerInterfaceID,
+			MethodID:      0,
+			InterfaceName: configurationManagerInterfaceName,
+			MethodName:    "updateConfiguration",
+		},
+		// updateConfiguration (version :Int32, config :Data)
+		// -> (result :UpdateConfigurationResponse(latestAppliedVersion :Int32, err :Text))
+		Impl: func(_ context.Context, _ capnp.CallOptions, params, results capnp.Struct) error {
+			configPtr, err := params.Ptr(0)
+			if err != nil {
+				return err
+			}
+			latest, applyErr := proxy.UpdateConfiguration(int32(params.Uint32(0)), configPtr.Data())
+
+			resp, err := capnp.NewStruct(results.Segment(), capnp.ObjectSize{DataSize: 8, PointerCount: 1})
+			if err != nil {
+				return err
+			}
+			resp.SetUint32(0, uint32(latest))
+			if applyErr != nil {
+				if err = resp.SetText(0, applyErr.Error()); err != nil {
+					return err
+				}
+			}
+			return results.SetPtr(0, resp.ToPtr())
+		},
+		ResultsSize: capnp.ObjectSize{DataSize: 0, PointerCount: 1},
+	}
+}
@@ -0,0 +1,156 @@
+package cfd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	capnp "zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/rpc"
+)
+
+// fakeEdge serves the CloudflaredServer of proxy on one end of a pipe and returns the capability the edge
+// bootstraps on the other.
+func fakeEdge(t *testing.T, proxy *Proxy) capnp.Client {
+	t.Helper()
+	server, edge := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	go serveCloudflaredRPC(ctx, server, cloudflaredServer(proxy, nil))
+	conn := rpc.NewConn(rpc.StreamTransport(edge), rpc.ConnLog(nil))
+	t.Cleanup(func() {
+		_ = conn.Close()
+		cancel()
+	})
+	return conn.Bootstrap(ctx)
+}
+
+// pushConfiguration calls updateConfiguration like the edge and returns the acknowledged version and error.
+func pushConfiguration(t *testing.T, client capnp.Client, version int32, config string) (int32, string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results, err := client.Call(&capnp.Call{
+		Ctx: ctx,
+		Method: capnp.Method{
+			InterfaceID:   configurationManagerInterfaceID,
+			MethodID:      0,
+			InterfaceName: configurationManagerInterfaceName,
+			MethodName:    "updateConfiguration",
+		},
+		ParamsSize: capnp.ObjectSize{DataSize: 8, PointerCount: 1},
+		ParamsFunc: func(s capnp.Struct) error {
+			s.SetUint32(0, uint32(version))
+			return s.SetData(0, []byte(config))
+		},
+	}).Struct()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, err := results.Ptr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := ptr.Struct()
+	text, err := resp.Ptr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int32(resp.Uint32(0)), text.Text()
+}
+
+const dashboardConfig = `{
+	"originRequest": {"noTLSVerify": true},
+	"ingress": [
+		{"hostname": "app.example.com", "service": "http_status:418"},
+		{"service": "http_status:404"}
+	]
+}`
+
+func TestUpdateConfiguration(t *testing.T) {
+	proxy := &Proxy{RemoteConfig: true}
+	edge := fakeEdge(t, proxy)
+
+	if latest, errText := pushConfiguration(t, edge, 3, dashboardConfig); latest != 3 || errText != "" {
+		t.Fatalf("version 3: latest %d, error %q", latest, errText)
+	}
+	rule := proxy.Ingress().match(&ConnectRequest{Dest: "https://app.example.com/", Metadata: []Metadata{{"HttpHost", "app.example.com"}}})
+	if rule == nil || rule.status != 418 {
+		t.Fatalf("the pushed ingress was not applied: %+v", rule)
+	}
+
+	// 旧版本只确认，不应用。
+	if latest, errText := pushConfiguration(t, edge, 2, `{"ingress": []}`); latest != 3 || errText != "" {
+		t.Fatalf("version 2: latest %d, error %q", latest, errText)
+	}
+	if latest, errText := pushConfiguration(t, edge, 4, `{"ingress": `); latest != 3 || errText == "" {
+		t.Fatalf("invalid version 4: latest %d, error %q", latest, errText)
+	}
+	if latest, errText := pushConfiguration(t, edge, 5, `{"ingress": [{"service": "http_status:404"}]}`); latest != 5 || errText != "" {
+		t.Fatalf("version 5: latest %d, error %q", latest, errText)
+	}
+}
+
+func TestUpdateConfigurationDisabled(t *testing.T) {
+	proxy := &Proxy{}
+	latest, errText := pushConfiguration(t, fakeEdge(t, proxy), 1, dashboardConfig)
+	if latest != -1 || !strings.Contains(errText, ErrRemoteConfigDisabled.Error()) {
+		t.Fatalf("latest %d, error %q", latest, errText)
+	}
+	if proxy.Ingress() != nil {
+		t.Fatal("a configuration was applied with remote-config disabled")
+	}
+	for _, feature := range Features(DatagramV2, false) {
+		if feature == FeatureAllowRemoteConfig {
+			t.Fatal("allow_remote_config is announced with remote-config disabled")
+		}
+	}
+}
+
+func TestRelayRequestsBypassIngress(t *testing.T) {
+	proxy := &Proxy{RemoteConfig: true}
+	if latest, errText := pushConfiguration(t, fakeEdge(t, proxy), 1, dashboardConfig); latest != 1 {
+		t.Fatalf("latest %d, error %q", latest, errText)
+	}
+	origin := echoOrigin(t)
+
+	request := func(relay bool) string {
+		metadata := []Metadata{
+			{"HttpHost", "app.example.com"},
+			{"HttpHeader:Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ=="},
+		}
+		if relay {
+			metadata = append(metadata, Metadata{"HttpHeader:Forward-Dest", origin}, Metadata{"HttpHeader:Forward-Proto", "tcp"})
+		}
+		stream, client := net.Pipe()
+		defer client.Close()
+		status := make(chan string, 1)
+		rss := &RequestServerStream{ReadWriteCloser: stream, respond: func(_ error, metadata []Metadata) error {
+			for _, m := range metadata {
+				if m.Key == "HttpStatus" {
+					status <- m.Val
+				}
+			}
+			return nil
+		}}
+		go proxy.handleRequest(context.Background(), rss, &ConnectRequest{
+			Dest:     "https://app.example.com/",
+			Type:     ConnectionTypeWebsocket,
+			Metadata: metadata,
+		})
+		select {
+		case s := <-status:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatal("no response")
+			return ""
+		}
+	}
+	// 仪表盘规则只处理普通 websocket 请求，中继请求仍连接 Forward-Dest。
+	if status := request(false); status != "418" {
+		t.Fatalf("websocket request: status %s, want the dashboard rule", status)
+	}
+	if status := request(true); status != "101" {
+		t.Fatalf("relay request: status %s, want the relay", status)
+	}
+}
@@ -0,0 +1,188 @@
+package cfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ServicePrefix marks a Forward-Dest that names a service instead of an address.
+const ServicePrefix = "svc:"
+
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceRandom     = "random"
+	BalanceFirst      = "first"
+)
+
+// defaultOriginCooldown is how long a failed origin is tried last before it gets another chance.
+const defaultOriginCooldown = 30 * time.Second
+
+var ErrUnknownService = errors.New("unknown service")
+
+// origin tracks TCP health only, UDP has no handshake that tells whether an origin is up.
+type origin struct {
+	address string
+	healthy atomic.Bool
+	// failedAt is the time of the last failure in unix nanoseconds.
+	failedAt atomic.Int64
+}
+
+// Service is a named pool of origins, clients request it with "svc:<name>".
+type Service struct {
+	Name           string
+	Balance        string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	// Cooldown restores failed origins passively, defaultOriginCooldown when zero.
+	Cooldown time.Duration
+	Log      *log.Logger
+
+	origins []*origin
+	next    atomic.Uint32
+}
+
+func NewService(name string, origins []string) *Service {
+	s := &Service{Name: name}
+	for _, address := range origins {
+		o := &origin{address: address}
+		o.healthy.Store(true)
+		s.origins = append(s.origins, o)
+	}
+	return s
+}
+
+// candidates returns the origins in dial order. TCP dials try healthy origins first, origins that failed more
+// than a cooldown ago count as healthy again.
+func (s *Service) candidates(network string) []string {
+	n := len(s.origins)
+	start := 0
+	switch s.Balance {
+	case BalanceRandom:
+		start = rand.Intn(n)
+	case BalanceFirst:
+	default:
+		start = int(s.next.Add(1)-1) % n
+	}
+
+	cooldown := s.Cooldown
+	if cooldown <= 0 {
+		cooldown = defaultOriginCooldown
+	}
+	var healthy, unhealthy []string
+	for i := 0; i < n; i++ {
+		o := s.origins[(start+i)%n]
+		if network != "tcp" || o.healthy.Load() || time.Since(time.Unix(0, o.failedAt.Load())) >= cooldown {
+			healthy = append(healthy, o.address)
+		} else {
+			unhealthy = append(unhealthy, o.address)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (s *Service) setHealthy(address string, healthy bool) {
+	for _, o := range s.origins {
+		if o.address != address {
+			continue
+		}
+		if !healthy {
+			o.failedAt.Store(time.Now().UnixNano())
+		}
+		if o.healthy.Swap(healthy) != healthy {
+			if healthy {
+				s.Log.Infoln("Service %s: origin %s is healthy", s.Name, address)
+			} else {
+				s.Log.Warnln("Service %s: origin %s is unhealthy", s.Name, address)
+			}
+		}
+	}
+}
+
+// healthCheck probes the origins over TCP every interval until ctx is done.
+func (s *Service) healthCheck(ctx context.Context, dial func(network, address string) (net.Conn, error)) {
+	ticker := time.NewTicker(s.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, o := range s.origins {
+			go func(address string) {
+				conn, err := dial("tcp", address)
+				if err == nil {
+					_ = conn.Close()
+				}
+				s.setHealthy(address, err == nil)
+			}(o.address)
+		}
+	}
+}
+
+// Services maps service names to origin pools.
+type Services struct {
+	Services map[string]*Service
+	Default  string
+}
+
+// Lookup returns the service requested by address, or nil when address is a plain destination.
+// A request with a protocol but no destination uses the default service.
+func (s *Services) Lookup(network, address string) (*Service, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var name string
+	switch {
+	case strings.HasPrefix(address, ServicePrefix):
+		name = strings.TrimPrefix(address, ServicePrefix)
+	case address == "" && network != "" && s.Default != "":
+		name = s.Default
+	default:
+		return nil, nil
+	}
+	service, ok := s.Services[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownService, name)
+	}
+	return service, nil
+}
+
+// StartHealthChecks probes the origins of every service with an interval configured until ctx is done.
+func (s *Services) StartHealthChecks(ctx context.Context, proxy *Proxy) {
+	if s == nil {
+		return
+	}
+	for _, service := range s.Services {
+		if service.HealthInterval <= 0 {
+			continue
+		}
+		timeout := service.HealthTimeout
+		go service.healthCheck(ctx, func(network, address string) (net.Conn, error) {
+			return proxy.DialTimeout(network, address, timeout)
+		})
+	}
+}
+
+// DialService connects to the first reachable origin of service.
+func (d *Proxy) DialService(network string, service *Service) (net.Conn, string, error) {
+	var err error
+	for _, address := range service.candidates(network) {
+		var conn net.Conn
+		conn, err = d.dial(service.Name, network, address, nil)
+		if network == "tcp" {
+			service.setHealthy(address, err == nil)
+		}
+		if err == nil {
+			return conn, address, nil
+		}
+	}
+	return nil, "", fmt.Errorf("service %s: no origin available: %w", service.Name, err)
+}
@@ -0,0 +1,125 @@
+package cfd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// switchOutbound fails the dials to the addresses marked down.
+type switchOutbound struct {
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+func (o *switchOutbound) setDown(address string, down bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.down[address] = down
+}
+
+func (o *switchOutbound) outbound() *Outbound {
+	return &Outbound{Name: "test", Dial: func(network, address string) (net.Conn, error) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if o.down[address] {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}}
+}
+
+func TestServiceCandidates(t *testing.T) {
+	service := NewService("db", []string{"192.0.2.1:5432", "192.0.2.2:5432"})
+	service.Balance = BalanceFirst
+	service.Cooldown = 50 * time.Millisecond
+	service.setHealthy("192.0.2.1:5432", false)
+
+	if got, want := service.candidates("tcp"), []string{"192.0.2.2:5432", "192.0.2.1:5432"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tcp candidates %v, want %v", got, want)
+	}
+	// UDP 不使用 TCP 的健康状态。
+	if got, want := service.candidates("udp"), []string{"192.0.2.1:5432", "192.0.2.2:5432"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("udp candidates %v, want %v", got, want)
+	}
+	time.Sleep(2 * service.Cooldown)
+	if got, want := service.candidates("tcp"), []string{"192.0.2.1:5432", "192.0.2.2:5432"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tcp candidates after the cooldown %v, want %v", got, want)
+	}
+}
+
+func TestDialServiceRestoresOrigin(t *testing.T) {
+	first, second := "192.0.2.1:5432", "192.0.2.2:5432"
+	outbound := &switchOutbound{down: map[string]bool{first: true}}
+	proxy := &Proxy{Egress: &Egress{Default: outbound.outbound()}}
+	service := NewService("db", []string{first, second})
+	service.Balance = BalanceFirst
+	service.Cooldown = 50 * time.Millisecond
+
+	dial := func(network, want string) {
+		t.Helper()
+		conn, address, err := proxy.DialService(network, service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+		if address != want {
+			t.Fatalf("%s dialed %s, want %s", network, address, want)
+		}
+	}
+	dial("tcp", second)
+	if service.origins[0].healthy.Load() {
+		t.Fatal("the failed origin is still healthy")
+	}
+	dial("tcp", second)
+
+	// 冷却结束后重新尝试失败的源站，连接成功即恢复健康。
+	outbound.setDown(first, false)
+	time.Sleep(2 * service.Cooldown)
+	dial("tcp", first)
+	if !service.origins[0].healthy.Load() {
+		t.Fatal("the origin was not restored")
+	}
+
+	outbound.setDown(first, true)
+	dial("udp", second)
+	if !service.origins[0].healthy.Load() {
+		t.Fatal("a udp dial marked the origin unhealthy")
+	}
+}
+
+func TestHealthCheckStopsWithContext(t *testing.T) {
+	service := NewService("db", []string{"192.0.2.1:5432"})
+	service.HealthInterval = 5 * time.Millisecond
+	var probes atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		service.healthCheck(ctx, func(network, address string) (net.Conn, error) {
+			if network != "tcp" {
+				t.Errorf("probed over %s", network)
+			}
+			probes.Add(1)
+			return nil, errors.New("connection refused")
+		})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the health check did not stop")
+	}
+	if probes.Load() == 0 {
+		t.Fatal("the origins were never probed")
+	}
+}
@@ -0,0 +1,166 @@
+package cfd
+
+import (
+	"context"
+	"fmt"
+	"github.com/fmnx/cftun/uuid"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+	capnp "zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/rpc"
+	"zombiezen.com/go/capnproto2/server"
+)
+
+const (
+	sessionManagerInterfaceID   = 0x839445a59fb01686
+	sessionManagerInterfaceName = "tunnelrpc/proto/tunnelrpc.capnp:SessionManager"
+)
+
+// serveRPCStream answers the calls the edge makes on cloudflared over stream.
+func (q *QuicConnection) serveRPCStream(ctx context.Context, stream io.ReadWriteCloser) {
+	if _, err := readVersion(stream); err != nil {
+		return
+	}
+	serveCloudflaredRPC(ctx, stream, cloudflaredServer(q.proxy, q.datagrams))
+}
+
+// cloudflaredServer exports the CloudflaredServer interface, datagrams is nil when UDP sessions are not carried.
+func cloudflaredServer(proxy *Proxy, datagrams *datagramMuxer) capnp.Client {
+	methods := []server.Method{updateConfigurationMethod(proxy)}
+	if datagrams != nil {
+		methods = append(methods, datagrams.sessionMethods()...)
+	}
+	return server.New(methods, nil)
+}
+
+func serveCloudflaredRPC(ctx context.Context, stream io.ReadWriteCloser, main capnp.Client) {
+	conn := rpc.NewConn(rpc.StreamTransport(stream), rpc.MainInterface(main), rpc.ConnLog(nil))
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		_ = conn.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// sessionMethods implements the SessionManager interface.
+func (m *datagramMuxer) sessionMethods() []server.Method {
+	return []server.Method{
+		{
+			Method: capnp.Method{
+				InterfaceID:   sessionManagerInterfaceID,
+				MethodID:      0,
+				InterfaceName: sessionManagerInterfaceName,
+				MethodName:    "registerUdpSession",
+			},
+			Impl:        m.registerUdpSession,
+			ResultsSize: capnp.ObjectSize{DataSize: 0, PointerCount: 1},
+		},
+		{
+			Method: capnp.Method{
+				InterfaceID:   sessionManagerInterfaceID,
+				MethodID:      1,
+				InterfaceName: sessionManagerInterfaceName,
+				MethodName:    "unregisterUdpSession",
+			},
+			Impl:        m.unregisterUdpSessionCall,
+			ResultsSize: capnp.ObjectSize{},
+		},
+	}
+}
+
+// registerUdpSession (sessionId :Data, dstIp :Data, dstPort :UInt16, closeAfterIdleHint :Int64, traceContext :Text)
+// -> (result :RegisterUdpSessionResponse(err :Text, spans :Data))
+func (m *datagramMuxer) registerUdpSession(_ context.Context, _ capnp.CallOptions, params, results capnp.Struct) error {
+	idPtr, err := params.Ptr(0)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.FromBytes(idPtr.Data())
+	if err != nil {
+		return err
+	}
+	ipPtr, err := params.Ptr(1)
+	if err != nil {
+		return err
+	}
+	ip, ok := netip.AddrFromSlice(net.IP(ipPtr.Data()))
+	if !ok {
+		return fmt.Errorf("invalid destination IP %x", ipPtr.Data())
+	}
+	dst := netip.AddrPortFrom(ip.Unmap(), params.Uint16(0))
+	idle := time.Duration(int64(params.Uint64(8)))
+
+	resp, err := capnp.NewStruct(results.Segment(), capnp.ObjectSize{DataSize: 0, PointerCount: 2})
+	if err != nil {
+		return err
+	}
+	if err = m.register(id, dst, idle); err != nil {
+		m.q.proxy.Log.Warnln("Failed to register UDP session %s to %s: %v", id, dst, err)
+		if err = resp.SetText(0, err.Error()); err != nil {
+			return err
+		}
+	}
+	return results.SetPtr(0, resp.ToPtr())
+}
+
+// unregisterUdpSessionCall (sessionId :Data, message :Text) -> ()
+func (m *datagramMuxer) unregisterUdpSessionCall(_ context.Context, _ capnp.CallOptions, params, _ capnp.Struct) error {
+	idPtr, err := params.Ptr(0)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.FromBytes(idPtr.Data())
+	if err != nil {
+		return err
+	}
+	messagePtr, err := params.Ptr(1)
+	if err != nil {
+		return err
+	}
+	m.unregister(id, messagePtr.Text(), true)
+	return nil
+}
+
+// unregisterUdpSession tells the edge that a session was closed on this side.
+func (q *QuicConnection) unregisterUdpSession(id uuid.UUID, message string) error {
+	stream, err := q.conn.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if err = writeRPCStreamPreamble(stream); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), q.rpcTimeout)
+	defer cancel()
+	conn := rpc.NewConn(rpc.StreamTransport(stream), rpc.ConnLog(nil))
+	defer conn.Close()
+
+	call := &capnp.Call{
+		Ctx: ctx,
+		Method: capnp.Method{
+			InterfaceID:   sessionManagerInterfaceID,
+			MethodID:      1,
+			InterfaceName: sessionManagerInterfaceName,
+			MethodName:    "unregisterUdpSession",
+		},
+		ParamsSize: capnp.ObjectSize{DataSize: 0, PointerCount: 2},
+		ParamsFunc: func(s capnp.Struct) error {
+			if err := s.SetData(0, id[:]); err != nil {
+				return err
+			}
+			return s.SetText(1, message)
+		},
+	}
+	_, err = conn.Bootstrap(ctx).Call(call).Struct()
+	return err
+}
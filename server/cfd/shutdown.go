@@ -0,0 +1,55 @@
+package cfd
+
+import (
+	"context"
+	"github.com/fmnx/cftun/log"
+	"sync"
+	"time"
+)
+
+// activeStreams counts in-flight streams so a shutting down connection can wait for them.
+type activeStreams struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (a *activeStreams) add() {
+	a.mu.Lock()
+	a.n++
+	a.mu.Unlock()
+}
+
+func (a *activeStreams) done() {
+	a.mu.Lock()
+	a.n--
+	a.mu.Unlock()
+}
+
+func (a *activeStreams) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.n
+}
+
+// drain waits up to gracePeriod for the active streams to finish.
+func (a *activeStreams) drain(connIndex uint8, gracePeriod time.Duration, logger *log.Logger) {
+	deadline := time.Now().Add(gracePeriod)
+	for n := a.count(); n > 0; n = a.count() {
+		if time.Now().After(deadline) {
+			logger.Warnln("Connection %d: closing with %d streams still active after %s", connIndex, n, gracePeriod)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// unregister tells the edge to stop sending new requests over the connection.
+func unregister(registration *RegistrationClient, connIndex uint8, rpcTimeout time.Duration, logger *log.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	if err := registration.UnregisterConnection(ctx); err != nil {
+		logger.Warnln("Connection %d: failed to unregister: %v", connIndex, err)
+		return
+	}
+	logger.Infoln("Connection %d: unregistered, draining streams", connIndex)
+}
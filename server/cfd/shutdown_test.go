@@ -0,0 +1,182 @@
+package cfd
+
+import (
+	"context"
+	"github.com/fmnx/cftun/uuid"
+	"github.com/quic-go/quic-go"
+	"testing"
+	"time"
+	capnp "zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/server"
+)
+
+// registrationEdge serves the RegistrationServer of the edge on the control stream the tunnel opens. Every
+// unregisterConnection call is reported on the returned channel.
+func registrationEdge(t *testing.T, edge quic.Connection) <-chan struct{} {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	unregistered := make(chan struct{}, 1)
+	main := server.New([]server.Method{
+		{
+			Method: capnp.Method{
+				InterfaceID:   registrationInterfaceID,
+				MethodID:      0,
+				InterfaceName: registrationInterfaceName,
+				MethodName:    "registerConnection",
+			},
+			Impl: func(_ context.Context, _ capnp.CallOptions, _, results capnp.Struct) error {
+				resp, err := capnp.NewStruct(results.Segment(), capnp.ObjectSize{DataSize: 8, PointerCount: 1})
+				if err != nil {
+					return err
+				}
+				details, err := capnp.NewStruct(results.Segment(), capnp.ObjectSize{DataSize: 8, PointerCount: 2})
+				if err != nil {
+					return err
+				}
+				id, _ := uuid.NewRandom()
+				_ = details.SetData(0, id[:])
+				_ = details.SetText(1, "TEST")
+				resp.SetUint16(0, 1)
+				if err = resp.SetPtr(0, details.ToPtr()); err != nil {
+					return err
+				}
+				return results.SetPtr(0, resp.ToPtr())
+			},
+			ResultsSize: capnp.ObjectSize{DataSize: 0, PointerCount: 1},
+		},
+		{
+			Method: capnp.Method{
+				InterfaceID:   registrationInterfaceID,
+				MethodID:      1,
+				InterfaceName: registrationInterfaceName,
+				MethodName:    "unregisterConnection",
+			},
+			Impl: func(context.Context, capnp.CallOptions, capnp.Struct, capnp.Struct) error {
+				unregistered <- struct{}{}
+				return nil
+			},
+		},
+	}, nil)
+	go func() {
+		stream, err := edge.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		serveCloudflaredRPC(ctx, stream, main)
+	}()
+	return unregistered
+}
+
+// serveShutdownTest registers a connection with the fake edge under e and returns it once registered.
+func serveShutdownTest(t *testing.T, e *EdgeTunnelServer, gracePeriod time.Duration) (*QuicConnection, quic.Connection, <-chan struct{}) {
+	t.Helper()
+	conn, edge := quicPair(t)
+	unregistered := registrationEdge(t, edge)
+	q, _ := NewTunnelConnection(conn, 0, time.Second, gracePeriod, e.Proxy, DatagramV2)
+	q.shutdown = e.shutdownC()
+	registered := make(chan struct{})
+	q.onRegistered = func(*ConnectionDetails) { close(registered) }
+
+	e.running.Add(1)
+	go func() {
+		defer e.running.Done()
+		if err := q.Serve(context.Background(), &Credentials{}, &ConnectionOptions{Client: &ClientInfo{}}); err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection did not register")
+	}
+	return q, edge, unregistered
+}
+
+// openStream opens a stream from the edge with a partial signature, the tunnel keeps it in flight until the
+// edge closes it.
+func openStream(t *testing.T, edge quic.Connection) quic.Stream {
+	t.Helper()
+	stream, err := edge.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write(dataStreamProtocolSignature[:2]); err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func waitStreams(t *testing.T, q *QuicConnection, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.streams.count() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d active streams, want %d", q.streams.count(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsStreams(t *testing.T) {
+	e := &EdgeTunnelServer{Proxy: &Proxy{}}
+	q, edge, unregistered := serveShutdownTest(t, e, 5*time.Second)
+	inflight := openStream(t, edge)
+	waitStreams(t, q, 1)
+
+	done := make(chan struct{})
+	go func() {
+		e.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-unregistered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not unregistered")
+	}
+
+	// 注销后不再接受新的流，先等注销的响应到达。
+	time.Sleep(100 * time.Millisecond)
+	openStream(t, edge)
+	time.Sleep(200 * time.Millisecond)
+	if n := q.streams.count(); n != 1 {
+		t.Fatalf("%d active streams after unregistering, want only the in-flight one", n)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown returned with a stream in flight")
+	default:
+	}
+
+	start := time.Now()
+	_ = inflight.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown did not return once the stream finished")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took %s after the stream finished", elapsed)
+	}
+	waitStreams(t, q, 0)
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	e := &EdgeTunnelServer{Proxy: &Proxy{}}
+	gracePeriod := 300 * time.Millisecond
+	q, edge, unregistered := serveShutdownTest(t, e, gracePeriod)
+	openStream(t, edge)
+	waitStreams(t, q, 1)
+
+	start := time.Now()
+	e.Shutdown()
+	elapsed := time.Since(start)
+	select {
+	case <-unregistered:
+	default:
+		t.Fatal("the connection was not unregistered")
+	}
+	if elapsed < gracePeriod || elapsed > gracePeriod+2*time.Second {
+		t.Fatalf("shutdown took %s with a stuck stream, want about the grace period of %s", elapsed, gracePeriod)
+	}
+}
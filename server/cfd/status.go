@@ -0,0 +1,85 @@
+package cfd
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// ConnectionStatus is the state of one HA connection.
+type ConnectionStatus struct {
+	Index          int        `json:"index"`
+	Registered     bool       `json:"registered"`
+	UUID           string     `json:"uuid,omitempty"`
+	Location       string     `json:"location,omitempty"`
+	EdgeAddress    string     `json:"edge_address,omitempty"`
+	Protocol       string     `json:"protocol,omitempty"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+}
+
+func (e *EdgeTunnelServer) connectionStatus(connIndex int) *ConnectionStatus {
+	if e.status == nil {
+		e.status = make(map[int]*ConnectionStatus)
+	}
+	status, ok := e.status[connIndex]
+	if !ok {
+		status = &ConnectionStatus{Index: connIndex}
+		e.status[connIndex] = status
+	}
+	return status
+}
+
+func (e *EdgeTunnelServer) connectionUp(connIndex int, protocol string, edgeAddr netip.AddrPort, details *ConnectionDetails) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	status := e.connectionStatus(connIndex)
+	status.Registered = true
+	status.UUID = details.UUID.String()
+	status.Location = details.Location
+	status.EdgeAddress = edgeAddr.String()
+	status.Protocol = protocol
+	status.ConnectedSince = &now
+}
+
+func (e *EdgeTunnelServer) connectionDown(connIndex int, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status := e.connectionStatus(connIndex)
+	status.Registered = false
+	status.ConnectedSince = nil
+	if err != nil {
+		now := time.Now()
+		status.LastError = err.Error()
+		status.LastErrorAt = &now
+	}
+}
+
+// Status returns the state of every HA connection that has been started, ordered by index.
+func (e *EdgeTunnelServer) Status() []ConnectionStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	statuses := make([]ConnectionStatus, 0, len(e.status))
+	for _, status := range e.status {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Index < statuses[j].Index
+	})
+	return statuses
+}
+
+// ReadyConnections returns the number of registered HA connections.
+func (e *EdgeTunnelServer) ReadyConnections() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := 0
+	for _, status := range e.status {
+		if status.Registered {
+			n++
+		}
+	}
+	return n
+}
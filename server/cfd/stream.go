@@ -5,9 +5,15 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"github.com/fmnx/cftun/auth"
+	"github.com/fmnx/cftun/e2e"
 	"github.com/quic-go/quic-go"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,15 +24,36 @@ import (
 
 var idleTimeoutError = quic.IdleTimeoutError{}
 
+// ErrorHeader tells the client why a stream was refused.
+const ErrorHeader = "Cftun-Error"
+
+// ReplyHeader is sent by clients that read the reply to the first packet of a pre-dialed stream, see writeReply.
+const ReplyHeader = "Forward-Reply"
+
+const (
+	replyOK      = 0
+	replyRefused = 1
+)
+
+const (
+	ReasonAuthFailed      = "auth-failed"
+	ReasonPolicyDenied    = "policy-denied"
+	ReasonUnknownService  = "unknown-service"
+	ReasonHandshakeFailed = "handshake-failed"
+	ReasonDialRefused     = "dial-refused"
+	ReasonDialTimeout     = "dial-timeout"
+	ReasonDialFailed      = "dial-failed"
+)
+
 type RequestServerStream struct {
 	io.ReadWriteCloser
+
+	// respond replaces the capnp response for transports that carry it in HTTP headers.
+	respond func(respErr error, metadata []Metadata) error
 }
 
-func (rss *RequestServerStream) Accept() (network, address string, err error) {
-	request, err := rss.ReadConnectRequestData()
-	if err != nil {
-		return
-	}
+// Accept acknowledges the websocket upgrade of request, extra is appended to the response metadata.
+func (rss *RequestServerStream) Accept(request *ConnectRequest, extra ...Metadata) error {
 	k := sha1.New()
 	k.Write([]byte(request.WebsocketKey()))
 	k.Write([]byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
@@ -39,12 +66,15 @@ func (rss *RequestServerStream) Accept() (network, address string, err error) {
 		{"HttpHeader:Upgrade", "websocket"},
 	}
 
-	err = rss.WriteConnectResponseData(metadata...)
+	return rss.WriteConnectResponseData(nil, append(metadata, extra...)...)
+}
 
-	if err == nil {
-		network, address = request.Network(), request.Address()
-	}
-	return
+// Reject fails the request with an HTTP status and a machine-readable reason in ErrorHeader.
+func (rss *RequestServerStream) Reject(status int, reason string) error {
+	return rss.WriteConnectResponseData(nil,
+		Metadata{"HttpStatus", strconv.Itoa(status)},
+		Metadata{"HttpHeader:" + ErrorHeader, reason},
+	)
 }
 
 func (rss *RequestServerStream) ReadConnectRequestData() (*ConnectRequest, error) {
@@ -65,10 +95,16 @@ func (rss *RequestServerStream) ReadConnectRequestData() (*ConnectRequest, error
 }
 
 // WriteConnectResponseData writes response to a QUIC stream.
-func (rss *RequestServerStream) WriteConnectResponseData(metadata ...Metadata) error {
+func (rss *RequestServerStream) WriteConnectResponseData(respErr error, metadata ...Metadata) error {
+	if rss.respond != nil {
+		return rss.respond(respErr, metadata)
+	}
 	connectResponse := &ConnectResponse{
 		Metadata: metadata,
 	}
+	if respErr != nil {
+		connectResponse.Error = respErr.Error()
+	}
 
 	msg, err := connectResponse.ToPogs()
 	if err != nil {
@@ -83,6 +119,24 @@ func (rss *RequestServerStream) WriteConnectResponseData(metadata ...Metadata) e
 
 type ConnectionType uint16
 
+const (
+	ConnectionTypeHTTP ConnectionType = iota
+	ConnectionTypeWebsocket
+	ConnectionTypeTCP
+)
+
+func (t ConnectionType) String() string {
+	switch t {
+	case ConnectionTypeHTTP:
+		return "http"
+	case ConnectionTypeWebsocket:
+		return "websocket"
+	case ConnectionTypeTCP:
+		return "tcp"
+	}
+	return "unknown"
+}
+
 type Metadata struct {
 	Key string `capnp:"key"`
 	Val string `capnp:"val"`
@@ -121,6 +175,101 @@ func (r *ConnectRequest) Address() string {
 	return ""
 }
 
+func (r *ConnectRequest) Auth() string {
+	for _, metadata := range r.Metadata {
+		if metadata.Key == "HttpHeader:"+auth.Header {
+			return metadata.Val
+		}
+	}
+	return ""
+}
+
+// IsRelay reports whether the request carries the Forward-* headers of a cftun client.
+func (r *ConnectRequest) IsRelay() bool {
+	for _, metadata := range r.Metadata {
+		if strings.HasPrefix(metadata.Key, "HttpHeader:Forward-") {
+			return true
+		}
+	}
+	return false
+}
+
+// WantsReply reports whether the client reads the reply to the first packet of a pre-dialed stream.
+func (r *ConnectRequest) WantsReply() bool {
+	for _, metadata := range r.Metadata {
+		if metadata.Key == "HttpHeader:"+ReplyHeader {
+			return metadata.Val == "1"
+		}
+	}
+	return false
+}
+
+func (r *ConnectRequest) E2EKey() string {
+	for _, metadata := range r.Metadata {
+		if metadata.Key == "HttpHeader:"+e2e.Header {
+			return metadata.Val
+		}
+	}
+	return ""
+}
+
+func (r *ConnectRequest) Method() string {
+	for _, metadata := range r.Metadata {
+		if metadata.Key == "HttpMethod" {
+			return metadata.Val
+		}
+	}
+	return ""
+}
+
+func (r *ConnectRequest) Host() string {
+	for _, metadata := range r.Metadata {
+		if metadata.Key == "HttpHost" {
+			return metadata.Val
+		}
+	}
+	if u, err := url.Parse(r.Dest); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// Header returns the HTTP headers of the request sent by the edge.
+func (r *ConnectRequest) Header() http.Header {
+	header := make(http.Header)
+	for _, metadata := range r.Metadata {
+		if key, ok := strings.CutPrefix(metadata.Key, "HttpHeader:"); ok {
+			header.Add(key, metadata.Val)
+		}
+	}
+	return header
+}
+
+// ForwardedSource returns the client address reported in Forward-Src, it is only signed on tunnels with
+// auth keys.
+func (r *ConnectRequest) ForwardedSource() string {
+	for _, metadata := range r.Metadata {
+		if metadata.Key == "HttpHeader:Forward-Src" {
+			return metadata.Val
+		}
+	}
+	return ""
+}
+
+// Source returns the original client address, the one reported by the client when signed is set and the
+// address seen by Cloudflare otherwise.
+func (r *ConnectRequest) Source(signed bool) string {
+	if source := r.ForwardedSource(); signed && source != "" {
+		return source
+	}
+	for _, metadata := range r.Metadata {
+		if metadata.Key == "HttpHeader:Cf-Connecting-Ip" {
+			return metadata.Val
+		}
+	}
+	return ""
+}
+
 type ConnectRequestProto struct{ capnp.Struct }
 
 func ReadRootConnectRequest(msg *capnp.Message) (ConnectRequestProto, error) {
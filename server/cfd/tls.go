@@ -132,10 +132,37 @@ func GetCloudflareRootCA() ([]*x509.Certificate, error) {
 	return certs, nil
 }
 
-func CreateTunnelConfig(serverName string) (*tls.Config, error) {
+const (
+	PostQuantumPrefer = "prefer"
+	PostQuantumStrict = "strict"
+	PostQuantumOff    = "off"
+
+	// FeaturePostQuantum tells the edge that only post-quantum key agreement is accepted.
+	FeaturePostQuantum = "postquantum"
+
+	// curveX25519MLKEM768 is the hybrid X25519 and ML-KEM-768 group, supported by Go 1.24 and later. The
+	// go 1.23 language version of this module disables ML-KEM by default, which would leave the prefer and
+	// strict post-quantum modes without it, so main.go and main_server.go turn it back on with
+	// //go:debug tlsmlkem=1.
+	curveX25519MLKEM768 tls.CurveID = 0x11ec
+)
+
+// curvePreferences returns the key agreement groups offered to the edge for a post-quantum mode.
+func curvePreferences(postQuantum string) []tls.CurveID {
+	switch postQuantum {
+	case PostQuantumOff:
+		return []tls.CurveID{tls.CurveP256}
+	case PostQuantumStrict:
+		return []tls.CurveID{curveX25519MLKEM768}
+	default:
+		return []tls.CurveID{curveX25519MLKEM768, tls.X25519, tls.CurveP256}
+	}
+}
+
+func CreateTunnelConfig(serverName, postQuantum string) (*tls.Config, error) {
 	var rootCAs []string
 
-	userConfig := &TLSParameters{RootCAs: rootCAs, ServerName: serverName}
+	userConfig := &TLSParameters{RootCAs: rootCAs, ServerName: serverName, CurvePreferences: curvePreferences(postQuantum)}
 
 	rootCAPool, err := x509.SystemCertPool()
 	if err != nil {
@@ -153,11 +180,14 @@ func CreateTunnelConfig(serverName string) (*tls.Config, error) {
 
 	tlsConfig := &tls.Config{
 		ServerName:       userConfig.ServerName,
-		CurvePreferences: []tls.CurveID{tls.CurveP256},
+		CurvePreferences: userConfig.CurvePreferences,
 		MinVersion:       userConfig.MinVersion,
 		MaxVersion:       userConfig.MaxVersion,
 		RootCAs:          rootCAPool,
 	}
+	if postQuantum == PostQuantumStrict {
+		tlsConfig.VerifyConnection = verifyPostQuantum
+	}
 
 	return tlsConfig, nil
 }
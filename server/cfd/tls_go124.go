@@ -0,0 +1,13 @@
+//go:build !go1.25
+
+package cfd
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// verifyPostQuantum cannot see the negotiated group before Go 1.25, so strict mode refuses to connect.
+func verifyPostQuantum(tls.ConnectionState) error {
+	return errors.New("post-quantum: strict requires building with Go 1.25 or later")
+}
@@ -0,0 +1,18 @@
+//go:build go1.25
+
+package cfd
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// verifyPostQuantum fails a handshake that did not agree on X25519MLKEM768. crypto/tls drops the group
+// when GODEBUG has tlsmlkem=0 and falls back to its default groups, so the offered groups alone do not
+// enforce it.
+func verifyPostQuantum(cs tls.ConnectionState) error {
+	if cs.CurveID != curveX25519MLKEM768 {
+		return fmt.Errorf("the edge negotiated %s instead of X25519MLKEM768", cs.CurveID)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+//go:build go1.25
+
+//go:debug tlsmlkem=1
+package cfd
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// edgeHandshake connects to a TLS server offering curves with the edge config of postQuantum.
+func edgeHandshake(t *testing.T, curves []tls.CurveID, postQuantum string) (tls.ConnectionState, error) {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.TLS = &tls.Config{CurvePreferences: curves}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	config, err := CreateTunnelConfig("example.com", postQuantum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.InsecureSkipVerify = true
+	conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), config)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+func TestPostQuantumStrict(t *testing.T) {
+	if _, err := edgeHandshake(t, []tls.CurveID{curveX25519MLKEM768}, PostQuantumStrict); err != nil {
+		t.Fatalf("strict handshake with an ML-KEM edge: %v", err)
+	}
+	if _, err := edgeHandshake(t, []tls.CurveID{tls.X25519}, PostQuantumStrict); err == nil {
+		t.Fatal("strict handshake succeeded without ML-KEM")
+	}
+	if _, err := edgeHandshake(t, []tls.CurveID{tls.X25519}, PostQuantumPrefer); err != nil {
+		t.Fatalf("prefer handshake with a classical edge: %v", err)
+	}
+}
+
+func TestVerifyPostQuantum(t *testing.T) {
+	if err := verifyPostQuantum(tls.ConnectionState{CurveID: tls.X25519}); err == nil {
+		t.Fatal("X25519 passed the strict check")
+	}
+	if err := verifyPostQuantum(tls.ConnectionState{CurveID: curveX25519MLKEM768}); err != nil {
+		t.Fatal(err)
+	}
+}
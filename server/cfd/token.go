@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/fmnx/cftun/uuid"
+	"os"
 )
 
 type TunnelToken struct {
@@ -47,6 +48,23 @@ func ParseToken(tokenStr string) (*TunnelToken, error) {
 	return &token, nil
 }
 
+// ParseCredentialsFile reads the credentials file written by `cloudflared tunnel create`.
+func ParseCredentialsFile(path string) (*Credentials, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials Credentials
+	if err := json.Unmarshal(content, &credentials); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+	if credentials.AccountTag == "" || len(credentials.TunnelSecret) == 0 || credentials.TunnelID == (uuid.UUID{}) {
+		return nil, fmt.Errorf("credentials file %s is missing AccountTag, TunnelSecret or TunnelID", path)
+	}
+	return &credentials, nil
+}
+
 func GenerateToken(token *TunnelToken) (string, error) {
 	if token == nil {
 		return "", fmt.Errorf("token cannot be nil")
@@ -0,0 +1,58 @@
+package cfd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCredentialsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			// cloudflared tunnel create 写入的格式。
+			name:    "cloudflared",
+			content: `{"AccountTag":"699d98642c564d2e855e9661899b7252","TunnelSecret":"c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0IQ==","TunnelID":"1f4ad7b8-4a55-4e5d-9a8b-1d1f3c7e6a21","Endpoint":""}`,
+		},
+		{name: "malformed", content: `{"AccountTag":`, err: "invalid credentials file"},
+		{name: "invalid secret", content: `{"AccountTag":"a","TunnelSecret":"not base64!","TunnelID":"1f4ad7b8-4a55-4e5d-9a8b-1d1f3c7e6a21"}`, err: "invalid credentials file"},
+		{name: "invalid tunnel id", content: `{"AccountTag":"a","TunnelSecret":"c2VjcmV0","TunnelID":"tunnel"}`, err: "invalid credentials file"},
+		{name: "missing account", content: `{"TunnelSecret":"c2VjcmV0","TunnelID":"1f4ad7b8-4a55-4e5d-9a8b-1d1f3c7e6a21"}`, err: "is missing"},
+		{name: "missing secret", content: `{"AccountTag":"a","TunnelID":"1f4ad7b8-4a55-4e5d-9a8b-1d1f3c7e6a21"}`, err: "is missing"},
+		{name: "missing tunnel id", content: `{"AccountTag":"a","TunnelSecret":"c2VjcmV0"}`, err: "is missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			credentials, err := ParseCredentialsFile(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credentials.AccountTag != "699d98642c564d2e855e9661899b7252" ||
+				!bytes.Equal(credentials.TunnelSecret, []byte("secret-secret-secret-secret!")) ||
+				credentials.TunnelID.String() != "1f4ad7b8-4a55-4e5d-9a8b-1d1f3c7e6a21" {
+				t.Fatalf("parsed %+v", credentials)
+			}
+		})
+	}
+}
+
+func TestParseCredentialsFileMissing(t *testing.T) {
+	if _, err := ParseCredentialsFile(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want a not-exist error", err)
+	}
+}
@@ -2,87 +2,254 @@ package cfd
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"github.com/fmnx/cftun/log"
 	"github.com/quic-go/quic-go"
 	"net"
 	"net/netip"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type EdgeTunnelServer struct {
-	Token        string
+	Credentials  *Credentials
 	HaConn       int
-	EdgeIPS      chan netip.AddrPort
+	Edge         *EdgePool
 	EdgeBindAddr net.IP
-	NsResult     []string
 	Proxy        *Proxy
 	ClientInfo   *ClientInfo
-	mu           sync.Mutex
+	// DatagramVersion selects the UDP session protocol, v2 or v3.
+	DatagramVersion string
+	// Protocol is auto, quic or http2.
+	Protocol string
+	// PostQuantum is prefer, strict or off.
+	PostQuantum string
+	mu          sync.Mutex
+
+	quicFailures map[int]int
+	// quicFallback is when each connection last fell back to http2.
+	quicFallback map[int]time.Time
+	status       map[int]*ConnectionStatus
+
+	shutdownOnce sync.Once
+	shutdown     chan struct{}
+	started      atomic.Bool
+	running      sync.WaitGroup
+}
+
+const (
+	ProtocolAuto  = "auto"
+	ProtocolQUIC  = "quic"
+	ProtocolHTTP2 = "http2"
+
+	// quicFallbackThreshold is the number of consecutive QUIC failures before auto switches to http2.
+	quicFallbackThreshold = 3
+	// quicRetryInterval is how long auto stays on http2 before reconnecting over QUIC again.
+	quicRetryInterval = 10 * time.Minute
+
+	ReconnectBase = 1 * time.Second
+	ReconnectMax  = 60 * time.Second
+
+	RPCTimeout  = 5 * time.Second
+	GracePeriod = 30 * time.Second
+)
+
+var errQUICUnavailable = errors.New("quic unavailable")
+
+// protocol returns the transport for the next attempt of connIndex.
+func (e *EdgeTunnelServer) protocol(connIndex int) string {
+	switch e.Protocol {
+	case ProtocolQUIC, ProtocolHTTP2:
+		return e.Protocol
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.quicFailures[connIndex] >= quicFallbackThreshold {
+		if time.Since(e.quicFallback[connIndex]) < quicRetryInterval {
+			return ProtocolHTTP2
+		}
+		// 回退一段时间后重新尝试 QUIC，再失败一次即回到 http2。
+		e.quicFailures[connIndex] = quicFallbackThreshold - 1
+		e.Proxy.Log.Infoln("Connection %d retrying QUIC after %s on http2", connIndex, quicRetryInterval)
+	}
+	return ProtocolQUIC
 }
 
-func (e *EdgeTunnelServer) getEdgeIP(index int) netip.AddrPort {
+// recordQUIC counts consecutive failures to reach the edge over QUIC.
+func (e *EdgeTunnelServer) recordQUIC(connIndex int, err error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
+	if e.quicFailures == nil {
+		e.quicFailures = make(map[int]int)
+		e.quicFallback = make(map[int]time.Time)
+	}
+	if !errors.Is(err, errQUICUnavailable) {
+		e.quicFailures[connIndex] = 0
+		return
+	}
+	e.quicFailures[connIndex]++
+	if e.Protocol != ProtocolQUIC && e.quicFailures[connIndex] == quicFallbackThreshold {
+		e.quicFallback[connIndex] = time.Now()
+		e.Proxy.Log.Warnln("Connection %d failed to reach the edge over QUIC %d times, falling back to http2 for %s",
+			connIndex, quicFallbackThreshold, quicRetryInterval)
+	}
+}
+
+// strictPostQuantumError points out that a failed handshake may be caused by post-quantum being enforced.
+func (e *EdgeTunnelServer) strictPostQuantumError(edgeAddr netip.AddrPort, err error) error {
+	if e.PostQuantum != PostQuantumStrict {
+		return err
+	}
+	return fmt.Errorf("post-quantum key agreement could not be negotiated with edge %s (post-quantum: strict): %w", edgeAddr, err)
+}
+
+func (e *EdgeTunnelServer) shutdownC() chan struct{} {
+	e.shutdownOnce.Do(func() {
+		e.shutdown = make(chan struct{})
+	})
+	return e.shutdown
+}
+
+// Start runs HaConn connections in the background.
+func (e *EdgeTunnelServer) Start() {
+	e.started.Store(true)
+	for i := 0; i < e.HaConn; i++ {
+		e.running.Add(1)
+		go func(connIndex int) {
+			defer e.running.Done()
+			e.Run(connIndex)
+		}(i)
+	}
+}
+
+// Running reports whether the connections were started and Shutdown has not been called yet.
+func (e *EdgeTunnelServer) Running() bool {
 	select {
-	case addrPort := <-e.EdgeIPS:
-		return addrPort
+	case <-e.shutdownC():
+		return false
 	default:
-		if len(e.NsResult) == 0 {
-			ips1, err := net.LookupHost("region1.v2.argotunnel.com")
-			if err == nil {
-				e.NsResult = ips1
-			}
+		return e.started.Load()
+	}
+}
 
-			ips2, err := net.LookupHost("region2.v2.argotunnel.com")
-			if err == nil {
-				e.NsResult = append(e.NsResult, ips2...)
-			}
+// Shutdown unregisters every connection and waits until their streams are drained,
+// at most GracePeriod plus the time to unregister.
+func (e *EdgeTunnelServer) Shutdown() {
+	shutdown := e.shutdownC()
+	e.mu.Lock()
+	select {
+	case <-shutdown:
+	default:
+		close(shutdown)
+	}
+	e.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.running.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(GracePeriod + RPCTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		e.Proxy.Log.Warnln("Timed out waiting for tunnel connections to shut down")
+	}
+}
+
+// Run keeps HA connection connIndex up until Shutdown, rotating edge addresses that fail before registering.
+func (e *EdgeTunnelServer) Run(connIndex int) {
+	shutdown := e.shutdownC()
+	backoff := &Backoff{Base: ReconnectBase, Max: ReconnectMax}
+	for {
+		select {
+		case <-shutdown:
+			return
+		default:
 		}
 
-		var addr string
-		if len(e.NsResult) > index {
-			ip := e.NsResult[index]
-			if strings.Contains(ip, ":") {
-				addr = fmt.Sprintf("[%s]:7844", ip)
-			} else {
-				addr = fmt.Sprintf("%s:7844", ip)
-			}
+		edgeAddr := e.Edge.Get(connIndex)
+		var registered atomic.Bool
+		err := e.Serve(connIndex, edgeAddr, func() {
+			registered.Store(true)
+			e.Edge.ReportSuccess(edgeAddr)
+		})
+		if err != nil {
+			e.Proxy.Log.Errorln(err.Error())
+		}
+		if registered.Load() {
+			backoff.Reset()
 		} else {
-			addr = fmt.Sprintf("198.41.192.%d:7844", index)
+			e.Edge.ReportFailure(connIndex, edgeAddr)
 		}
 
-		addrPort, _ := netip.ParseAddrPort(addr)
-		return addrPort
+		timer := time.NewTimer(backoff.Duration())
+		select {
+		case <-shutdown:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
 }
 
-func (e *EdgeTunnelServer) Serve(connIndex int) error {
+// Serve runs one connection to edgeAddr, onRegistered is called once the edge accepted it.
+func (e *EdgeTunnelServer) Serve(connIndex int, edgeAddr netip.AddrPort, onRegistered func()) (err error) {
 
 	ctx := context.Background()
 
-	rpcTimeout := 5 * time.Second
-	gracePeriod := 30 * time.Second
-	edgeAddr := e.getEdgeIP(connIndex)
-	tunnelToken, err := ParseToken(e.Token)
-	if err != nil {
-		return err
-	}
-
+	rpcTimeout := RPCTimeout
+	gracePeriod := GracePeriod
 	connOptions := &ConnectionOptions{
 		Client:          e.ClientInfo,
 		ReplaceExisting: true,
 	}
 
-	return e.serveQUIC(ctx,
+	metrics := e.Proxy.Metrics
+	protocol := e.protocol(connIndex)
+	var registered atomic.Bool
+	connRegistered := func(details *ConnectionDetails) {
+		registered.Store(true)
+		e.connectionUp(connIndex, protocol, edgeAddr, details)
+		metrics.connectionRegistered(uint8(connIndex), protocol, edgeAddr, details.Location)
+		if onRegistered != nil {
+			onRegistered()
+		}
+	}
+	metrics.registrationAttempted()
+	defer func() {
+		e.connectionDown(connIndex, err)
+		if registered.Load() {
+			metrics.connectionClosed(uint8(connIndex))
+		} else {
+			metrics.registrationFailed()
+		}
+	}()
+
+	if protocol == ProtocolHTTP2 {
+		return e.serveHTTP2(ctx,
+			edgeAddr,
+			connOptions,
+			e.Credentials,
+			rpcTimeout,
+			gracePeriod,
+			uint8(connIndex),
+			connRegistered)
+	}
+
+	err = e.serveQUIC(ctx,
 		edgeAddr,
 		connOptions,
-		tunnelToken.Credentials(),
+		e.Credentials,
 		rpcTimeout,
 		gracePeriod,
-		uint8(connIndex))
+		uint8(connIndex),
+		connRegistered)
+	e.recordQUIC(connIndex, err)
+	return err
 }
 
 func (e *EdgeTunnelServer) serveQUIC(
@@ -93,9 +260,10 @@ func (e *EdgeTunnelServer) serveQUIC(
 	rpcTimeout,
 	gracePeriod time.Duration,
 	connIndex uint8,
+	onRegistered func(*ConnectionDetails),
 ) (err error) {
 
-	tlsConfig, err := CreateTunnelConfig("quic.cftunnel.com")
+	tlsConfig, err := CreateTunnelConfig("quic.cftunnel.com", e.PostQuantum)
 	if err != nil {
 		return fmt.Errorf("unable to create TLS config to connect with edge: %s", err.Error())
 	}
@@ -125,8 +293,8 @@ func (e *EdgeTunnelServer) serveQUIC(
 		connIndex,
 	)
 	if err != nil {
-		log.Errorln("Failed to dial a quic connection")
-		return err
+		e.Proxy.Log.Errorln("Failed to dial a quic connection")
+		return fmt.Errorf("%w: %w", errQUICUnavailable, e.strictPostQuantumError(edgeAddr, err))
 	}
 
 	tunnelConn, err := NewTunnelConnection(
@@ -135,11 +303,78 @@ func (e *EdgeTunnelServer) serveQUIC(
 		rpcTimeout,
 		gracePeriod,
 		e.Proxy,
+		e.DatagramVersion,
 	)
 	if err != nil {
-		log.Errorln("Failed to create new tunnel connection")
+		e.Proxy.Log.Errorln("Failed to create new tunnel connection")
 		return err
 	}
+	tunnelConn.onRegistered = onRegistered
+	tunnelConn.shutdown = e.shutdownC()
+
+	return tunnelConn.Serve(ctx, credentials, connOptions)
+}
 
+func (e *EdgeTunnelServer) serveHTTP2(
+	ctx context.Context,
+	edgeAddr netip.AddrPort,
+	connOptions *ConnectionOptions,
+	credentials *Credentials,
+	rpcTimeout,
+	gracePeriod time.Duration,
+	connIndex uint8,
+	onRegistered func(*ConnectionDetails),
+) error {
+
+	tlsConfig, err := CreateTunnelConfig(HTTP2ServerName, e.PostQuantum)
+	if err != nil {
+		return fmt.Errorf("unable to create TLS config to connect with edge: %s", err.Error())
+	}
+
+	dialer := &net.Dialer{Timeout: HandshakeIdleTimeout}
+	if e.EdgeBindAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: e.EdgeBindAddr}
+	}
+	tcpConn, err := dialer.DialContext(ctx, "tcp", edgeAddr.String())
+	if err != nil {
+		e.Proxy.Log.Errorln("Failed to dial a http2 connection")
+		return err
+	}
+	conn := tls.Client(tcpConn, tlsConfig)
+	handshakeCtx, cancel := context.WithTimeout(ctx, HandshakeIdleTimeout)
+	err = conn.HandshakeContext(handshakeCtx)
+	cancel()
+	if err != nil {
+		_ = tcpConn.Close()
+		return fmt.Errorf("http2 TLS handshake with edge failed: %w", e.strictPostQuantumError(edgeAddr, err))
+	}
+
+	tunnelConn := NewHTTP2Connection(
+		conn,
+		connIndex,
+		rpcTimeout,
+		gracePeriod,
+		e.Proxy,
+	)
+	tunnelConn.onRegistered = onRegistered
+	tunnelConn.shutdown = e.shutdownC()
+	if e.Protocol != ProtocolHTTP2 {
+		// auto 回退到 http2 的连接在重试间隔后优雅关闭，重连时再次尝试 QUIC。
+		retry, done := make(chan struct{}), make(chan struct{})
+		defer close(done)
+		go func() {
+			timer := time.NewTimer(quicRetryInterval)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				e.Proxy.Log.Infoln("Connection %d closing http2 to retry QUIC", connIndex)
+			case <-e.shutdownC():
+			case <-done:
+				return
+			}
+			close(retry)
+		}()
+		tunnelConn.shutdown = retry
+	}
 	return tunnelConn.Serve(ctx, credentials, connOptions)
 }
@@ -0,0 +1,57 @@
+package cfd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProtocolFallsBackAndRetriesQUIC(t *testing.T) {
+	e := &EdgeTunnelServer{Protocol: ProtocolAuto, Proxy: &Proxy{}}
+	unavailable := fmt.Errorf("dial edge: %w", errQUICUnavailable)
+
+	for i := 0; i < quicFallbackThreshold; i++ {
+		if protocol := e.protocol(0); protocol != ProtocolQUIC {
+			t.Fatalf("attempt %d uses %s", i+1, protocol)
+		}
+		e.recordQUIC(0, unavailable)
+	}
+	if protocol := e.protocol(0); protocol != ProtocolHTTP2 {
+		t.Fatalf("after %d failures: %s, want http2", quicFallbackThreshold, protocol)
+	}
+	if protocol := e.protocol(1); protocol != ProtocolQUIC {
+		t.Fatalf("another connection uses %s", protocol)
+	}
+
+	// 回退期满后重试 QUIC，失败一次即再次回退。
+	e.quicFallback[0] = time.Now().Add(-quicRetryInterval)
+	if protocol := e.protocol(0); protocol != ProtocolQUIC {
+		t.Fatalf("after the retry interval: %s, want quic", protocol)
+	}
+	e.recordQUIC(0, unavailable)
+	if protocol := e.protocol(0); protocol != ProtocolHTTP2 {
+		t.Fatalf("after a failed retry: %s, want http2", protocol)
+	}
+
+	e.quicFallback[0] = time.Now().Add(-quicRetryInterval)
+	if protocol := e.protocol(0); protocol != ProtocolQUIC {
+		t.Fatalf("after the retry interval: %s, want quic", protocol)
+	}
+	e.recordQUIC(0, errors.New("connection closed"))
+	if protocol := e.protocol(0); protocol != ProtocolQUIC || e.quicFailures[0] != 0 {
+		t.Fatalf("after a working QUIC connection: %s with %d failures", protocol, e.quicFailures[0])
+	}
+}
+
+func TestProtocolPinned(t *testing.T) {
+	for _, pinned := range []string{ProtocolQUIC, ProtocolHTTP2} {
+		e := &EdgeTunnelServer{Protocol: pinned, Proxy: &Proxy{}}
+		for i := 0; i < 2*quicFallbackThreshold; i++ {
+			e.recordQUIC(0, errQUICUnavailable)
+		}
+		if protocol := e.protocol(0); protocol != pinned {
+			t.Fatalf("protocol %s uses %s", pinned, protocol)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package cfd
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"github.com/fmnx/cftun/server/cfd/wsutil"
@@ -22,6 +23,8 @@ type Conn struct {
 	rw        io.ReadWriter
 	writeLock sync.Mutex
 	done      bool
+	// readBuf holds the rest of a message that did not fit in the last Read.
+	readBuf bytes.Buffer
 }
 
 func NewConn(ctx context.Context, rw io.ReadWriter) *Conn {
@@ -87,11 +90,16 @@ func (c *Conn) Close() {
 
 // Read will read messages from the websocket connection
 func (c *Conn) Read(reader []byte) (int, error) {
+	if c.readBuf.Len() > 0 {
+		return c.readBuf.Read(reader)
+	}
 	data, err := wsutil.ReadClientBinary(c.rw)
 	if err != nil {
 		return 0, err
 	}
-	return copy(reader, data), nil
+	n := copy(reader, data)
+	c.readBuf.Write(data[n:])
+	return n, nil
 }
 
 // Write will write messages to the websocket connection.
@@ -0,0 +1,309 @@
+package cfd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/fmnx/cftun/auth"
+	"github.com/fmnx/cftun/client/tun/transport/argo"
+	"github.com/fmnx/cftun/e2e"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoOrigin returns the address of a TCP server echoing everything back.
+func echoOrigin(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// e2eServer stands in for the edge and the server: the upgrader ends the client's websocket like the edge,
+// which hands the server the message payloads as a plain stream, and handleConn relays it to origin,
+// encrypting it when server is set.
+func e2eServer(t *testing.T, server *e2e.Server, origin string) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var session *e2e.Session
+		header := http.Header{}
+		if server != nil {
+			var serverKey string
+			var err error
+			if session, serverKey, err = server.Accept(r.Header.Get(e2e.Header)); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			header.Set(e2e.ResponseHeader, serverKey)
+		}
+		remoteConn, err := net.Dial("tcp", origin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		edge, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			_ = remoteConn.Close()
+			return
+		}
+		defer edge.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		wsConn := NewConn(ctx, &argo.GorillaConn{Conn: edge})
+		var ws io.ReadWriter = wsConn
+		if session != nil {
+			ws = session.Wrap(wsConn)
+		}
+		(&Proxy{}).handleConn(ctx, cancel, wsConn, ws, remoteConn, "test", false)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// dialE2E connects like the client, returning the conn and the raw websocket under it.
+func dialE2E(t *testing.T, url string, serverKey *[32]byte) (net.Conn, *websocket.Conn) {
+	t.Helper()
+	header := http.Header{}
+	var handshake *e2e.ClientHandshake
+	if serverKey != nil {
+		var err error
+		if handshake, err = e2e.NewClientHandshake(serverKey); err != nil {
+			t.Fatal(err)
+		}
+		header.Set(e2e.Header, handshake.PublicKey())
+	}
+	wsConn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conn net.Conn = &argo.GorillaConn{Conn: wsConn}
+	if handshake != nil {
+		session, err := handshake.Finish(resp.Header.Get(e2e.ResponseHeader))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn = session.WrapConn(conn)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn, wsConn
+}
+
+func TestE2ERoundTrip(t *testing.T) {
+	priv := new([32]byte)
+	if _, err := rand.Read(priv[:]); err != nil {
+		t.Fatal(err)
+	}
+	server := e2e.NewServer(priv)
+	serverKey, err := e2e.ParseKey(server.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := e2eServer(t, server, echoOrigin(t))
+	conn, _ := dialE2E(t, ts.URL, serverKey)
+
+	// 较大的写入会拆成多条记录，每条记录是一条 websocket 消息。
+	for _, size := range []int{1, 1500, 64 << 10} {
+		msg := make([]byte, size)
+		_, _ = rand.Read(msg)
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("write %d bytes: %v", size, err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got := make([]byte, size)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("read %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("%d bytes came back different", size)
+		}
+	}
+}
+
+func TestE2EPayloadIsEncrypted(t *testing.T) {
+	priv := new([32]byte)
+	if _, err := rand.Read(priv[:]); err != nil {
+		t.Fatal(err)
+	}
+	server := e2e.NewServer(priv)
+	serverKey, _ := e2e.ParseKey(server.PublicKey())
+	ts := e2eServer(t, server, echoOrigin(t))
+	conn, wsConn := dialE2E(t, ts.URL, serverKey)
+
+	secret := []byte("plaintext that must not cross the edge")
+	if _, err := conn.Write(secret); err != nil {
+		t.Fatal(err)
+	}
+	// 直接读取 websocket 消息，看到的应当是密文。
+	_ = wsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := wsConn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(message, secret) {
+		t.Fatal("the echoed message is not encrypted")
+	}
+}
+
+func TestWebsocketRoundTripWithoutE2E(t *testing.T) {
+	ts := e2eServer(t, nil, echoOrigin(t))
+	conn, _ := dialE2E(t, ts.URL, nil)
+	msg := bytes.Repeat([]byte("cftun"), 20000)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload came back different")
+	}
+}
+
+// preDialServer is e2eServer for pre-dialed streams, the destination comes with the first packet and the
+// client reads the reply.
+func preDialServer(t *testing.T, proxy *Proxy) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		edge, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer edge.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		wsConn := NewConn(ctx, &argo.GorillaConn{Conn: edge})
+		proxy.handleConn(ctx, cancel, wsConn, wsConn, nil, "test", true)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// firstPacket prepends the destination header the client sends on a pre-dialed stream, followed by the
+// token when it is not empty.
+func firstPacket(t *testing.T, address, token string, payload []byte) []byte {
+	t.Helper()
+	addrPort := netip.MustParseAddrPort(address)
+	packet := []byte{4, TCP}
+	packet = append(packet, addrPort.Addr().AsSlice()...)
+	packet = binary.BigEndian.AppendUint16(packet, addrPort.Port())
+	if token != "" {
+		packet = append(append(packet, byte(len(token))), token...)
+	}
+	return append(packet, payload...)
+}
+
+func TestPreDialedReply(t *testing.T) {
+	origin := echoOrigin(t)
+	ts := preDialServer(t, &Proxy{})
+	conn, _ := dialE2E(t, ts.URL, nil)
+
+	if _, err := conn.Write(firstPacket(t, origin, "", []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := argo.ReadReply(conn); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestPreDialedSignedDestination(t *testing.T) {
+	origin := echoOrigin(t)
+	ts := preDialServer(t, &Proxy{Auth: auth.NewVerifier([]string{"key"})})
+	conn, _ := dialE2E(t, ts.URL, nil)
+
+	if _, err := conn.Write(firstPacket(t, origin, auth.Sign("key", "tcp", origin, ""), []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := argo.ReadReply(conn); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("the token leaked into the payload: %q", got)
+	}
+}
+
+func TestPreDialedRefusal(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().String()
+	_ = closed.Close()
+
+	origin := echoOrigin(t)
+	verifier := &Proxy{Auth: auth.NewVerifier([]string{"key"})}
+
+	tests := []struct {
+		name    string
+		proxy   *Proxy
+		address string
+		token   string
+		status  int
+		reason  string
+	}{
+		{"policy", &Proxy{Policy: &Policy{}}, origin, "", http.StatusForbidden, ReasonPolicyDenied},
+		{"refused", &Proxy{}, refused, "", http.StatusBadGateway, ReasonDialRefused},
+		{"unsigned", verifier, origin, "", http.StatusForbidden, ReasonAuthFailed},
+		{"other destination", verifier, origin, auth.Sign("key", "tcp", "127.0.0.1:1", ""), http.StatusForbidden, ReasonAuthFailed},
+		{"wrong key", verifier, origin, auth.Sign("other", "tcp", origin, ""), http.StatusForbidden, ReasonAuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := preDialServer(t, tt.proxy)
+			conn, _ := dialE2E(t, ts.URL, nil)
+			if _, err := conn.Write(firstPacket(t, tt.address, tt.token, []byte("hello"))); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var streamErr *argo.StreamError
+			if err := argo.ReadReply(conn); !errors.As(err, &streamErr) {
+				t.Fatalf("expected a StreamError, got %v", err)
+			}
+			if streamErr.Status != tt.status || streamErr.Reason != tt.reason {
+				t.Fatalf("got %d %s, want %d %s", streamErr.Status, streamErr.Reason, tt.status, tt.reason)
+			}
+		})
+	}
+}
@@ -1,14 +1,19 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/fmnx/cftun/auth"
+	"github.com/fmnx/cftun/e2e"
 	"github.com/fmnx/cftun/log"
 	"github.com/fmnx/cftun/server/cfd"
 	"github.com/fmnx/cftun/uuid"
 	"net"
 	"net/netip"
 	"runtime"
-	"time"
+	"strings"
+	"sync"
 )
 
 type BuildInfo struct {
@@ -34,14 +39,130 @@ func (bi *BuildInfo) UserAgent() string {
 }
 
 type Config struct {
-	EdgeIPs     []string `yaml:"edge-ips" json:"edge-ips"`
-	Token       string   `yaml:"token" json:"token"`
-	HaConn      int      `yaml:"ha-conn" json:"ha-conn"`
-	BindAddress string   `yaml:"bind-address" json:"bind-address"`
-	Warp        *Warp    `yaml:"warp" json:"warp"`
+	EdgeIPs            []string            `yaml:"edge-ips" json:"edge-ips"`
+	Token              string              `yaml:"token" json:"token"`
+	CredentialsFile    string              `yaml:"credentials-file" json:"credentials-file"`
+	HaConn             int                 `yaml:"ha-conn" json:"ha-conn"`
+	BindAddress        string              `yaml:"bind-address" json:"bind-address"`
+	Warp               *Warp               `yaml:"warp" json:"warp"`
+	ProxyProtocol      string              `yaml:"proxy-protocol" json:"proxy-protocol"`
+	ProxyProtocolDests []string            `yaml:"proxy-protocol-dests" json:"proxy-protocol-dests"`
+	Policy             *Policy             `yaml:"policy" json:"policy"`
+	AuthKeys           []string            `yaml:"auth-keys" json:"auth-keys"`
+	E2EKey             string              `yaml:"e2e-key" json:"e2e-key"`
+	Services           map[string]*Service `yaml:"services" json:"services"`
+	DefaultService     string              `yaml:"default-service" json:"default-service"`
+	Ingress            []*IngressRule      `yaml:"ingress" json:"ingress"`
+	RemoteConfig       bool                `yaml:"remote-config" json:"remote-config"`
+	DatagramVersion    string              `yaml:"datagram-version" json:"datagram-version"`
+	Protocol           string              `yaml:"protocol" json:"protocol"`
+	EdgeIPVersion      string              `yaml:"edge-ip-version" json:"edge-ip-version"`
+	Region             string              `yaml:"region" json:"region"`
+	PostQuantum        string              `yaml:"post-quantum" json:"post-quantum"`
+	MetricsAddress     string              `yaml:"metrics-address" json:"metrics-address"`
+	EgressProxy        []string            `yaml:"egress-proxy" json:"egress-proxy"`
+	EgressRules        []*EgressRule       `yaml:"egress-rules" json:"egress-rules"`
+	DNS                *DNS                `yaml:"dns" json:"dns"`
+	WireGuard          []*WireGuard        `yaml:"wireguard" json:"wireguard"`
+	Name               string              `yaml:"name" json:"name"`
+	Tunnels            []*Config           `yaml:"tunnels" json:"tunnels"`
+
+	mu      sync.Mutex
+	stopped bool
+	tunnels []*tunnel
+}
+
+// tunnel is one running tunnel of the server.
+type tunnel struct {
+	name        string
+	connectorID string
+	metrics     *cfd.Metrics
+	edge        supervisor
+	// cancel stops the background work of the tunnel, such as the WARP health monitor.
+	cancel context.CancelFunc
+}
+
+// supervisor keeps the HA connections of a tunnel up, implemented by *cfd.EdgeTunnelServer.
+type supervisor interface {
+	Start()
+	Shutdown()
+	Running() bool
+	ReadyConnections() int
+	Status() []cfd.ConnectionStatus
 }
 
+// Run starts the tunnel of the config, or every entry of tunnels when it is set.
 func (server *Config) Run(info *BuildInfo, quickData *QuickData) {
+	if len(server.Tunnels) > 0 && (server.Token != "" || server.CredentialsFile != "") {
+		log.Warnln("Ignoring the top-level token and credentials-file, tunnels is set")
+	}
+	configs, err := server.tunnelConfigs()
+	if err != nil {
+		log.Fatalln("Invalid tunnels: %v", err)
+	}
+
+	var tunnels []*tunnel
+	for _, c := range configs {
+		tunnels = append(tunnels, c.newTunnel(info, quickData, server.MetricsAddress != ""))
+	}
+	if server.MetricsAddress != "" {
+		serveMetrics(server.MetricsAddress, tunnels)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.stopped {
+		return
+	}
+	server.tunnels = tunnels
+	for _, t := range tunnels {
+		t.edge.Start()
+	}
+}
+
+// tunnelConfigs validates and returns the configs to run, the entries of tunnels when set. A named tunnel keeps
+// its automatic WARP accounts in .warp-<name>.json.
+func (server *Config) tunnelConfigs() ([]*Config, error) {
+	configs := []*Config{server}
+	if len(server.Tunnels) > 0 {
+		configs = server.Tunnels
+		names := make(map[string]bool)
+		ports := make(map[uint16]string)
+		for _, c := range configs {
+			switch {
+			case c.Name == "":
+				return nil, errors.New("every entry of tunnels requires a name")
+			case strings.ContainsAny(c.Name, `/\`):
+				return nil, fmt.Errorf("tunnel %s: the name cannot contain a path separator", c.Name)
+			case names[c.Name]:
+				return nil, fmt.Errorf("duplicate tunnel name: %s", c.Name)
+			case c.Token == "quick":
+				return nil, fmt.Errorf("tunnel %s: quick tunnels cannot be listed in tunnels", c.Name)
+			case len(c.Tunnels) > 0:
+				return nil, fmt.Errorf("tunnel %s: tunnels cannot be nested", c.Name)
+			}
+			names[c.Name] = true
+			if c.Warp == nil || c.Warp.Port == 0 {
+				continue
+			}
+			if other, ok := ports[c.Warp.Port]; ok {
+				return nil, fmt.Errorf("tunnel %s: WARP port %d is already used by tunnel %s", c.Name, c.Warp.Port, other)
+			}
+			ports[c.Warp.Port] = c.Name
+		}
+	}
+	for _, c := range configs {
+		if c.Warp != nil && c.Name != "" {
+			c.Warp.file = ".warp-" + c.Name + ".json"
+		}
+	}
+	return configs, nil
+}
+
+// newTunnel validates the settings of one tunnel and builds its EdgeTunnelServer.
+func (server *Config) newTunnel(info *BuildInfo, quickData *QuickData, withMetrics bool) *tunnel {
+	logger := log.WithPrefix(server.Name)
+	ctx, cancel := context.WithCancel(context.Background())
 	if server.HaConn == 0 {
 		server.HaConn = 4
 	}
@@ -50,57 +171,233 @@ func (server *Config) Run(info *BuildInfo, quickData *QuickData) {
 		if err := quickData.Load(); err != nil {
 			quickData.Token, quickData.QuickURL, err = ApplyQuickURL(info)
 			if err != nil {
-				log.Fatalln(err.Error())
+				logger.Fatalln(err.Error())
 			}
 		}
 		server.Token = quickData.Token
-		log.Infoln("\033[36mTHE TEMPORARY DOMAIN YOU HAVE APPLIED FOR IS: \033[0m%s", quickData.QuickURL)
+		logger.Infoln("\033[36mTHE TEMPORARY DOMAIN YOU HAVE APPLIED FOR IS: \033[0m%s", quickData.QuickURL)
+	}
+
+	switch server.ProxyProtocol {
+	case "", cfd.ProxyProtocolV1, cfd.ProxyProtocolV2:
+	default:
+		logger.Fatalln("Unsupported proxy-protocol version: %s", server.ProxyProtocol)
+	}
+
+	switch server.DatagramVersion {
+	case "", cfd.DatagramV2, cfd.DatagramV3:
+	default:
+		logger.Fatalln("Unsupported datagram-version: %s", server.DatagramVersion)
+	}
+
+	switch server.Protocol {
+	case "", cfd.ProtocolAuto, cfd.ProtocolQUIC, cfd.ProtocolHTTP2:
+	default:
+		logger.Fatalln("Unsupported protocol: %s", server.Protocol)
+	}
+
+	features := cfd.Features(server.DatagramVersion, server.RemoteConfig)
+	switch server.PostQuantum {
+	case "", cfd.PostQuantumPrefer, cfd.PostQuantumOff:
+	case cfd.PostQuantumStrict:
+		logger.Infoln("Post-quantum key agreement is enforced for edge connections")
+		features = append(features, cfd.FeaturePostQuantum)
+	default:
+		logger.Fatalln("Unsupported post-quantum mode: %s", server.PostQuantum)
+	}
+
+	switch server.EdgeIPVersion {
+	case "", cfd.EdgeIPVersionAuto, cfd.EdgeIPVersion4, cfd.EdgeIPVersion6:
+	default:
+		logger.Fatalln("Unsupported edge-ip-version: %s", server.EdgeIPVersion)
+	}
+
+	policy, err := server.Policy.build()
+	if err != nil {
+		logger.Fatalln("Invalid policy: %v", err)
+	}
+
+	services, err := buildServices(server.Services, server.DefaultService, logger)
+	if err != nil {
+		logger.Fatalln("Invalid services: %v", err)
+	}
+
+	ingress, err := buildIngress(server.Ingress)
+	if err != nil {
+		logger.Fatalln("Invalid ingress: %v", err)
 	}
 
-	dialFunc := net.Dial
+	var e2eServer *e2e.Server
+	if server.E2EKey != "" {
+		privateKey, err := e2e.ParseKey(server.E2EKey)
+		if err != nil {
+			logger.Fatalln("Invalid e2e-key: %v", err)
+		}
+		e2eServer = e2e.NewServer(privateKey)
+		logger.Infoln("End-to-end encryption enabled, server public key: %s", e2eServer.PublicKey())
+	}
+
+	var shared outbounds
 	var proxy4, proxy6 bool
-	if server.Warp != nil && (server.Warp.Proxy4 || server.Warp.Proxy6) {
-		dialFunc = server.Warp.Run()
+	if server.usesWarp() {
+		server.Warp.logger = logger
+		warpDial, err := server.Warp.Run(ctx)
+		if err != nil {
+			logger.Fatalln("Failed to start warp: %v", err)
+		}
+		shared.warp = &cfd.Outbound{Name: OutboundWarp, Dial: warpDial, Resolve: true}
 		proxy4, proxy6 = server.Warp.Proxy4, server.Warp.Proxy6
 	}
 
+	for _, wg := range server.WireGuard {
+		if wg.Name == "" && len(server.WireGuard) > 1 {
+			logger.Fatalln("Invalid wireguard: name is required with several interfaces")
+		}
+		if _, ok := shared.wireguard[wg.Name]; ok {
+			logger.Fatalln("Invalid wireguard: duplicate name %q", wg.Name)
+		}
+		outbound, err := wg.Run(ctx)
+		if err != nil {
+			logger.Fatalln("Failed to start wireguard %s: %v", wg.Name, err)
+		}
+		if shared.wireguard == nil {
+			shared.wireguard = make(map[string]*cfd.Outbound)
+		}
+		shared.wireguard[wg.Name] = outbound
+		logger.Infoln("WireGuard interface %s is up", wg.Name)
+	}
+
+	if len(server.EgressProxy) > 0 {
+		if shared.proxy, err = proxyOutbound(server.EgressProxy); err != nil {
+			logger.Fatalln("Invalid egress-proxy: %v", err)
+		}
+		logger.Infoln("Egress connections go through %d proxies", len(server.EgressProxy))
+	}
+
+	egressRoutes, err := buildEgress(server.EgressRules, shared, proxy4, proxy6)
+	if err != nil {
+		logger.Fatalln("Invalid egress-rules: %v", err)
+	}
+
+	dnsResolver, err := server.DNS.build(shared.warp)
+	if err != nil {
+		logger.Fatalln("Invalid dns: %v", err)
+	}
+	if dnsResolver != nil {
+		egressRoutes.Resolver = dnsResolver
+		policy.Resolver = dnsResolver
+	}
+
+	if shared.warp != nil {
+		if err = server.Warp.LocalProxy.serve(shared.warp, egressRoutes.Resolver, policy, logger); err != nil {
+			logger.Fatalln("Failed to start the warp local-proxy: %v", err)
+		}
+	}
+	for _, wg := range server.WireGuard {
+		if err = wg.LocalProxy.serve(shared.wireguard[wg.Name], egressRoutes.Resolver, policy, logger); err != nil {
+			logger.Fatalln("Failed to start the local-proxy of wireguard %s: %v", wg.Name, err)
+		}
+	}
+
+	credentials, err := server.credentials()
+	if err != nil {
+		logger.Fatalln(err.Error())
+	}
+
 	clientID, _ := uuid.NewRandom()
-	var edgeIPS chan netip.AddrPort
-	if len(server.EdgeIPs) > 0 {
-		edgeIPS = make(chan netip.AddrPort, len(server.EdgeIPs))
-		for _, addr := range server.EdgeIPs {
-			edgeAddr, err := netip.ParseAddrPort(addr)
-			if err == nil {
-				edgeIPS <- edgeAddr
-			}
+	var edgeIPs []netip.AddrPort
+	for _, addr := range server.EdgeIPs {
+		edgeAddr, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			logger.Warnln("Ignoring invalid edge IP %s: %v", addr, err)
+			continue
 		}
+		edgeIPs = append(edgeIPs, edgeAddr)
 	}
 
-	edgeTunnel := cfd.EdgeTunnelServer{
-		Token:        server.Token,
-		HaConn:       server.HaConn,
-		EdgeIPS:      edgeIPS,
-		EdgeBindAddr: net.ParseIP(server.BindAddress),
+	var metrics *cfd.Metrics
+	if withMetrics {
+		metrics = cfd.NewMetrics()
+		metrics.Tunnel = server.Name
+		if shared.warp != nil {
+			metrics.Warp = server.Warp.State
+		}
+	}
+
+	edgePool := cfd.NewEdgePool(edgeIPs, server.Region, server.EdgeIPVersion)
+	edgePool.Log = logger
+	edgeTunnel := &cfd.EdgeTunnelServer{
+		Credentials:     credentials,
+		HaConn:          server.HaConn,
+		Edge:            edgePool,
+		EdgeBindAddr:    net.ParseIP(server.BindAddress),
+		DatagramVersion: server.DatagramVersion,
+		Protocol:        server.Protocol,
+		PostQuantum:     server.PostQuantum,
 		Proxy: &cfd.Proxy{
-			DialFunc: dialFunc,
-			Proxy4:   proxy4,
-			Proxy6:   proxy6,
+			Egress:             egressRoutes,
+			ProxyProtocol:      server.ProxyProtocol,
+			ProxyProtocolDests: server.ProxyProtocolDests,
+			Policy:             policy,
+			Auth:               auth.NewVerifier(server.AuthKeys),
+			E2E:                e2eServer,
+			Services:           services,
+			Metrics:            metrics,
+			RemoteConfig:       server.RemoteConfig,
+			Log:                logger,
 		},
 		ClientInfo: &cfd.ClientInfo{
 			ClientID: clientID[:],
+			Features: features,
 			Version:  info.CloudflaredVersion,
 			Arch:     info.GoArch,
 		},
 	}
-	for i := 0; i < server.HaConn; i++ {
-		connIndex := i
-		go func() {
-			for {
-				if err := edgeTunnel.Serve(connIndex); err != nil {
-					log.Errorln(err.Error())
-				}
-				time.Sleep(3 * time.Second)
-			}
-		}()
+	edgeTunnel.Proxy.SetIngress(ingress)
+	services.StartHealthChecks(ctx, edgeTunnel.Proxy)
+
+	return &tunnel{
+		name:        server.Name,
+		connectorID: clientID.String(),
+		metrics:     metrics,
+		edge:        edgeTunnel,
+		cancel:      cancel,
+	}
+}
+
+// credentials come from the token, or from the credentials file when no token is set.
+func (server *Config) credentials() (*cfd.Credentials, error) {
+	if server.Token == "" {
+		if server.CredentialsFile == "" {
+			return nil, fmt.Errorf("either token or credentials-file is required")
+		}
+		return cfd.ParseCredentialsFile(server.CredentialsFile)
+	}
+	token, err := cfd.ParseToken(server.Token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	return token.Credentials(), nil
+}
+
+// Shutdown unregisters the tunnel connections and waits for their streams to finish.
+func (server *Config) Shutdown() {
+	server.mu.Lock()
+	server.stopped = true
+	tunnels := server.tunnels
+	server.mu.Unlock()
+	if len(tunnels) == 0 {
+		return
+	}
+	log.Infoln("Shutting down, draining tunnel connections for up to %s", cfd.GracePeriod)
+	var wg sync.WaitGroup
+	for _, t := range tunnels {
+		wg.Add(1)
+		go func(t *tunnel) {
+			defer wg.Done()
+			t.edge.Shutdown()
+			t.cancel()
+		}(t)
 	}
+	wg.Wait()
 }
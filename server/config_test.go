@@ -0,0 +1,98 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTunnelConfigs(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    *Config
+		err       string
+		names     []string
+		warpFiles []string
+	}{
+		{
+			name:   "single",
+			config: &Config{Token: "token", Warp: &Warp{}},
+			names:  []string{""},
+			// 单隧道未命名时使用默认的状态文件。
+			warpFiles: []string{".warp.json"},
+		},
+		{
+			name:      "single named",
+			config:    &Config{Name: "a", Warp: &Warp{}},
+			names:     []string{"a"},
+			warpFiles: []string{".warp-a.json"},
+		},
+		{
+			name: "tunnels",
+			config: &Config{Tunnels: []*Config{
+				{Name: "a", Token: "a", Warp: &Warp{Port: 1001}},
+				{Name: "b", Token: "b", Warp: &Warp{}},
+				{Name: "c", Token: "c", Warp: &Warp{}},
+			}},
+			names:     []string{"a", "b", "c"},
+			warpFiles: []string{".warp-a.json", ".warp-b.json", ".warp-c.json"},
+		},
+		{
+			name:   "empty name",
+			config: &Config{Tunnels: []*Config{{Name: "a"}, {Token: "b"}}},
+			err:    "requires a name",
+		},
+		{
+			name:   "path in name",
+			config: &Config{Tunnels: []*Config{{Name: "../a"}}},
+			err:    "path separator",
+		},
+		{
+			name:   "duplicate name",
+			config: &Config{Tunnels: []*Config{{Name: "a"}, {Name: "a"}}},
+			err:    "duplicate tunnel name: a",
+		},
+		{
+			name:   "quick tunnel",
+			config: &Config{Tunnels: []*Config{{Name: "a", Token: "quick"}}},
+			err:    "quick tunnels",
+		},
+		{
+			name:   "nested",
+			config: &Config{Tunnels: []*Config{{Name: "a", Tunnels: []*Config{{Name: "b"}}}}},
+			err:    "cannot be nested",
+		},
+		{
+			name: "shared warp port",
+			config: &Config{Tunnels: []*Config{
+				{Name: "a", Warp: &Warp{Port: 1001}},
+				{Name: "b", Warp: &Warp{Port: 1001}},
+			}},
+			err: "already used by tunnel a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs, err := tt.config.tunnelConfigs()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(configs) != len(tt.names) {
+				t.Fatalf("got %d configs, want %d", len(configs), len(tt.names))
+			}
+			for i, c := range configs {
+				if c.Name != tt.names[i] {
+					t.Errorf("config %d is %q, want %q", i, c.Name, tt.names[i])
+				}
+				if file := c.Warp.stateFile(); file != tt.warpFiles[i] {
+					t.Errorf("tunnel %q stores WARP in %s, want %s", c.Name, file, tt.warpFiles[i])
+				}
+			}
+		})
+	}
+}
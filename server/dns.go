@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/server/cfd"
+	"github.com/fmnx/cftun/server/resolver"
+	"net/netip"
+	"strings"
+)
+
+// defaultWarpDNSUpstream answers the queries going through WARP when no upstream is configured.
+const defaultWarpDNSUpstream = "https://1.1.1.1/dns-query"
+
+type DNS struct {
+	Upstreams    []string            `yaml:"upstreams" json:"upstreams"`
+	Via          string              `yaml:"via" json:"via"`
+	Hosts        map[string][]string `yaml:"hosts" json:"hosts"`
+	Prefer       string              `yaml:"prefer" json:"prefer"`
+	DisableCache bool                `yaml:"disable-cache" json:"disable-cache"`
+}
+
+func (d *DNS) viaWarp() bool {
+	return d != nil && strings.ToLower(d.Via) == OutboundWarp
+}
+
+// build creates the resolver of the egress dialers, nil when no dns is configured.
+func (d *DNS) build(warp *cfd.Outbound) (*resolver.Resolver, error) {
+	if d == nil {
+		return nil, nil
+	}
+
+	var dial resolver.DialFunc
+	switch strings.ToLower(d.Via) {
+	case "", OutboundDirect:
+	case OutboundWarp:
+		if warp == nil {
+			return nil, errors.New("dns goes through warp but warp is not configured")
+		}
+		dial = resolver.DialFunc(warp.Dial)
+	default:
+		return nil, fmt.Errorf("invalid dns via: %q", d.Via)
+	}
+
+	r := &resolver.Resolver{CacheSize: resolver.DefaultCacheSize}
+	if d.DisableCache {
+		r.CacheSize = 0
+	}
+	switch prefer := strings.ToLower(d.Prefer); prefer {
+	case "", resolver.PreferIPv4, resolver.PreferIPv6:
+		r.Prefer = prefer
+	default:
+		return nil, fmt.Errorf("invalid dns prefer: %q", d.Prefer)
+	}
+
+	upstreams := d.Upstreams
+	if len(upstreams) == 0 && dial != nil {
+		// 默认的 system 不经过 WARP，改用经 WARP 的 DoH。
+		upstreams = []string{defaultWarpDNSUpstream}
+	}
+	for _, raw := range upstreams {
+		upstream, err := resolver.ParseUpstream(raw, dial)
+		if err != nil {
+			return nil, err
+		}
+		if upstream == resolver.System && dial != nil {
+			return nil, errors.New("the system dns upstream cannot go through warp")
+		}
+		r.Upstreams = append(r.Upstreams, upstream)
+	}
+
+	for name, addrs := range d.Hosts {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, s := range addrs {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dns hosts address for %s: %q", name, s)
+			}
+			if r.Hosts == nil {
+				r.Hosts = make(map[string][]netip.Addr)
+			}
+			r.Hosts[name] = append(r.Hosts[name], addr.Unmap())
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"github.com/fmnx/cftun/server/cfd"
+	"testing"
+)
+
+func TestDNSViaWarpDefaultsToDoH(t *testing.T) {
+	r, err := (&DNS{Via: OutboundWarp}).build(cfd.DirectOutbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Upstreams) != 1 || r.Upstreams[0].String() != defaultWarpDNSUpstream {
+		t.Fatalf("upstreams %v, want %s", r.Upstreams, defaultWarpDNSUpstream)
+	}
+	for _, upstreams := range [][]string{{"system"}, {"tls://one.one.one.one"}} {
+		if _, err = (&DNS{Via: OutboundWarp, Upstreams: upstreams}).build(cfd.DirectOutbound); err == nil {
+			t.Errorf("%v went through warp", upstreams)
+		}
+	}
+}
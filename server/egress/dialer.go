@@ -0,0 +1,105 @@
+package egress
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	SchemeSOCKS5 = "socks5"
+	SchemeHTTP   = "http"
+
+	// handshakeTimeout bounds the negotiation with every hop of the chain.
+	handshakeTimeout = 10 * time.Second
+)
+
+var ErrUDPUnsupported = errors.New("udp requires an egress proxy chain of a single socks5 proxy")
+
+// Hop is one proxy of the chain.
+type Hop struct {
+	Scheme   string
+	Address  string
+	Username string
+	Password string
+}
+
+// ParseHop parses socks5://[user:pass@]host:port or http://[user:pass@]host:port.
+func ParseHop(rawURL string) (Hop, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Hop{}, err
+	}
+	if u.Scheme != SchemeSOCKS5 && u.Scheme != SchemeHTTP {
+		return Hop{}, fmt.Errorf("unsupported egress proxy scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		return Hop{}, fmt.Errorf("egress proxy %s has no port", u.Redacted())
+	}
+	hop := Hop{Scheme: u.Scheme, Address: u.Host}
+	if u.User != nil {
+		hop.Username = u.User.Username()
+		hop.Password, _ = u.User.Password()
+	}
+	return hop, nil
+}
+
+// Dialer connects through a chain of proxies, each hop is reached through the previous ones.
+type Dialer struct {
+	hops []Hop
+	// Forward dials the first hop, nil uses net.Dial.
+	Forward func(network, address string) (net.Conn, error)
+}
+
+func NewDialer(hops []Hop) (*Dialer, error) {
+	if len(hops) == 0 {
+		return nil, errors.New("empty egress proxy chain")
+	}
+	return &Dialer{hops: hops}, nil
+}
+
+func (d *Dialer) forward(network, address string) (net.Conn, error) {
+	if d.Forward != nil {
+		return d.Forward(network, address)
+	}
+	return net.Dial(network, address)
+}
+
+// Dial connects to address through the chain, udp is relayed with SOCKS5 UDP ASSOCIATE.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		if len(d.hops) != 1 || d.hops[0].Scheme != SchemeSOCKS5 {
+			return nil, ErrUDPUnsupported
+		}
+		return d.dialUDP(d.hops[0], address)
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+
+	conn, err := d.forward("tcp", d.hops[0].Address)
+	if err != nil {
+		return nil, fmt.Errorf("egress proxy %s: %w", d.hops[0].Address, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	for i, hop := range d.hops {
+		target := address
+		if i+1 < len(d.hops) {
+			target = d.hops[i+1].Address
+		}
+		if hop.Scheme == SchemeSOCKS5 {
+			_, err = socksConnect(conn, hop, socksCmdConnect, target)
+		} else {
+			conn, err = httpConnect(conn, hop, target)
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("egress proxy %s: %w", hop.Address, err)
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
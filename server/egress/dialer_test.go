@@ -0,0 +1,283 @@
+package egress
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listen serves handle on a loopback listener and returns its address.
+func listen(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func echoTCP(t *testing.T) string {
+	return listen(t, func(c net.Conn) {
+		_, _ = io.Copy(c, c)
+		_ = c.Close()
+	})
+}
+
+func echoUDP(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// stubProxy runs a Server recording the addresses it is asked to connect to.
+type stubProxy struct {
+	Server
+	mu     sync.Mutex
+	dialed []string
+}
+
+func newStubProxy(t *testing.T, username, password string) (*stubProxy, string) {
+	t.Helper()
+	p := &stubProxy{}
+	p.Username, p.Password = username, password
+	p.Dial = func(network, address string) (net.Conn, error) {
+		p.mu.Lock()
+		p.dialed = append(p.dialed, address)
+		p.mu.Unlock()
+		return net.Dial(network, address)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() { _ = p.Serve(l) }()
+	return p, l.Addr().String()
+}
+
+func (p *stubProxy) targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.dialed...)
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != msg {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
+
+func TestDialAuthentication(t *testing.T) {
+	echo := echoTCP(t)
+	for _, scheme := range []string{SchemeSOCKS5, SchemeHTTP} {
+		_, addr := newStubProxy(t, "user", "secret")
+		tests := []struct {
+			name     string
+			username string
+			password string
+			ok       bool
+		}{
+			{"valid", "user", "secret", true},
+			{"wrong password", "user", "wrong", false},
+			{"no credentials", "", "", false},
+		}
+		for _, tt := range tests {
+			t.Run(scheme+" "+tt.name, func(t *testing.T) {
+				d, _ := NewDialer([]Hop{{Scheme: scheme, Address: addr, Username: tt.username, Password: tt.password}})
+				conn, err := d.Dial("tcp", echo)
+				if !tt.ok {
+					if err == nil {
+						_ = conn.Close()
+						t.Fatal("dialed with bad credentials")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				roundTrip(t, conn, "hello")
+			})
+		}
+	}
+}
+
+func TestSocksReplyCodes(t *testing.T) {
+	for code, reason := range map[byte]string{1: socksReplies[1], 2: socksReplies[2], 5: socksReplies[5], 8: socksReplies[8], 0x42: "code 66"} {
+		addr := listen(t, func(c net.Conn) {
+			defer c.Close()
+			greeting := make([]byte, 3)
+			if _, err := io.ReadFull(c, greeting); err != nil {
+				return
+			}
+			_, _ = c.Write([]byte{socksVersion, socksAuthNone})
+			if _, err := readSocksRequest(c); err != nil {
+				return
+			}
+			_ = socksReply(c, code, "0.0.0.0:0")
+		})
+		d, _ := NewDialer([]Hop{{Scheme: SchemeSOCKS5, Address: addr}})
+		_, err := d.Dial("tcp", "example.com:443")
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("reply %d: got %v, want %q", code, err, reason)
+		}
+	}
+}
+
+// readSocksRequest reads the request after the method negotiation and returns its address.
+func readSocksRequest(r io.Reader) (string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	return readSocksAddr(r)
+}
+
+func TestDialChain(t *testing.T) {
+	echo := echoTCP(t)
+	first, firstAddr := newStubProxy(t, "a", "1")
+	second, secondAddr := newStubProxy(t, "b", "2")
+	d, err := NewDialer([]Hop{
+		{Scheme: SchemeSOCKS5, Address: firstAddr, Username: "a", Password: "1"},
+		{Scheme: SchemeHTTP, Address: secondAddr, Username: "b", Password: "2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, strings.Repeat("chain", 1000))
+
+	// 每一跳只连接下一跳。
+	if got := first.targets(); len(got) != 1 || got[0] != secondAddr {
+		t.Fatalf("the first hop dialed %v, want %s", got, secondAddr)
+	}
+	if got := second.targets(); len(got) != 1 || got[0] != echo {
+		t.Fatalf("the second hop dialed %v, want %s", got, echo)
+	}
+}
+
+func TestDialUDP(t *testing.T) {
+	echo := echoUDP(t)
+	_, addr := newStubProxy(t, "user", "secret")
+	d, _ := NewDialer([]Hop{{Scheme: SchemeSOCKS5, Address: addr, Username: "user", Password: "secret"}})
+	conn, err := d.Dial("udp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != echo {
+		t.Fatalf("remote address %s, want %s", conn.RemoteAddr(), echo)
+	}
+	for _, msg := range []string{"one", "two"} {
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("got %q, want %q", buf[:n], msg)
+		}
+	}
+
+	chained, _ := NewDialer([]Hop{{Scheme: SchemeSOCKS5, Address: addr}, {Scheme: SchemeSOCKS5, Address: addr}})
+	if _, err = chained.Dial("udp", echo); err != ErrUDPUnsupported {
+		t.Fatalf("udp through a chain: %v", err)
+	}
+}
+
+func TestSocksUDPHeader(t *testing.T) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	conn, err := net.Dial("udp", relay.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, peer := net.Pipe()
+	defer peer.Close()
+	header, _ := appendSocksAddr([]byte{0, 0, 0}, "[2001:db8::1]:53")
+	c := &socksUDPConn{Conn: conn, ctrl: ctrl, header: header}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = relay.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = c.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, client, err := relay.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(buf[3:n])
+	address, err := readSocksAddr(r)
+	if err != nil || address != "[2001:db8::1]:53" || !bytes.Equal(buf[:3], []byte{0, 0, 0}) {
+		t.Fatalf("header %x addressed %s: %v", buf[:n-r.Len()], address, err)
+	}
+	if string(buf[n-r.Len():n]) != "query" {
+		t.Fatalf("payload %q", buf[n-r.Len():n])
+	}
+
+	// 分片和格式错误的数据报被丢弃，只返回完整的应答。
+	fragment, _ := appendSocksAddr([]byte{0, 0, 1}, "[2001:db8::1]:53")
+	reply, _ := appendSocksAddr([]byte{0, 0, 0}, "[2001:db8::1]:53")
+	for _, datagram := range [][]byte{append(fragment, "fragment"...), {0, 0}, {0, 0, 0, 9}, append(reply, "answer"...)} {
+		if _, err = relay.WriteTo(datagram, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err = c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "answer" {
+		t.Fatalf("read %q, want the unfragmented answer", buf[:n])
+	}
+}
@@ -0,0 +1,340 @@
+package egress
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Server serves SOCKS5 and HTTP proxy clients on one port and connects them with Dial.
+type Server struct {
+	Dial func(network, address string) (net.Conn, error)
+	// Username and Password are required from clients when Username is set.
+	Username string
+	Password string
+	Log      *log.Logger
+}
+
+// Serve accepts clients on l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	// SOCKS5 以版本号 5 开头，其余按 HTTP 代理处理。
+	c := &bufferedConn{Conn: conn, r: br}
+	if first[0] == socksVersion {
+		err = s.serveSocks(c)
+	} else {
+		err = s.serveHTTP(c, br)
+	}
+	if err != nil && s.Log != nil {
+		s.Log.Debugln("Proxy client %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) authorized(username, password string) bool {
+	return subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) == 1
+}
+
+func (s *Server) serveSocks(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	method := byte(socksAuthNone)
+	if s.Username != "" {
+		method = socksAuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		_, _ = conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		_ = conn.Close()
+		return errors.New("no acceptable SOCKS authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if method == socksAuthPassword {
+		if err := s.socksAuthenticate(conn); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	address, err := readSocksAddr(conn)
+	if err != nil {
+		_ = socksReply(conn, 8, "0.0.0.0:0")
+		_ = conn.Close()
+		return err
+	}
+
+	switch req[1] {
+	case socksCmdConnect:
+		target, err := s.Dial("tcp", address)
+		if err != nil {
+			_ = socksReply(conn, 5, "0.0.0.0:0")
+			_ = conn.Close()
+			return fmt.Errorf("connect %s: %w", address, err)
+		}
+		if err = socksReply(conn, 0, "0.0.0.0:0"); err != nil {
+			_ = conn.Close()
+			_ = target.Close()
+			return err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		relay(conn, target)
+		return nil
+	case socksCmdUDPAssociate:
+		return s.serveSocksUDP(conn)
+	default:
+		_ = socksReply(conn, 7, "0.0.0.0:0")
+		_ = conn.Close()
+		return fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+}
+
+// socksAuthenticate checks the username/password negotiation of RFC 1929.
+func (s *Server) socksAuthenticate(conn net.Conn) error {
+	readField := func() (string, error) {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return "", err
+		}
+		field := make([]byte, n[0])
+		_, err := io.ReadFull(conn, field)
+		return string(field), err
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+	username, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+	if !s.authorized(username, password) {
+		_, _ = conn.Write([]byte{1, 1})
+		return errors.New("SOCKS authentication failed")
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+func socksReply(conn net.Conn, code byte, bound string) error {
+	reply, err := appendSocksAddr([]byte{socksVersion, code, 0}, bound)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(reply)
+	return err
+}
+
+// serveSocksUDP relays the datagrams of a UDP association until its TCP connection closes.
+// Only datagrams from the address of the TCP client are accepted.
+func (s *Server) serveSocksUDP(conn net.Conn) error {
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		_ = socksReply(conn, 1, "0.0.0.0:0")
+		_ = conn.Close()
+		return err
+	}
+	if err = socksReply(conn, 0, pc.LocalAddr().String()); err != nil {
+		_ = pc.Close()
+		_ = conn.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		_ = pc.Close()
+	}()
+	defer conn.Close()
+
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	var client net.Addr
+	targets := make(map[string]net.Conn)
+	defer func() {
+		for _, target := range targets {
+			_ = target.Close()
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		if ip, _, _ := net.SplitHostPort(from.String()); ip != clientIP {
+			continue
+		}
+		if client == nil {
+			client = from
+		}
+		// 丢弃分片和格式错误的数据报。
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		address, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		payload := buf[n-r.Len() : n]
+
+		target, ok := targets[address]
+		if !ok {
+			if target, err = s.Dial("udp", address); err != nil {
+				if s.Log != nil {
+					s.Log.Debugln("Proxy client %s: udp %s: %v", from, address, err)
+				}
+				continue
+			}
+			targets[address] = target
+			go relayUDPReplies(pc, client, target, address)
+		}
+		_, _ = target.Write(payload)
+	}
+}
+
+// relayUDPReplies sends the datagrams of target back to the client with the SOCKS5 UDP header of address.
+func relayUDPReplies(pc net.PacketConn, client net.Addr, target net.Conn, address string) {
+	header, err := appendSocksAddr([]byte{0, 0, 0}, address)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := target.Read(buf)
+		if err != nil {
+			return
+		}
+		msg := make([]byte, 0, len(header)+n)
+		msg = append(msg, header...)
+		if _, err = pc.WriteTo(append(msg, buf[:n]...), client); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) serveHTTP(conn net.Conn, br *bufio.Reader) error {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if s.Username != "" {
+		username, password, ok := proxyBasicAuth(req.Header.Get("Proxy-Authorization"))
+		if !ok || !s.authorized(username, password) {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Basic realm=\"cftun\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			_ = conn.Close()
+			return errors.New("HTTP proxy authentication failed")
+		}
+	}
+
+	address := req.Host
+	if req.Method != http.MethodConnect {
+		if req.URL.Host == "" {
+			_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			_ = conn.Close()
+			return fmt.Errorf("not a proxy request: %s", req.URL)
+		}
+		address = req.URL.Host
+	}
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "80")
+	}
+
+	target, err := s.Dial("tcp", address)
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		_ = conn.Close()
+		return fmt.Errorf("connect %s: %w", address, err)
+	}
+
+	if req.Method == http.MethodConnect {
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else {
+		// 每个连接只转发一个请求，后续请求可能发往其他主机。
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		req.Close = true
+		err = req.Write(target)
+	}
+	if err != nil {
+		_ = conn.Close()
+		_ = target.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	relay(conn, target)
+	return nil
+}
+
+func proxyBasicAuth(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// relay copies between a and b until either side is done, then closes both.
+func relay(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(b, a)
+		_ = b.Close()
+		_ = a.Close()
+		close(done)
+	}()
+	_, _ = io.Copy(a, b)
+	_ = a.Close()
+	_ = b.Close()
+	<-done
+}
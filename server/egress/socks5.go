@@ -0,0 +1,271 @@
+package egress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socksVersion = 5
+
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	// maxSocksUDPHeader is RSV, FRAG, ATYP, a domain of 255 bytes and the port.
+	maxSocksUDPHeader = 3 + 1 + 1 + 255 + 2
+)
+
+var socksReplies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksConnect negotiates with the SOCKS5 proxy on conn and issues cmd for address,
+// it returns the address bound by the proxy.
+func socksConnect(conn net.Conn, hop Hop, cmd byte, address string) (string, error) {
+	methods := []byte{socksAuthNone}
+	if hop.Username != "" {
+		methods = []byte{socksAuthNone, socksAuthPassword}
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return "", err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", err
+	}
+	if reply[0] != socksVersion {
+		return "", fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if hop.Username == "" {
+			return "", errors.New("SOCKS proxy requires a username and password")
+		}
+		if err := socksAuthenticate(conn, hop); err != nil {
+			return "", err
+		}
+	case socksAuthNoAcceptable:
+		return "", errors.New("no acceptable SOCKS authentication method")
+	default:
+		return "", fmt.Errorf("unsupported SOCKS authentication method %d", reply[1])
+	}
+
+	req, err := appendSocksAddr([]byte{socksVersion, cmd, 0}, address)
+	if err != nil {
+		return "", err
+	}
+	if _, err = conn.Write(req); err != nil {
+		return "", err
+	}
+	header := make([]byte, 3)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[1] != 0 {
+		if reason, ok := socksReplies[header[1]]; ok {
+			return "", errors.New(reason)
+		}
+		return "", fmt.Errorf("SOCKS request failed with code %d", header[1])
+	}
+	return readSocksAddr(conn)
+}
+
+// socksAuthenticate runs the username/password negotiation of RFC 1929.
+func socksAuthenticate(conn net.Conn, hop Hop) error {
+	if len(hop.Username) > 255 || len(hop.Password) > 255 {
+		return errors.New("SOCKS username or password too long")
+	}
+	req := []byte{1, byte(len(hop.Username))}
+	req = append(req, hop.Username...)
+	req = append(req, byte(len(hop.Password)))
+	req = append(req, hop.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("SOCKS authentication failed")
+	}
+	return nil
+}
+
+func appendSocksAddr(b []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip = ip.Unmap(); ip.Is4() {
+			b = append(b, socksAtypIPv4)
+		} else {
+			b = append(b, socksAtypIPv6)
+		}
+		b = append(b, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		b = append(b, socksAtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func readSocksAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case socksAtypIPv4:
+		host = make([]byte, 4)
+	case socksAtypIPv6:
+		host = make([]byte, 16)
+	case socksAtypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		host = make([]byte, n[0])
+	default:
+		return "", fmt.Errorf("unsupported SOCKS address type %d", atyp[0])
+	}
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	hostStr := string(host)
+	if atyp[0] != socksAtypDomain {
+		ip, _ := netip.AddrFromSlice(host)
+		hostStr = ip.String()
+	}
+	return net.JoinHostPort(hostStr, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// dialUDP associates a UDP relay on the SOCKS5 proxy, the association lasts as long as its TCP connection.
+func (d *Dialer) dialUDP(hop Hop, address string) (net.Conn, error) {
+	header, err := appendSocksAddr([]byte{0, 0, 0}, address)
+	if err != nil {
+		return nil, err
+	}
+	ctrl, err := d.forward("tcp", hop.Address)
+	if err != nil {
+		return nil, fmt.Errorf("egress proxy %s: %w", hop.Address, err)
+	}
+	_ = ctrl.SetDeadline(time.Now().Add(handshakeTimeout))
+	bound, err := socksConnect(ctrl, hop, socksCmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, fmt.Errorf("egress proxy %s: %w", hop.Address, err)
+	}
+	_ = ctrl.SetDeadline(time.Time{})
+
+	// 代理返回未指定地址时，中继地址与代理地址相同。
+	relayHost, relayPort, _ := net.SplitHostPort(bound)
+	if ip, err := netip.ParseAddr(relayHost); err == nil && ip.IsUnspecified() {
+		relayHost, _, _ = net.SplitHostPort(hop.Address)
+	}
+	relay, err := d.forward("udp", net.JoinHostPort(relayHost, relayPort))
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, fmt.Errorf("egress proxy %s: %w", hop.Address, err)
+	}
+
+	remote := &net.UDPAddr{}
+	if addrPort, err := netip.ParseAddrPort(address); err == nil {
+		remote = net.UDPAddrFromAddrPort(addrPort)
+	} else if _, port, err := net.SplitHostPort(address); err == nil {
+		remote.Port, _ = strconv.Atoi(port)
+	}
+	c := &socksUDPConn{Conn: relay, ctrl: ctrl, header: header, remote: remote}
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		_ = c.Close()
+	}()
+	return c, nil
+}
+
+// socksUDPConn relays the datagrams of one destination through a SOCKS5 UDP association.
+type socksUDPConn struct {
+	net.Conn
+	ctrl      net.Conn
+	header    []byte
+	remote    *net.UDPAddr
+	closeOnce sync.Once
+}
+
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	msg := make([]byte, 0, len(c.header)+len(b))
+	msg = append(msg, c.header...)
+	if _, err := c.Conn.Write(append(msg, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+maxSocksUDPHeader)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		// 丢弃分片和格式错误的数据报。
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		if _, err = readSocksAddr(r); err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), nil
+	}
+}
+
+func (c *socksUDPConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *socksUDPConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		_ = c.ctrl.Close()
+	})
+	return err
+}
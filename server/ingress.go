@@ -0,0 +1,28 @@
+package server
+
+import (
+	"github.com/fmnx/cftun/server/cfd"
+)
+
+type IngressRule struct {
+	Hostname    string `yaml:"hostname" json:"hostname"`
+	Path        string `yaml:"path" json:"path"`
+	Service     string `yaml:"service" json:"service"`
+	NoTLSVerify bool   `yaml:"no-tls-verify" json:"no-tls-verify"`
+}
+
+func buildIngress(rules []*IngressRule) (*cfd.Ingress, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	ingressRules := make([]cfd.IngressRule, 0, len(rules))
+	for _, rule := range rules {
+		ingressRules = append(ingressRules, cfd.IngressRule{
+			Hostname:    rule.Hostname,
+			Path:        rule.Path,
+			Service:     rule.Service,
+			NoTLSVerify: rule.NoTLSVerify,
+		})
+	}
+	return cfd.NewIngress(ingressRules)
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -13,6 +15,11 @@ func (k *Key) String() string {
 	return base64.StdEncoding.EncodeToString(k[:])
 }
 
+// Hex is the form of the key in the WireGuard UAPI.
+func (k *Key) Hex() string {
+	return hex.EncodeToString(k[:])
+}
+
 func (k *Key) IsZero() bool {
 	var zeros Key
 	return subtle.ConstantTimeCompare(zeros[:], k[:]) == 1
@@ -42,3 +49,15 @@ func NewPrivateKey() *Key {
 	k[31] = (k[31] & 127) | 64
 	return k
 }
+
+// ParseKey decodes a base64 key, the format of `wg genkey` and wg-quick configs.
+func ParseKey(s string) (*Key, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != 32 {
+		return nil, fmt.Errorf("invalid key length: %d", len(buf))
+	}
+	return (*Key)(buf), nil
+}
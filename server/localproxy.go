@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/server/cfd"
+	"github.com/fmnx/cftun/server/egress"
+	"net"
+	"net/netip"
+)
+
+const defaultLocalProxyListen = "127.0.0.1:1080"
+
+// LocalProxy serves an outbound to the other processes of the host as a SOCKS5 and HTTP proxy on one port.
+// It listens on loopback unless a username is set.
+type LocalProxy struct {
+	Listen   string `yaml:"listen" json:"listen"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+}
+
+// serve listens on Listen and dials through outbound the destinations policy allows, resolving host names
+// as egress connections do.
+func (p *LocalProxy) serve(outbound *cfd.Outbound, resolver cfd.Resolver, policy *cfd.Policy, logger *log.Logger) error {
+	if p == nil {
+		return nil
+	}
+	listen := p.Listen
+	if listen == "" {
+		listen = defaultLocalProxyListen
+	}
+	// 只写端口时仅监听回环地址。
+	if host, port, err := net.SplitHostPort(listen); err == nil && host == "" {
+		listen = net.JoinHostPort("127.0.0.1", port)
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	if addrPort, err := netip.ParseAddrPort(l.Addr().String()); (err != nil || !addrPort.Addr().IsLoopback()) && p.Username == "" {
+		_ = l.Close()
+		return fmt.Errorf("a username and password are required to listen on %s", l.Addr())
+	}
+
+	routes := &cfd.Egress{Default: outbound, Resolver: resolver}
+	server := &egress.Server{
+		Dial: func(network, address string) (net.Conn, error) {
+			checked, err := policy.Check(network, address)
+			if err != nil {
+				return nil, err
+			}
+			return routes.Dial(network, address, checked)
+		},
+		Username: p.Username,
+		Password: p.Password,
+		Log:      logger,
+	}
+
+	logger.Infoln("Serving the %s outbound as a SOCKS5 and HTTP proxy on %s", outbound.Name, l.Addr())
+	go func() {
+		if err := server.Serve(l); err != nil {
+			logger.Errorln("The %s proxy stopped: %v", outbound.Name, err)
+		}
+	}()
+	return nil
+}
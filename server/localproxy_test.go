@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fmnx/cftun/server/cfd"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+func TestLocalProxyRefusesOpenListen(t *testing.T) {
+	p := &LocalProxy{Listen: "0.0.0.0:0"}
+	if err := p.serve(cfd.DirectOutbound, nil, nil, nil); err == nil {
+		t.Fatal("a non-loopback listen without a username was accepted")
+	}
+}
+
+func TestLocalProxyChecksPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	outbound := &cfd.Outbound{Name: "test", Dial: func(network, address string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, address)
+		return nil, fmt.Errorf("not dialing %s", address)
+	}}
+	policy, err := (*Policy)(nil).build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := freeAddr(t)
+	if err = (&LocalProxy{Listen: listen}).serve(outbound, nil, policy, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"169.254.169.254:80", "127.0.0.1:22", "192.0.2.1:443"} {
+		conn, err := net.Dial("tcp", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		_ = conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("%s: status %d", target, resp.StatusCode)
+		}
+	}
+	// 只有策略允许的目标才会经出口拨号。
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(dialed, ",") != "192.0.2.1:443" {
+		t.Fatalf("dialed %v, want only 192.0.2.1:443", dialed)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/server/cfd"
+	"net"
+	"net/http"
+	"time"
+)
+
+// readyResponse follows the /ready document of cloudflared.
+type readyResponse struct {
+	Status           int    `json:"status"`
+	ReadyConnections int    `json:"readyConnections"`
+	ConnectorID      string `json:"connectorId,omitempty"`
+}
+
+type tunnelStatus struct {
+	Name             string                 `json:"name,omitempty"`
+	ConnectorID      string                 `json:"connector_id"`
+	ReadyConnections int                    `json:"ready_connections"`
+	Connections      []cfd.ConnectionStatus `json:"connections"`
+	Warp             *warpStatus            `json:"warp,omitempty"`
+}
+
+type warpStatus struct {
+	Healthy       bool       `json:"healthy"`
+	Fallback      bool       `json:"fallback"`
+	Account       string     `json:"account"`
+	Endpoint      string     `json:"endpoint"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	LastProbe     *time.Time `json:"last_probe,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+func newWarpStatus(state cfd.WarpState) *warpStatus {
+	status := &warpStatus{
+		Healthy:   state.Healthy,
+		Fallback:  state.Fallback,
+		Account:   state.Account,
+		Endpoint:  state.Endpoint,
+		LastError: state.LastError,
+	}
+	if !state.LastHandshake.IsZero() {
+		status.LastHandshake = &state.LastHandshake
+	}
+	if !state.LastProbe.IsZero() {
+		status.LastProbe = &state.LastProbe
+	}
+	return status
+}
+
+type statusResponse struct {
+	ReadyConnections int            `json:"ready_connections"`
+	Tunnels          []tunnelStatus `json:"tunnels"`
+}
+
+// serveMetrics serves metricsHandler on address. Without metrics-address none of its endpoints exist.
+func serveMetrics(address string, tunnels []*tunnel) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalln("Failed to listen on metrics-address %s: %v", address, err)
+	}
+	log.Infoln("Serving metrics on http://%s/metrics", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, metricsHandler(tunnels)); err != nil {
+			log.Errorln("Metrics server stopped: %v", err)
+		}
+	}()
+}
+
+// metricsHandler serves the Prometheus metrics at /metrics, readiness at /ready, liveness at /healthz
+// and the connection details at /status.
+func metricsHandler(tunnels []*tunnel) http.Handler {
+	var metrics cfd.MetricsHandler
+	for _, t := range tunnels {
+		metrics = append(metrics, t.metrics)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	// 隧道未启动或已开始关闭时不再存活。
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		for _, t := range tunnels {
+			if !t.edge.Running() {
+				http.Error(w, "NOT RUNNING", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_, _ = w.Write([]byte("OK\n"))
+	})
+	// 所有隧道都至少有一个已注册的连接时才算就绪。
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, _ *http.Request) {
+		resp := readyResponse{Status: http.StatusOK}
+		for _, t := range tunnels {
+			n := t.edge.ReadyConnections()
+			if n == 0 {
+				resp.Status = http.StatusServiceUnavailable
+			}
+			resp.ReadyConnections += n
+		}
+		if len(tunnels) == 1 {
+			resp.ConnectorID = tunnels[0].connectorID
+		}
+		writeJSON(w, resp.Status, resp)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		var resp statusResponse
+		for _, t := range tunnels {
+			status := tunnelStatus{
+				Name:             t.name,
+				ConnectorID:      t.connectorID,
+				ReadyConnections: t.edge.ReadyConnections(),
+				Connections:      t.edge.Status(),
+			}
+			if t.metrics.Warp != nil {
+				status.Warp = newWarpStatus(t.metrics.Warp())
+			}
+			resp.ReadyConnections += status.ReadyConnections
+			resp.Tunnels = append(resp.Tunnels, status)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
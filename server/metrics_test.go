@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/fmnx/cftun/server/cfd"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeSupervisor reports the state set by the test.
+type fakeSupervisor struct {
+	mu          sync.Mutex
+	running     bool
+	connections []cfd.ConnectionStatus
+}
+
+func (s *fakeSupervisor) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = true
+}
+
+func (s *fakeSupervisor) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+}
+
+func (s *fakeSupervisor) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+func (s *fakeSupervisor) register(status cfd.ConnectionStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connections = append(s.connections, status)
+}
+
+func (s *fakeSupervisor) ReadyConnections() int {
+	n := 0
+	for _, status := range s.Status() {
+		if status.Registered {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *fakeSupervisor) Status() []cfd.ConnectionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(make([]cfd.ConnectionStatus, 0, len(s.connections)), s.connections...)
+}
+
+func get(t *testing.T, url string, v any) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestMetricsReady(t *testing.T) {
+	edge := &fakeSupervisor{}
+	ts := httptest.NewServer(metricsHandler([]*tunnel{{connectorID: "connector", metrics: cfd.NewMetrics(), edge: edge}}))
+	defer ts.Close()
+
+	var ready readyResponse
+	if status := get(t, ts.URL+"/ready", &ready); status != http.StatusServiceUnavailable || ready.ReadyConnections != 0 {
+		t.Fatalf("/ready before registering: %d %+v", status, ready)
+	}
+	edge.register(cfd.ConnectionStatus{Index: 0, Registered: true, Location: "LAX"})
+	if status := get(t, ts.URL+"/ready", &ready); status != http.StatusOK || ready.ReadyConnections != 1 ||
+		ready.ConnectorID != "connector" {
+		t.Fatalf("/ready after registering: %d %+v", status, ready)
+	}
+}
+
+func TestMetricsHealthz(t *testing.T) {
+	edge := &fakeSupervisor{}
+	ts := httptest.NewServer(metricsHandler([]*tunnel{{metrics: cfd.NewMetrics(), edge: edge}}))
+	defer ts.Close()
+
+	if status := get(t, ts.URL+"/healthz", nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("/healthz before starting: %d", status)
+	}
+	edge.Start()
+	if status := get(t, ts.URL+"/healthz", nil); status != http.StatusOK {
+		t.Fatalf("/healthz while running: %d", status)
+	}
+	edge.Shutdown()
+	if status := get(t, ts.URL+"/healthz", nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("/healthz after shutdown: %d", status)
+	}
+}
+
+func TestMetricsStatus(t *testing.T) {
+	a, b := &fakeSupervisor{}, &fakeSupervisor{}
+	a.register(cfd.ConnectionStatus{Index: 0, Registered: true, UUID: "uuid", Location: "LAX", EdgeAddress: "198.41.192.1:7844", Protocol: "quic"})
+	a.register(cfd.ConnectionStatus{Index: 1, LastError: "timeout"})
+	warp := cfd.NewMetrics()
+	warp.Warp = func() cfd.WarpState {
+		return cfd.WarpState{Healthy: true, Account: "default", Endpoint: "162.159.192.1:2408"}
+	}
+	ts := httptest.NewServer(metricsHandler([]*tunnel{
+		{name: "a", connectorID: "connector-a", metrics: cfd.NewMetrics(), edge: a},
+		{name: "b", connectorID: "connector-b", metrics: warp, edge: b},
+	}))
+	defer ts.Close()
+
+	var status map[string]any
+	if code := get(t, ts.URL+"/status", &status); code != http.StatusOK {
+		t.Fatalf("/status: %d", code)
+	}
+	expected := map[string]any{
+		"ready_connections": 1.0,
+		"tunnels": []any{
+			map[string]any{
+				"name":              "a",
+				"connector_id":      "connector-a",
+				"ready_connections": 1.0,
+				"connections": []any{
+					map[string]any{"index": 0.0, "registered": true, "uuid": "uuid", "location": "LAX",
+						"edge_address": "198.41.192.1:7844", "protocol": "quic"},
+					map[string]any{"index": 1.0, "registered": false, "last_error": "timeout"},
+				},
+			},
+			map[string]any{
+				"name":              "b",
+				"connector_id":      "connector-b",
+				"ready_connections": 0.0,
+				"connections":       []any{},
+				"warp": map[string]any{"healthy": true, "fallback": false, "account": "default",
+					"endpoint": "162.159.192.1:2408"},
+			},
+		},
+	}
+	got, _ := json.Marshal(status)
+	want, _ := json.Marshal(expected)
+	if string(got) != string(want) {
+		t.Fatalf("/status\n got %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/server/cfd"
+	"github.com/fmnx/cftun/server/egress"
+	"net/netip"
+	"strings"
+)
+
+const (
+	OutboundDirect = "direct"
+	OutboundWarp   = "warp"
+	OutboundBind   = "bind"
+	OutboundProxy  = "proxy"
+)
+
+type EgressRule struct {
+	Outbound    string   `yaml:"outbound" json:"outbound"`
+	Protocol    string   `yaml:"protocol" json:"protocol"`
+	CIDRs       []string `yaml:"cidrs" json:"cidrs"`
+	Ports       []string `yaml:"ports" json:"ports"`
+	Domains     []string `yaml:"domains" json:"domains"`
+	BindAddress string   `yaml:"bind-address" json:"bind-address"`
+	Proxy       []string `yaml:"proxy" json:"proxy"`
+	// WireGuard names the interface of outbound wireguard, it may be omitted when there is only one.
+	WireGuard string `yaml:"wireguard" json:"wireguard"`
+}
+
+// outbounds are the shared outbounds rules can refer to, nil when not configured.
+type outbounds struct {
+	warp      *cfd.Outbound
+	proxy     *cfd.Outbound
+	wireguard map[string]*cfd.Outbound
+}
+
+// usesWarp reports whether warp proxy4, proxy6, its local proxy, an egress rule or dns needs the WARP device.
+func (server *Config) usesWarp() bool {
+	if server.Warp == nil {
+		return false
+	}
+	if server.Warp.Proxy4 || server.Warp.Proxy6 || server.Warp.LocalProxy != nil || server.DNS.viaWarp() {
+		return true
+	}
+	for _, r := range server.EgressRules {
+		if strings.ToLower(r.Outbound) == OutboundWarp {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyOutbound chains the proxies given as URLs, see egress.ParseHop.
+func proxyOutbound(urls []string) (*cfd.Outbound, error) {
+	var hops []egress.Hop
+	for _, rawURL := range urls {
+		hop, err := egress.ParseHop(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hop)
+	}
+	dialer, err := egress.NewDialer(hops)
+	if err != nil {
+		return nil, err
+	}
+	return &cfd.Outbound{Name: OutboundProxy, Dial: dialer.Dial, RemoteDNS: true}, nil
+}
+
+// wireguardOutbound returns the wireguard interface called name, or the only one when name is empty.
+func (shared outbounds) wireguardOutbound(name string) (*cfd.Outbound, error) {
+	if name == "" {
+		if len(shared.wireguard) != 1 {
+			return nil, errors.New("egress rule uses wireguard but does not name one of the wireguard interfaces")
+		}
+		for _, outbound := range shared.wireguard {
+			return outbound, nil
+		}
+	}
+	outbound, ok := shared.wireguard[name]
+	if !ok {
+		return nil, fmt.Errorf("egress rule uses unknown wireguard interface %q", name)
+	}
+	return outbound, nil
+}
+
+func (r *EgressRule) build(shared outbounds) (*cfd.EgressRule, error) {
+	rule := &cfd.EgressRule{}
+	switch outbound := strings.ToLower(r.Outbound); outbound {
+	case OutboundDirect:
+		rule.Outbound = cfd.DirectOutbound
+	case OutboundWarp:
+		if shared.warp == nil {
+			return nil, errors.New("egress rule uses warp but warp is not configured")
+		}
+		rule.Outbound = shared.warp
+	case OutboundBind:
+		ip, err := netip.ParseAddr(r.BindAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress rule bind-address: %q", r.BindAddress)
+		}
+		rule.Outbound = cfd.BindOutbound(ip)
+	case OutboundProxy:
+		if len(r.Proxy) == 0 {
+			if shared.proxy == nil {
+				return nil, errors.New("egress rule uses proxy but neither proxy nor egress-proxy is set")
+			}
+			rule.Outbound = shared.proxy
+			break
+		}
+		proxy, err := proxyOutbound(r.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		rule.Outbound = proxy
+	case OutboundWireGuard:
+		outbound, err := shared.wireguardOutbound(r.WireGuard)
+		if err != nil {
+			return nil, err
+		}
+		rule.Outbound = outbound
+	default:
+		return nil, fmt.Errorf("invalid egress rule outbound: %q", r.Outbound)
+	}
+
+	switch protocol := strings.ToLower(r.Protocol); protocol {
+	case "", "tcp", "udp":
+		rule.Network = protocol
+	default:
+		return nil, fmt.Errorf("invalid egress rule protocol: %q", r.Protocol)
+	}
+
+	for _, cidr := range r.CIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid egress rule cidr: %q", cidr)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rule.Prefixes = append(rule.Prefixes, prefix.Masked())
+	}
+
+	for _, port := range r.Ports {
+		portRange, err := cfd.ParsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		rule.Ports = append(rule.Ports, portRange)
+	}
+
+	for _, domain := range r.Domains {
+		rule.Domains = append(rule.Domains, strings.ToLower(strings.Trim(domain, ".")))
+	}
+	return rule, nil
+}
+
+// buildEgress compiles the rules followed by the family rules of warp proxy4 and proxy6.
+// Unmatched destinations go through egress-proxy when it is set, directly otherwise.
+func buildEgress(rules []*EgressRule, shared outbounds, proxy4, proxy6 bool) (*cfd.Egress, error) {
+	e := &cfd.Egress{Default: cfd.DirectOutbound}
+	if shared.proxy != nil {
+		e.Default = shared.proxy
+	}
+	for _, r := range rules {
+		rule, err := r.build(shared)
+		if err != nil {
+			return nil, err
+		}
+		e.Rules = append(e.Rules, rule)
+	}
+
+	if proxy4 {
+		e.Rules = append(e.Rules, &cfd.EgressRule{
+			Prefixes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+			Outbound: shared.warp,
+		})
+	}
+	if proxy6 {
+		e.Rules = append(e.Rules, &cfd.EgressRule{
+			Prefixes: []netip.Prefix{netip.MustParsePrefix("::/0")},
+			Outbound: shared.warp,
+		})
+	}
+	return e, nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"github.com/fmnx/cftun/server/cfd"
+	"net/netip"
+	"strings"
+)
+
+type PolicyRule struct {
+	Action   string   `yaml:"action" json:"action"`
+	Protocol string   `yaml:"protocol" json:"protocol"`
+	CIDRs    []string `yaml:"cidrs" json:"cidrs"`
+	Ports    []string `yaml:"ports" json:"ports"`
+	Hosts    []string `yaml:"hosts" json:"hosts"`
+}
+
+type Policy struct {
+	Default             string        `yaml:"default" json:"default"`
+	DisableSafeDefaults bool          `yaml:"disable-safe-defaults" json:"disable-safe-defaults"`
+	Rules               []*PolicyRule `yaml:"rules" json:"rules"`
+}
+
+func (r *PolicyRule) build() (*cfd.PolicyRule, error) {
+	rule := &cfd.PolicyRule{}
+	switch strings.ToLower(r.Action) {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("invalid policy action: %q", r.Action)
+	}
+
+	switch protocol := strings.ToLower(r.Protocol); protocol {
+	case "", "tcp", "udp":
+		rule.Network = protocol
+	default:
+		return nil, fmt.Errorf("invalid policy protocol: %q", r.Protocol)
+	}
+
+	for _, cidr := range r.CIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid policy cidr: %q", cidr)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rule.Prefixes = append(rule.Prefixes, prefix.Masked())
+	}
+
+	for _, port := range r.Ports {
+		portRange, err := cfd.ParsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		rule.Ports = append(rule.Ports, portRange)
+	}
+
+	for _, host := range r.Hosts {
+		rule.Hosts = append(rule.Hosts, strings.ToLower(host))
+	}
+	return rule, nil
+}
+
+// build compiles the configured rules. A nil policy still blocks loopback, link-local and metadata addresses.
+func (p *Policy) build() (*cfd.Policy, error) {
+	if p == nil {
+		p = &Policy{}
+	}
+
+	policy := &cfd.Policy{}
+	switch strings.ToLower(p.Default) {
+	case "", "allow":
+		policy.DefaultAllow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("invalid policy default action: %q", p.Default)
+	}
+
+	if !p.DisableSafeDefaults {
+		policy.Rules = append(policy.Rules,
+			&cfd.PolicyRule{Prefixes: cfd.SafeDefaultDenyPrefixes},
+			&cfd.PolicyRule{Hosts: cfd.SafeDefaultDenyHosts},
+		)
+	}
+
+	for _, r := range p.Rules {
+		rule, err := r.build()
+		if err != nil {
+			return nil, err
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
@@ -0,0 +1,186 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+
+	// DefaultCacheSize bounds the names kept in the cache.
+	DefaultCacheSize = 4096
+
+	minTTL      = 5 * time.Second
+	maxTTL      = time.Hour
+	negativeTTL = 30 * time.Second
+)
+
+// DialFunc connects to an upstream, e.g. through WARP. A nil DialFunc dials directly.
+type DialFunc func(network, address string) (net.Conn, error)
+
+// Resolver resolves host names through its upstreams in order, with static hosts and a TTL cache.
+type Resolver struct {
+	Upstreams []Upstream
+	Hosts     map[string][]netip.Addr
+	// Prefer puts the addresses of one family first, empty keeps the order of the upstream.
+	Prefer string
+	// CacheSize bounds the cached names, 0 disables the cache.
+	CacheSize int
+
+	mu       sync.Mutex
+	cache    map[string]*entry
+	inflight map[string]*call
+}
+
+type entry struct {
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+type call struct {
+	done  chan struct{}
+	addrs []netip.Addr
+	err   error
+}
+
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// LookupNetIP returns the addresses of host in order of preference.
+func (r *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+	if addrs, ok := r.Hosts[host]; ok {
+		return r.order(addrs), nil
+	}
+
+	r.mu.Lock()
+	if e, ok := r.cache[host]; ok && time.Now().Before(e.expires) {
+		r.mu.Unlock()
+		if e.err != nil {
+			return nil, e.err
+		}
+		return r.order(e.addrs), nil
+	}
+	// 同一域名的并发查询只发出一次。
+	if c, ok := r.inflight[host]; ok {
+		r.mu.Unlock()
+		select {
+		case <-c.done:
+			if c.err != nil {
+				return nil, c.err
+			}
+			return r.order(c.addrs), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := &call{done: make(chan struct{})}
+	if r.inflight == nil {
+		r.inflight = make(map[string]*call)
+	}
+	r.inflight[host] = c
+	r.mu.Unlock()
+
+	addrs, ttl, err := r.lookup(ctx, host)
+	c.addrs, c.err = addrs, err
+
+	r.mu.Lock()
+	delete(r.inflight, host)
+	if err == nil || isNotFound(err) {
+		r.store(host, &entry{addrs: addrs, err: err, expires: time.Now().Add(ttl)})
+	}
+	r.mu.Unlock()
+	close(c.done)
+
+	if err != nil {
+		return nil, err
+	}
+	return r.order(addrs), nil
+}
+
+// lookup asks the upstreams in order until one answers, a name that does not exist is an answer.
+func (r *Resolver) lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	upstreams := r.Upstreams
+	if len(upstreams) == 0 {
+		upstreams = []Upstream{System}
+	}
+	var lastErr error
+	for _, upstream := range upstreams {
+		addrs, ttl, err := upstream.Lookup(ctx, host)
+		if err == nil {
+			return addrs, min(max(ttl, minTTL), maxTTL), nil
+		}
+		if isNotFound(err) {
+			return nil, min(max(ttl, minTTL), negativeTTL), err
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// store caches e, making room by dropping expired names and then arbitrary ones.
+func (r *Resolver) store(host string, e *entry) {
+	if r.CacheSize <= 0 {
+		return
+	}
+	if r.cache == nil {
+		r.cache = make(map[string]*entry)
+	}
+	if len(r.cache) >= r.CacheSize {
+		now := time.Now()
+		for name, cached := range r.cache {
+			if now.After(cached.expires) {
+				delete(r.cache, name)
+			}
+		}
+		for name := range r.cache {
+			if len(r.cache) < r.CacheSize {
+				break
+			}
+			delete(r.cache, name)
+		}
+	}
+	r.cache[host] = e
+}
+
+// order returns a copy of addrs with the preferred family first.
+func (r *Resolver) order(addrs []netip.Addr) []netip.Addr {
+	ordered := make([]netip.Addr, 0, len(addrs))
+	switch r.Prefer {
+	case PreferIPv4, PreferIPv6:
+		want4 := r.Prefer == PreferIPv4
+		for _, addr := range addrs {
+			if addr.Is4() == want4 {
+				ordered = append(ordered, addr)
+			}
+		}
+		for _, addr := range addrs {
+			if addr.Is4() != want4 {
+				ordered = append(ordered, addr)
+			}
+		}
+	default:
+		ordered = append(ordered, addrs...)
+	}
+	return ordered
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
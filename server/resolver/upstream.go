@@ -0,0 +1,411 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// queryTimeout bounds one upstream so the next one still gets its turn.
+	queryTimeout = 3 * time.Second
+	// systemTTL caches the answers of the system resolver, which does not report TTLs.
+	systemTTL = 30 * time.Second
+	udpSize   = 1232
+)
+
+// Upstream answers the A and AAAA queries of a host with the TTL of the answer.
+type Upstream interface {
+	Lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+	String() string
+}
+
+type systemUpstream struct{}
+
+// System is the resolver of the operating system.
+var System Upstream = systemUpstream{}
+
+func (systemUpstream) Lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, systemTTL, err
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return addrs, systemTTL, nil
+}
+
+func (systemUpstream) String() string {
+	return "system"
+}
+
+// dnsUpstream is a DNS server reached over udp, tcp, tls or https.
+type dnsUpstream struct {
+	scheme  string
+	address string
+	url     string
+	dial    DialFunc
+	tls     *tls.Config
+	client  *http.Client
+}
+
+// ParseUpstream parses system, udp://host[:port], tcp://host[:port], tls://host[:port] or an https:// DoH URL,
+// a bare host[:port] is udp. Connections to the upstream go through dial, the host must then be an address
+// as looking it up would leave dial.
+func ParseUpstream(raw string, dial DialFunc) (Upstream, error) {
+	if raw == "system" {
+		return System, nil
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "udp://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("dns upstream %s has no host", raw)
+	}
+	if _, err = netip.ParseAddr(u.Hostname()); err != nil && dial != nil {
+		return nil, fmt.Errorf("dns upstream %s must be an ip address to go through the dialer", raw)
+	}
+
+	up := &dnsUpstream{scheme: u.Scheme, dial: dial}
+	port := u.Port()
+	switch u.Scheme {
+	case "udp", "tcp":
+		if port == "" {
+			port = "53"
+		}
+	case "tls":
+		if port == "" {
+			port = "853"
+		}
+		up.tls = &tls.Config{ServerName: u.Hostname()}
+	case "https":
+		up.url = u.String()
+		up.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext:         up.dialContext,
+				ForceAttemptHTTP2:   true,
+				TLSHandshakeTimeout: queryTimeout,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+		return up, nil
+	default:
+		return nil, fmt.Errorf("unsupported dns upstream scheme %q", u.Scheme)
+	}
+	up.address = net.JoinHostPort(u.Hostname(), port)
+	return up, nil
+}
+
+func (u *dnsUpstream) String() string {
+	if u.url != "" {
+		return u.url
+	}
+	return u.scheme + "://" + u.address
+}
+
+// dialContext connects through dial. Without dial, the host of an upstream given by name is bootstrapped
+// with the system resolver.
+func (u *dnsUpstream) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = netip.ParseAddr(host); err != nil {
+		if u.dial != nil {
+			return nil, fmt.Errorf("dns upstream %s must be an ip address to go through the dialer", host)
+		}
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(addrs[0].Unmap().String(), port)
+	}
+	if u.dial == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := u.dial(network, address)
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Lookup queries A and AAAA concurrently, either family answering is enough.
+func (u *dnsUpstream) Lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	type answer struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make([]answer, len(types))
+	done := make(chan struct{}, len(types))
+	for i, qtype := range types {
+		go func(i int, qtype dnsmessage.Type) {
+			a := &answers[i]
+			a.addrs, a.ttl, a.err = u.query(ctx, name, qtype)
+			done <- struct{}{}
+		}(i, qtype)
+	}
+	for range types {
+		<-done
+	}
+
+	var addrs []netip.Addr
+	ttl := maxTTL
+	var lastErr error
+	answered := false
+	for _, a := range answers {
+		if a.err != nil {
+			lastErr = a.err
+			continue
+		}
+		answered = true
+		addrs = append(addrs, a.addrs...)
+		ttl = min(ttl, a.ttl)
+	}
+	if !answered {
+		return nil, 0, fmt.Errorf("%s: %w", u, lastErr)
+	}
+	if len(addrs) == 0 {
+		return nil, ttl, notFound(host)
+	}
+	return addrs, ttl, nil
+}
+
+// query sends one question and returns the addresses of the answer, or its negative TTL when empty.
+func (u *dnsUpstream) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	id := uint16(rand.Intn(1 << 16))
+	if u.scheme == "https" {
+		// RFC 8484 建议 DoH 使用 0 作为 ID，便于 HTTP 缓存。
+		id = 0
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET})
+	_ = b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	_ = opt.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, false)
+	_ = b.OPTResource(opt, dnsmessage.OPTResource{})
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var resp []byte
+	switch u.scheme {
+	case "udp":
+		resp, err = u.exchangeUDP(ctx, msg, id)
+	case "https":
+		resp, err = u.exchangeHTTPS(ctx, msg)
+	default:
+		resp, err = u.exchangeStream(ctx, msg)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	addrs, ttl, truncated, err := parseAnswer(resp, id, qtype)
+	if truncated && u.scheme == "udp" {
+		if resp, err = u.exchangeStream(ctx, msg); err != nil {
+			return nil, 0, err
+		}
+		addrs, ttl, _, err = parseAnswer(resp, id, qtype)
+	}
+	return addrs, ttl, err
+}
+
+func (u *dnsUpstream) exchangeUDP(ctx context.Context, msg []byte, id uint16) ([]byte, error) {
+	conn, err := u.dialContext(ctx, "udp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, udpSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略 ID 不匹配的迟到或伪造应答。
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends msg with a length prefix over tcp, or over tls for DoT.
+func (u *dnsUpstream) exchangeStream(ctx context.Context, msg []byte) ([]byte, error) {
+	conn, err := u.dialContext(ctx, "tcp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	if u.tls != nil {
+		tlsConn := tls.Client(conn, u.tls)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg)))); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (u *dnsUpstream) exchangeHTTPS(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u.url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+}
+
+// parseAnswer extracts the addresses of qtype and their smallest TTL, an empty answer carries the negative TTL.
+func parseAnswer(msg []byte, id uint16, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, bool, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if header.ID != id || !header.Response {
+		return nil, 0, false, errors.New("mismatched dns response")
+	}
+	if header.Truncated {
+		return nil, 0, true, nil
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, false, fmt.Errorf("dns server returned %s", header.RCode)
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, false, err
+	}
+
+	var addrs []netip.Addr
+	ttl := uint32(maxTTL / time.Second)
+	for {
+		h, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+		switch {
+		case h.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, false, err
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case h.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, false, err
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA).Unmap())
+		default:
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, false, err
+			}
+		}
+		ttl = min(ttl, h.TTL)
+	}
+
+	if len(addrs) == 0 {
+		ttl = uint32(negativeTTL / time.Second)
+		for {
+			h, err := p.AuthorityHeader()
+			if err != nil {
+				break
+			}
+			if h.Type != dnsmessage.TypeSOA {
+				if p.SkipAuthority() != nil {
+					break
+				}
+				continue
+			}
+			if soa, err := p.SOAResource(); err == nil {
+				ttl = min(h.TTL, soa.MinTTL)
+			}
+			break
+		}
+	}
+	return addrs, time.Duration(ttl) * time.Second, false, nil
+}
@@ -0,0 +1,59 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestParseUpstreamThroughDialRequiresAddress(t *testing.T) {
+	dial := func(network, address string) (net.Conn, error) { return nil, errors.New("not dialing") }
+	for _, raw := range []string{"dns.google", "tls://one.one.one.one", "https://cloudflare-dns.com/dns-query"} {
+		if _, err := ParseUpstream(raw, dial); err == nil {
+			t.Errorf("%s: a named upstream was accepted through the dialer", raw)
+		}
+		if _, err := ParseUpstream(raw, nil); err != nil {
+			t.Errorf("%s: %v", raw, err)
+		}
+	}
+	for _, raw := range []string{"1.1.1.1", "tls://1.1.1.1", "https://1.1.1.1/dns-query", "tcp://[2606:4700:4700::1111]"} {
+		if _, err := ParseUpstream(raw, dial); err != nil {
+			t.Errorf("%s: %v", raw, err)
+		}
+	}
+}
+
+func TestUpstreamQueriesGoThroughDial(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	dial := func(network, address string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, network+" "+address)
+		return nil, errors.New("not dialing")
+	}
+	for _, raw := range []string{"192.0.2.53", "https://192.0.2.53/dns-query"} {
+		mu.Lock()
+		dialed = nil
+		mu.Unlock()
+		upstream, err := ParseUpstream(raw, dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = upstream.Lookup(context.Background(), "example.com"); err == nil {
+			t.Fatalf("%s: the lookup succeeded without a connection", raw)
+		}
+		mu.Lock()
+		if len(dialed) == 0 {
+			t.Fatalf("%s: the query did not go through the dialer", raw)
+		}
+		for _, d := range dialed {
+			if d != "udp 192.0.2.53:53" && d != "tcp 192.0.2.53:443" {
+				t.Fatalf("%s: dialed %s", raw, d)
+			}
+		}
+		mu.Unlock()
+	}
+}
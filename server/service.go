@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"github.com/fmnx/cftun/log"
+	"github.com/fmnx/cftun/server/cfd"
+	"time"
+)
+
+type HealthCheck struct {
+	Interval int `yaml:"interval" json:"interval"`
+	Timeout  int `yaml:"timeout" json:"timeout"`
+}
+
+type Service struct {
+	Origins     []string     `yaml:"origins" json:"origins"`
+	Balance     string       `yaml:"balance" json:"balance"`
+	HealthCheck *HealthCheck `yaml:"health-check" json:"health-check"`
+}
+
+func buildServices(services map[string]*Service, defaultService string, logger *log.Logger) (*cfd.Services, error) {
+	if len(services) == 0 {
+		if defaultService != "" {
+			return nil, fmt.Errorf("default service %s is not defined", defaultService)
+		}
+		return nil, nil
+	}
+
+	result := &cfd.Services{
+		Services: make(map[string]*cfd.Service, len(services)),
+		Default:  defaultService,
+	}
+	for name, s := range services {
+		if len(s.Origins) == 0 {
+			return nil, fmt.Errorf("service %s has no origins", name)
+		}
+		service := cfd.NewService(name, s.Origins)
+		service.Log = logger
+		switch s.Balance {
+		case "":
+			service.Balance = cfd.BalanceRoundRobin
+		case cfd.BalanceRoundRobin, cfd.BalanceRandom, cfd.BalanceFirst:
+			service.Balance = s.Balance
+		default:
+			return nil, fmt.Errorf("service %s: unsupported balance policy %s", name, s.Balance)
+		}
+		if s.HealthCheck != nil {
+			service.HealthInterval = time.Duration(s.HealthCheck.Interval) * time.Second
+			if service.HealthInterval <= 0 {
+				service.HealthInterval = 10 * time.Second
+			}
+			service.HealthTimeout = time.Duration(s.HealthCheck.Timeout) * time.Second
+			if service.HealthTimeout <= 0 {
+				service.HealthTimeout = 3 * time.Second
+			}
+		}
+		result.Services[name] = service
+	}
+
+	if _, ok := result.Services[defaultService]; defaultService != "" && !ok {
+		return nil, fmt.Errorf("default service %s is not defined", defaultService)
+	}
+	return result, nil
+}
@@ -1,192 +1,495 @@
 package server
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/fmnx/cftun/log"
 	"github.com/fmnx/cftun/server/cfd"
-	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/netstack"
-	"io"
 	"net"
-	"net/http"
 	"net/netip"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-type Warp struct {
+const (
+	warpIPv4      = "172.16.0.2"
+	warpPublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+	warpEndpoint  = "engage.cloudflareclient.com:2408"
+)
+
+// warpHandshakeWait is how long an endpoint has to complete a handshake.
+var warpHandshakeWait = 8 * time.Second
+
+// defaultWarpEndpoints are tried after the endpoint of an account when no endpoints are configured.
+var defaultWarpEndpoints = []string{
+	"162.159.192.1:2408",
+	"162.159.193.1:2408",
+	"162.159.195.1:2408",
+	"[2606:4700:d0::a29f:c001]:2408",
+}
+
+// WarpAccount is one WARP registration. With auto it is registered on first start and kept in the state file.
+type WarpAccount struct {
 	Auto       bool   `yaml:"auto" json:"auto"`
-	Port       uint16 `yaml:"port" json:"port"`
+	License    string `yaml:"license" json:"license,omitempty"`
 	Endpoint   string `yaml:"endpoint" json:"endpoint"`
 	IPv4       string `yaml:"ipv4" json:"ipv4"`
 	IPv6       string `yaml:"ipv6" json:"ipv6"`
 	PrivateKey string `yaml:"private-key" json:"private-key"`
 	PublicKey  string `yaml:"public-key" json:"public-key"`
 	Reserved   []byte `yaml:"reserved" json:"reserved"`
-	Proxy4     bool   `yaml:"proxy4" json:"proxy4"`
-	Proxy6     bool   `yaml:"proxy6" json:"proxy6"`
+	// ID and Token identify a registered account to the API, a license can only be applied with them.
+	ID    string `yaml:"id" json:"id,omitempty"`
+	Token string `yaml:"token" json:"token,omitempty"`
 }
 
-type warpConfig struct {
-	Config struct {
-		ClientID string `json:"client_id"`
-		Interface struct {
-			Addresses struct {
-				V6 string `json:"v6"`
-			} `json:"addresses"`
-		} `json:"interface"`
-	} `json:"config"`
+type Warp struct {
+	WarpAccount `yaml:",inline"`
+	Port        uint16 `yaml:"port" json:"port"`
+	Proxy4      bool   `yaml:"proxy4" json:"proxy4"`
+	Proxy6      bool   `yaml:"proxy6" json:"proxy6"`
+	// API is the base URL of the registration API.
+	API string `yaml:"api" json:"api"`
+	// ClientVersion and UserAgent identify the client to the registration API, the WARP Android app by default.
+	ClientVersion string `yaml:"client-version" json:"client-version"`
+	UserAgent     string `yaml:"user-agent" json:"user-agent"`
+	// Endpoints are tried after the endpoint of each account, the first to complete a handshake is used.
+	Endpoints []string `yaml:"endpoints" json:"endpoints"`
+	// Accounts take over in order when the accounts before them are unusable.
+	Accounts []*WarpAccount `yaml:"accounts" json:"accounts"`
+	// Health checks the tunnel and recovers it, see WarpHealth.
+	Health *WarpHealth `yaml:"health" json:"health"`
+	// LocalProxy also serves WARP to the host.
+	LocalProxy *LocalProxy `yaml:"local-proxy" json:"local-proxy"`
+
+	// mu guards the running device and its health, recovery replaces the device.
+	mu        sync.RWMutex
+	dev       *device.Device
+	tnet      *netstack.Net
+	profile   warpProfile
+	endpoint  string
+	unhealthy bool
+	fallback  bool
+	stopped   bool
+	lastProbe time.Time
+	lastError string
+	// file stores the applied accounts, logger prefixes the messages of the tunnel.
+	file   string
+	logger *log.Logger
 }
 
-type warpResponse struct {
-	Result warpConfig `json:"result"`
+// warpState is the state file, the registrations of the top-level account and of Accounts by position.
+type warpState struct {
+	WarpAccount
+	Accounts []*WarpAccount `json:"accounts,omitempty"`
 }
 
-func (w *Warp) verify() bool {
-	return w.Endpoint != "" && w.IPv4 != "" && w.PrivateKey != "" && w.PublicKey != ""
+// warpProfile is an account with its name in logs, index is its position in Accounts or -1 for the top-level one.
+type warpProfile struct {
+	name    string
+	index   int
+	account *WarpAccount
 }
 
-func (w *Warp) load() {
-	buf, err := os.ReadFile(".warp.json")
-	if err != nil {
-		w.apply()
-		w.save()
+func (a *WarpAccount) complete() bool {
+	return a.IPv4 != "" && a.PrivateKey != "" && a.PublicKey != ""
+}
+
+func (w *Warp) stateFile() string {
+	if w.file == "" {
+		return ".warp.json"
+	}
+	return w.file
+}
+
+// profiles lists the accounts in failover order.
+func (w *Warp) profiles() []warpProfile {
+	var profiles []warpProfile
+	if w.Auto || w.IPv4 != "" || w.PrivateKey != "" {
+		profiles = append(profiles, warpProfile{name: "default", index: -1, account: &w.WarpAccount})
+	}
+	for i, account := range w.Accounts {
+		if account != nil {
+			profiles = append(profiles, warpProfile{name: "#" + strconv.Itoa(i+1), index: i, account: account})
+		}
+	}
+	return profiles
+}
+
+// load fills the auto accounts from the state file, registering the missing ones, and saves what changed.
+func (w *Warp) load() error {
+	var state warpState
+	buf, err := os.ReadFile(w.stateFile())
+	if err == nil {
+		if err = json.Unmarshal(buf, &state); err != nil {
+			return fmt.Errorf("invalid %s: %w", w.stateFile(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	changed := w.prepare("default", &w.WarpAccount, &state.WarpAccount)
+	for i, account := range w.Accounts {
+		if account == nil {
+			continue
+		}
+		for len(state.Accounts) <= i {
+			state.Accounts = append(state.Accounts, &WarpAccount{})
+		}
+		if state.Accounts[i] == nil {
+			state.Accounts[i] = &WarpAccount{}
+		}
+		if w.prepare("#"+strconv.Itoa(i+1), account, state.Accounts[i]) {
+			changed = true
+		}
+	}
+	if changed {
+		w.save(&state)
+	}
+	return nil
+}
+
+// prepare copies the registration of an auto account from saved or registers it, then applies its license.
+func (w *Warp) prepare(name string, account, saved *WarpAccount) (changed bool) {
+	if !account.Auto || account.complete() {
+		return false
+	}
+	if saved.complete() {
+		endpoint := account.Endpoint
+		license := account.License
+		*account = *saved
+		account.Auto, account.License = true, license
+		if endpoint != "" {
+			account.Endpoint = endpoint
+		}
 	} else {
-		proxy4, proxy6 := w.Proxy4, w.Proxy6
-		_ = json.Unmarshal(buf, w)
-		w.Proxy4, w.Proxy6 = proxy4, proxy6
+		if err := w.register(account); err != nil {
+			w.logger.Errorln("Failed to apply for WARP account %s: %v", name, err)
+			return false
+		}
+		*saved = *account
+		saved.License = ""
+		changed = true
 	}
 
+	if account.License != "" && account.License != saved.License {
+		if err := w.applyLicense(account); err != nil {
+			w.logger.Errorln("Failed to apply the WARP+ license to account %s: %v", name, err)
+			return changed
+		}
+		saved.License = account.License
+		changed = true
+	}
+	return changed
 }
 
-func (w *Warp) save() {
+func (w *Warp) save(state *warpState) {
 	// 将内存中的数据静态化
-	warpFile, _ := json.MarshalIndent(w, "", "  ")
-	err := os.WriteFile(".warp.json", warpFile, 0644)
+	warpFile, _ := json.MarshalIndent(state, "", "  ")
+	err := os.WriteFile(w.stateFile(), warpFile, 0600)
 	if err != nil {
-		log.Errorln("Error writing warp config file: %v", err)
+		w.logger.Errorln("Error writing warp config file: %v", err)
 		return
 	}
 }
 
-func (w *Warp) apply() {
+// Run starts WireGuard with the first account that completes a handshake through one of its endpoints,
+// and the health monitor unless it is disabled. The monitor stops with ctx.
+func (w *Warp) Run(ctx context.Context) (cfd.DialFunc, error) {
+	if err := w.Health.validate(); err != nil {
+		return nil, err
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+
+	var profiles []warpProfile
+	for _, profile := range w.profiles() {
+		if !profile.account.complete() {
+			w.logger.Warnln("Skipping WARP account %s: ipv4, private-key and public-key are required", profile.name)
+			continue
+		}
+		profiles = append(profiles, profile)
+	}
+	if len(profiles) == 0 {
+		return nil, errors.New("no usable WARP account")
+	}
 
-	log.Infoln("Automatically applying for Warp...")
+	profile, endpoint, err := w.connect(profiles)
+	if err == nil {
+		w.logger.Infoln("WARP account %s completed a handshake with %s", profile.name, endpoint)
+	} else {
+		// 启动时可能暂时无法握手，先使用第一个可解析的端点，之后由健康检查恢复。
+		if profile, endpoint, err = firstResolvable(profiles, w.candidates); err != nil {
+			return nil, errors.New("no usable WARP account")
+		}
+		w.logger.Warnln("No WARP endpoint completed a handshake, using %s", endpoint)
+	}
+	if err = w.start(profile, endpoint); err != nil {
+		return nil, err
+	}
+	if !w.Health.disabled() {
+		go w.monitor(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		w.close()
+	}()
+	return w.dial, nil
+}
 
-	url := "https://api.cloudflareclient.com/v0a2223/reg"
+// connect probes the endpoints of the profiles in order and returns the first one to complete a handshake.
+func (w *Warp) connect(profiles []warpProfile) (warpProfile, string, error) {
+	for _, profile := range profiles {
+		endpoint, err := w.probe(profile.account, w.candidates(profile.account))
+		if err == nil {
+			return profile, endpoint, nil
+		}
+		w.logger.Warnln("WARP account %s: %v", profile.name, err)
+	}
+	return warpProfile{}, "", errors.New("no WARP account completed a handshake")
+}
 
-	privateKey := NewPrivateKey()
-	// 请求头
-	headers := map[string]string{
-		"CF-Client-Version": "a-6.11-2223",
-		"Host":              "api.cloudflareclient.com",
-		"Connection":        "Keep-Alive",
-		"Accept-Encoding":   "gzip",
-		"User-Agent":        "okhttp/3.12.1",
-		"Content-Type":      "application/json",
+// firstResolvable returns the first profile whose first candidate endpoint resolves.
+func firstResolvable(profiles []warpProfile, candidates func(*WarpAccount) []string) (warpProfile, string, error) {
+	var lastErr error
+	for _, profile := range profiles {
+		endpoint, err := resolveEndpoint(candidates(profile.account)[0])
+		if err == nil {
+			return profile, endpoint, nil
+		}
+		lastErr = err
 	}
+	return warpProfile{}, "", lastErr
+}
 
-	jsonData, _ := json.Marshal(map[string]string{
-		"key":    privateKey.Public().String(),
-		"locale": "en-US",
-		"tos":    time.Now().Format(time.RFC3339Nano),
-	})
+// candidates lists the endpoint of the account followed by the configured or default endpoints.
+func (w *Warp) candidates(account *WarpAccount) []string {
+	endpoints := w.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = defaultWarpEndpoints
+	}
+	candidates := make([]string, 0, len(endpoints)+1)
+	if account.Endpoint != "" {
+		candidates = append(candidates, account.Endpoint)
+	}
+	for _, endpoint := range endpoints {
+		if endpoint != account.Endpoint {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	return candidates
+}
 
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+// probe tries the endpoints concurrently and returns the resolved address of the first one to complete a handshake.
+func (w *Warp) probe(account *WarpAccount, endpoints []string) (string, error) {
+	found := make(chan string, len(endpoints))
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, endpoint := range endpoints {
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			addr, err := account.handshake(endpoint, done)
+			if err != nil {
+				w.logger.Debugln("WARP endpoint %s: %v", endpoint, err)
+				return
+			}
+			found <- addr
+		}(endpoint)
+	}
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
 
-	for key, value := range headers {
-		req.Header.Set(key, value)
+	addr, ok := <-found
+	// 等待其余探测设备关闭，避免与正式设备争用同一账户的会话。
+	close(done)
+	wg.Wait()
+	if !ok {
+		return "", fmt.Errorf("none of %d endpoints completed a handshake", len(endpoints))
 	}
+	return addr, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// handshake brings up a throwaway device for endpoint and waits for its first handshake.
+func (a *WarpAccount) handshake(endpoint string, done <-chan struct{}) (string, error) {
+	addr, err := resolveEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	dev, _, peer, err := a.device(0, addr, device.LogLevelSilent)
 	if err != nil {
-		log.Fatalln("A request error occurred while automatically applying for Warp.: %v", err)
+		return "", err
+	}
+	defer dev.Close()
+	if err = dev.Up(); err != nil {
+		return "", err
+	}
+	if err = peer.SendHandshakeInitiation(false); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	var reader io.ReadCloser
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		reader, _ = gzip.NewReader(resp.Body)
-		defer reader.Close()
-	} else {
-		reader = resp.Body
+	timeout := time.NewTimer(warpHandshakeWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !deviceState(dev).LastHandshake.IsZero() {
+				return addr, nil
+			}
+		case <-timeout.C:
+			return "", fmt.Errorf("no handshake within %s", warpHandshakeWait)
+		case <-done:
+			return "", errors.New("canceled")
+		}
 	}
+}
 
-	body, _ := io.ReadAll(reader)
-	var warpResp warpResponse
-	if err := json.Unmarshal(body, &warpResp); err != nil {
-		log.Fatalln("Failed to parse warp response: %v", err)
+// device creates a WireGuard device of the account on a netstack with a single peer at endpoint.
+func (a *WarpAccount) device(port uint16, endpoint string, logLevel int) (*device.Device, *netstack.Net, *device.Peer, error) {
+	i := &wgInterface{mtu: defaultWireGuardMTU, port: port, reserved: a.Reserved}
+	var err error
+	if i.privateKey, err = ParseKey(a.PrivateKey); err != nil {
+		return nil, nil, nil, errors.New("invalid private-key")
 	}
-	clientID := warpResp.Result.Config.ClientID
-	ipv6 := warpResp.Result.Config.Interface.Addresses.V6
-	if ipv6 == "" {
-		log.Fatalln("Failed to automatically apply for Warp.")
+	peer := &wgPeer{
+		endpoint:   endpoint,
+		allowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
 	}
+	if peer.publicKey, err = ParseKey(a.PublicKey); err != nil {
+		return nil, nil, nil, errors.New("invalid public-key")
+	}
+	i.peers = []*wgPeer{peer}
 
-	w.Reserved, _ = base64.StdEncoding.DecodeString(clientID)
-	w.IPv4 = "172.16.0.2"
-	w.IPv6 = ipv6
-	w.PrivateKey = privateKey.String()
-	w.PublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
-	w.Endpoint = "engage.cloudflareclient.com:2408"
+	for _, s := range []string{a.IPv4, a.IPv6} {
+		if s == "" {
+			continue
+		}
+		s, _, _ = strings.Cut(s, "/")
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid address: %q", s)
+		}
+		i.addresses = append(i.addresses, addr)
+	}
 
-	log.Infoln("Warp has been successfully applied.")
+	dev, tnet, err := i.device(logLevel)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return dev, tnet, dev.LookupPeer(device.NoisePublicKey(*peer.publicKey)), nil
 }
 
-func (w *Warp) Run() cfd.DialFunc {
+// start replaces the running device with one of the account of profile at endpoint.
+func (w *Warp) start(profile warpProfile, endpoint string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return errors.New("warp is stopped")
+	}
+	if w.dev != nil {
+		// 先关闭旧设备以释放监听端口。
+		w.dev.Close()
+		w.dev, w.tnet = nil, nil
+	}
+	dev, tnet, _, err := profile.account.device(w.Port, endpoint, device.LogLevelError)
+	if err != nil {
+		return err
+	}
+	w.dev, w.tnet = dev, tnet
+	w.profile, w.endpoint = profile, endpoint
+	return nil
+}
 
-	if w.Auto {
-		w.load()
-	} else if !w.verify() {
-		log.Fatalln("The warp parameter is incorrect.")
+// close stops the running device when the tunnel stops.
+func (w *Warp) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.dev != nil {
+		w.dev.Close()
+		w.dev, w.tnet = nil, nil
 	}
+}
 
-	if strings.Contains(w.IPv4, "/") {
-		w.IPv4 = strings.Split(w.IPv4, "/")[0]
+// dial connects through the running device, or directly while falling back.
+func (w *Warp) dial(network, address string) (net.Conn, error) {
+	w.mu.RLock()
+	tnet, fallback := w.tnet, w.fallback
+	w.mu.RUnlock()
+	if fallback {
+		return net.Dial(network, address)
 	}
-	if strings.Contains(w.IPv6, "/") {
-		w.IPv6 = strings.Split(w.IPv6, "/")[0]
+	if tnet == nil {
+		return nil, errors.New("warp is not running")
 	}
+	return tnet.Dial(network, address)
+}
 
-	localAddress := []netip.Addr{netip.MustParseAddr(w.IPv4)}
-	if w.IPv6 != "" {
-		localAddress = append(localAddress, netip.MustParseAddr(w.IPv6))
+// State reads the handshake time and traffic of the WARP peer along with the health of the tunnel.
+func (w *Warp) State() cfd.WarpState {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	var state cfd.WarpState
+	if w.dev != nil {
+		state = deviceState(w.dev)
 	}
-	tunDev, tnet, err := netstack.CreateNetTUN(
-		localAddress,
-		[]netip.Addr{},
-		1280,
-	)
+	state.Healthy = w.dev != nil && !w.unhealthy
+	state.Fallback = w.fallback
+	state.Account = w.profile.name
+	state.Endpoint = w.endpoint
+	state.LastProbe = w.lastProbe
+	state.LastError = w.lastError
+	return state
+}
+
+func deviceState(dev *device.Device) cfd.WarpState {
+	var state cfd.WarpState
+	ipc, err := dev.IpcGet()
 	if err != nil {
-		log.Fatalln(err.Error())
+		return state
 	}
-
-	bind := conn.NewStdNetBind()
-	if w.Reserved != nil {
-		bind.(*conn.StdNetBind).SetReserved(w.Reserved)
+	var sec, nsec int64
+	for _, line := range strings.Split(ipc, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseUint(value, 10, 64)
+		switch key {
+		case "last_handshake_time_sec":
+			sec = int64(n)
+		case "last_handshake_time_nsec":
+			nsec = int64(n)
+		case "rx_bytes":
+			state.RxBytes += n
+		case "tx_bytes":
+			state.TxBytes += n
+		}
 	}
-	logger := device.NewLogger(1, "")
-	dev := device.NewDevice(tunDev, bind, logger)
-	dev.SetPort(w.Port)
-	dev.SetPrivateKey(w.PrivateKey)
-	peer := dev.SetPublicKey(w.PublicKey)
-
-	dev.SetEndpoint(peer, resolvEndpoint(w.Endpoint)).SetAllowedIP(peer)
-	peer.HandlePostConfig()
-	return tnet.Dial
+	if sec != 0 || nsec != 0 {
+		state.LastHandshake = time.Unix(sec, nsec)
+	}
+	return state
 }
 
-func resolvEndpoint(endpoint string) string {
-	c, _ := net.DialTimeout("udp", endpoint, 3*time.Second)
-	if c != nil {
-		_ = c.Close()
-		return c.RemoteAddr().String()
+// resolveEndpoint picks the address of endpoint that the host can route to.
+func resolveEndpoint(endpoint string) (string, error) {
+	c, err := net.DialTimeout("udp", endpoint, 3*time.Second)
+	if err != nil {
+		return "", err
 	}
-	return "162.159.192.1:2408"
+	_ = c.Close()
+	return c.RemoteAddr().String(), nil
 }
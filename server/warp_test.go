@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"golang.zx2c4.com/wireguard/device"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// warpAPI serves handler as the registration API of w and stores the state file in a temporary directory.
+func warpAPI(t *testing.T, handler http.HandlerFunc) *Warp {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	return &Warp{API: ts.URL, file: filepath.Join(t.TempDir(), ".warp.json")}
+}
+
+// noAPI fails the test when the registration API is called.
+func noAPI(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected API call: %s %s", r.Method, r.URL.Path)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	}
+}
+
+func TestWarpRegister(t *testing.T) {
+	w := warpAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/reg" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("CF-Client-Version") != defaultWarpClientVersion || r.Header.Get("User-Agent") != defaultWarpUserAgent {
+			t.Errorf("CF-Client-Version %q, User-Agent %q", r.Header.Get("CF-Client-Version"), r.Header.Get("User-Agent"))
+		}
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if _, err := ParseKey(body["key"]); err != nil {
+			t.Errorf("invalid public key %q: %v", body["key"], err)
+		}
+		_, _ = io.WriteString(w, `{"result": {"id": "reg-id", "token": "reg-token", "config": {
+			"client_id": "AQID",
+			"peers": [{"public_key": "`+warpPublicKey+`", "endpoint": {"host": "engage.example:2408"}}],
+			"interface": {"addresses": {"v4": "172.16.0.9", "v6": "2606:4700:110::9"}}}}}`)
+	})
+
+	account := &WarpAccount{Auto: true}
+	if err := w.register(account); err != nil {
+		t.Fatal(err)
+	}
+	if !account.complete() {
+		t.Fatalf("incomplete account: %+v", account)
+	}
+	if account.IPv4 != "172.16.0.9" || account.IPv6 != "2606:4700:110::9" || account.Endpoint != "engage.example:2408" {
+		t.Fatalf("unexpected addresses: %+v", account)
+	}
+	if string(account.Reserved) != "\x01\x02\x03" {
+		t.Fatalf("reserved %v, want the decoded client_id", account.Reserved)
+	}
+	if account.ID != "reg-id" || account.Token != "reg-token" {
+		t.Fatalf("id %q and token %q were not kept", account.ID, account.Token)
+	}
+}
+
+func TestWarpRegisterErrors(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		"status": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+		},
+		"no address": func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, `{"id": "reg-id", "config": {}}`)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			account := &WarpAccount{Auto: true}
+			if err := warpAPI(t, handler).register(account); err == nil {
+				t.Fatal("expected an error")
+			}
+			if account.complete() {
+				t.Fatal("a failed registration filled the account")
+			}
+		})
+	}
+}
+
+func TestWarpClientHeaders(t *testing.T) {
+	w := warpAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("CF-Client-Version") != "a-7.0-1234" || r.Header.Get("User-Agent") != "okhttp/4.12.0" {
+			t.Errorf("CF-Client-Version %q, User-Agent %q", r.Header.Get("CF-Client-Version"), r.Header.Get("User-Agent"))
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	w.ClientVersion = "a-7.0-1234"
+	w.UserAgent = "okhttp/4.12.0"
+	if err := w.register(&WarpAccount{Auto: true}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestWarpApplyLicense(t *testing.T) {
+	var calls atomic.Int32
+	w := warpAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Method != http.MethodPut || r.URL.Path != "/reg/reg-id/account" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer reg-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body["license"] != "license-key" {
+			http.Error(w, "invalid license", http.StatusBadRequest)
+			return
+		}
+		_, _ = io.WriteString(w, `{"result": {"account_type": "limited"}}`)
+	})
+
+	if err := w.applyLicense(&WarpAccount{ID: "reg-id", Token: "reg-token", License: "license-key"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.applyLicense(&WarpAccount{ID: "reg-id", Token: "other", License: "license-key"}); err == nil {
+		t.Fatal("a rejected license was reported as applied")
+	}
+	before := calls.Load()
+	if err := w.applyLicense(&WarpAccount{License: "license-key"}); err == nil {
+		t.Fatal("a license was applied without id and token")
+	}
+	if calls.Load() != before {
+		t.Fatal("the API was called without id and token")
+	}
+}
+
+// TestWarpLoadMigratesStateFile reads a .warp.json written before accounts existed, which holds the
+// top-level account only, and applies a license added since.
+func TestWarpLoadMigratesStateFile(t *testing.T) {
+	var licensed atomic.Bool
+	w := warpAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == "/reg/old-id/account" {
+			licensed.Store(true)
+			_, _ = io.WriteString(w, `{"account_type": "limited"}`)
+			return
+		}
+		t.Errorf("unexpected API call: %s %s", r.Method, r.URL.Path)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	})
+	old := WarpAccount{
+		Endpoint:   "engage.example:2408",
+		IPv4:       "172.16.0.2",
+		IPv6:       "2606:4700:110::2",
+		PrivateKey: NewPrivateKey().String(),
+		PublicKey:  warpPublicKey,
+		Reserved:   []byte{1, 2, 3},
+		ID:         "old-id",
+		Token:      "old-token",
+	}
+	buf, _ := json.Marshal(old)
+	if err := os.WriteFile(w.stateFile(), buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Auto, w.License = true, "license-key"
+	if err := w.load(); err != nil {
+		t.Fatal(err)
+	}
+	if w.PrivateKey != old.PrivateKey || w.IPv6 != old.IPv6 || string(w.Reserved) != "\x01\x02\x03" {
+		t.Fatalf("the saved account was not loaded: %+v", w.WarpAccount)
+	}
+	if !w.Auto || w.License != "license-key" {
+		t.Fatal("the configured auto and license were overwritten")
+	}
+	if !licensed.Load() {
+		t.Fatal("the new license was not applied")
+	}
+
+	var state warpState
+	buf, _ = os.ReadFile(w.stateFile())
+	if err := json.Unmarshal(buf, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.PrivateKey != old.PrivateKey || state.License != "license-key" {
+		t.Fatalf("the state file was not updated: %s", buf)
+	}
+}
+
+// freeUDPPort returns a loopback UDP port nothing listens on.
+func freeUDPPort(t *testing.T) uint16 {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return uint16(c.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// wireguardPeer brings up a WireGuard interface at 10.9.0.1 accepting client from 10.9.0.2, it returns
+// its public key and endpoint.
+func wireguardPeer(t *testing.T, client *Key, psk *Key) (*Key, string) {
+	t.Helper()
+	private := NewPrivateKey()
+	port := freeUDPPort(t)
+	i := &wgInterface{
+		privateKey: private,
+		addresses:  []netip.Addr{netip.MustParseAddr("10.9.0.1")},
+		mtu:        defaultWireGuardMTU,
+		port:       port,
+		peers: []*wgPeer{{
+			publicKey:    client,
+			presharedKey: psk,
+			allowedIPs:   []netip.Prefix{netip.MustParsePrefix("10.9.0.2/32")},
+		}},
+	}
+	dev, tnet, err := i.device(device.LogLevelSilent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(dev.Close)
+
+	l, err := tnet.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.WriteString(c, "peer")
+			_ = c.Close()
+		}
+	}()
+	return private.Public(), "127.0.0.1:" + strconv.Itoa(int(port))
+}
+
+func TestWarpRunFailsOver(t *testing.T) {
+	saved := warpHandshakeWait
+	warpHandshakeWait = time.Second
+	t.Cleanup(func() { warpHandshakeWait = saved })
+
+	private := NewPrivateKey()
+	peer, endpoint := wireguardPeer(t, private.Public(), nil)
+	dead := "127.0.0.1:" + strconv.Itoa(int(freeUDPPort(t)))
+
+	w := warpAPI(t, noAPI(t))
+	w.Health = &WarpHealth{Disable: true}
+	w.Endpoints = []string{dead}
+	w.Accounts = []*WarpAccount{
+		// 第一个账户的端点无法握手，应切换到第二个账户。
+		{IPv4: "10.9.0.2", PrivateKey: NewPrivateKey().String(), PublicKey: peer.String(), Endpoint: dead},
+		{IPv4: "10.9.0.2", PrivateKey: private.String(), PublicKey: peer.String(), Endpoint: endpoint},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dial, err := w.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := w.State(); state.Account != "#2" || state.Endpoint != endpoint {
+		t.Fatalf("running account %s at %s, want #2 at %s", state.Account, state.Endpoint, endpoint)
+	}
+
+	c, err := dial("tcp", "10.9.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, _ := io.ReadAll(c)
+	if !strings.Contains(string(got), "peer") {
+		t.Fatalf("read %q through WARP", got)
+	}
+
+	// 隧道停止后设备随之关闭。
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for w.State().Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("the device was not closed when the tunnel stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err = dial("tcp", "10.9.0.1:80"); err == nil {
+		t.Fatal("dialed through a closed device")
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWarpAPI           = "https://api.cloudflareclient.com/v0a2223"
+	defaultWarpClientVersion = "a-6.11-2223"
+	defaultWarpUserAgent     = "okhttp/3.12.1"
+)
+
+var warpClient = &http.Client{Timeout: 30 * time.Second}
+
+type warpRegistration struct {
+	ID     string `json:"id"`
+	Token  string `json:"token"`
+	Config struct {
+		ClientID string `json:"client_id"`
+		Peers    []struct {
+			PublicKey string `json:"public_key"`
+			Endpoint  struct {
+				Host string `json:"host"`
+			} `json:"endpoint"`
+		} `json:"peers"`
+		Interface struct {
+			Addresses struct {
+				V4 string `json:"v4"`
+				V6 string `json:"v6"`
+			} `json:"addresses"`
+		} `json:"interface"`
+	} `json:"config"`
+}
+
+// warpResponse accepts the registration either at the top level or wrapped in result.
+type warpResponse struct {
+	warpRegistration
+	Result *warpRegistration `json:"result"`
+}
+
+func (r *warpResponse) registration() *warpRegistration {
+	if r.Result != nil {
+		return r.Result
+	}
+	return &r.warpRegistration
+}
+
+func (w *Warp) api() string {
+	if w.API == "" {
+		return defaultWarpAPI
+	}
+	return strings.TrimSuffix(w.API, "/")
+}
+
+func (w *Warp) clientVersion() string {
+	if w.ClientVersion == "" {
+		return defaultWarpClientVersion
+	}
+	return w.ClientVersion
+}
+
+func (w *Warp) userAgent() string {
+	if w.UserAgent == "" {
+		return defaultWarpUserAgent
+	}
+	return w.UserAgent
+}
+
+// request sends body as JSON to the registration API and decodes the response into out.
+func (w *Warp) request(method, path, token string, body, out any) error {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest(method, w.api()+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("CF-Client-Version", w.clientVersion())
+	req.Header.Set("User-Agent", w.userAgent())
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := warpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// register applies for a new anonymous account and stores its registration in account.
+func (w *Warp) register(account *WarpAccount) error {
+	w.logger.Infoln("Automatically applying for Warp...")
+
+	privateKey := NewPrivateKey()
+	var resp warpResponse
+	err := w.request(http.MethodPost, "/reg", "", map[string]string{
+		"key":    privateKey.Public().String(),
+		"locale": "en-US",
+		"tos":    time.Now().Format(time.RFC3339Nano),
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	reg := resp.registration()
+	addresses := reg.Config.Interface.Addresses
+	if addresses.V6 == "" {
+		return errors.New("the registration returned no address")
+	}
+
+	account.Reserved, _ = base64.StdEncoding.DecodeString(reg.Config.ClientID)
+	account.IPv4 = addresses.V4
+	if account.IPv4 == "" {
+		account.IPv4 = warpIPv4
+	}
+	account.IPv6 = addresses.V6
+	account.PrivateKey = privateKey.String()
+	account.PublicKey = warpPublicKey
+	endpoint := warpEndpoint
+	if len(reg.Config.Peers) > 0 {
+		peer := reg.Config.Peers[0]
+		if peer.PublicKey != "" {
+			account.PublicKey = peer.PublicKey
+		}
+		if peer.Endpoint.Host != "" {
+			endpoint = peer.Endpoint.Host
+		}
+	}
+	if account.Endpoint == "" {
+		account.Endpoint = endpoint
+	}
+	account.ID, account.Token = reg.ID, reg.Token
+
+	w.logger.Infoln("Warp has been successfully applied.")
+	return nil
+}
+
+// applyLicense binds the WARP+ license of account to its registration.
+func (w *Warp) applyLicense(account *WarpAccount) error {
+	if account.ID == "" || account.Token == "" {
+		return fmt.Errorf("the account was registered without id and token, remove %s to register again", w.stateFile())
+	}
+	var resp struct {
+		AccountType string `json:"account_type"`
+		Result      *struct {
+			AccountType string `json:"account_type"`
+		} `json:"result"`
+	}
+	err := w.request(http.MethodPut, "/reg/"+account.ID+"/account", account.Token, map[string]string{
+		"license": account.License,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	accountType := resp.AccountType
+	if resp.Result != nil {
+		accountType = resp.Result.AccountType
+	}
+	w.logger.Infoln("WARP+ license applied, account type: %s", accountType)
+	return nil
+}
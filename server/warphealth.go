@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWarpHealthInterval = 30
+	defaultWarpHealthProbe    = "1.1.1.1:443"
+
+	warpProbeTimeout = 5 * time.Second
+	// warpUnhealthyAfter consecutive failed probes start the recovery.
+	warpUnhealthyAfter = 2
+	// warpReregisterWait limits how often an auto account is registered again.
+	warpReregisterWait = time.Hour
+)
+
+// WarpHealth probes a TCP address through the tunnel every interval. After consecutive failures the tunnel
+// is recovered by switching endpoints, then accounts, then registering an auto account again. When nothing
+// works, fallback direct sends the WARP traffic directly until a probe succeeds again.
+type WarpHealth struct {
+	Disable  bool   `yaml:"disable" json:"disable"`
+	Interval int    `yaml:"interval" json:"interval"`
+	Probe    string `yaml:"probe" json:"probe"`
+	Fallback string `yaml:"fallback" json:"fallback"`
+}
+
+func (h *WarpHealth) validate() error {
+	if h == nil {
+		return nil
+	}
+	switch strings.ToLower(h.Fallback) {
+	case "", "none", OutboundDirect:
+	default:
+		return fmt.Errorf("invalid warp health fallback: %q", h.Fallback)
+	}
+	if h.Probe != "" {
+		if _, err := netip.ParseAddrPort(h.Probe); err != nil {
+			return fmt.Errorf("invalid warp health probe, ip:port is required: %q", h.Probe)
+		}
+	}
+	return nil
+}
+
+func (h *WarpHealth) disabled() bool {
+	return h != nil && h.Disable
+}
+
+func (h *WarpHealth) interval() time.Duration {
+	if h == nil || h.Interval <= 0 {
+		return defaultWarpHealthInterval * time.Second
+	}
+	return time.Duration(h.Interval) * time.Second
+}
+
+func (h *WarpHealth) probe() netip.AddrPort {
+	if h == nil || h.Probe == "" {
+		return netip.MustParseAddrPort(defaultWarpHealthProbe)
+	}
+	return netip.MustParseAddrPort(h.Probe)
+}
+
+func (h *WarpHealth) fallbackDirect() bool {
+	return h != nil && strings.ToLower(h.Fallback) == OutboundDirect
+}
+
+// monitor probes the tunnel until ctx is done and recovers it when it becomes unhealthy.
+func (w *Warp) monitor(ctx context.Context) {
+	probe := w.Health.probe()
+	ticker := time.NewTicker(w.Health.interval())
+	defer ticker.Stop()
+
+	var failures int
+	var reregistered time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := w.check(probe)
+		w.mu.Lock()
+		w.lastProbe, w.lastError = time.Now(), ""
+		if err != nil {
+			w.lastError = err.Error()
+		}
+		w.mu.Unlock()
+
+		if err == nil {
+			if failures >= warpUnhealthyAfter {
+				w.healthy()
+			}
+			failures = 0
+			continue
+		}
+		failures++
+		w.logger.Warnln("WARP health check failed: %v", err)
+		if failures < warpUnhealthyAfter {
+			continue
+		}
+		if failures == warpUnhealthyAfter {
+			w.logger.Errorln("WARP is unhealthy, recovering")
+			w.mu.Lock()
+			w.unhealthy = true
+			w.mu.Unlock()
+		}
+
+		if err = w.recover(&reregistered); err != nil {
+			w.logger.Errorln("Failed to recover WARP: %v", err)
+			w.mu.Lock()
+			fallback := !w.fallback && w.Health.fallbackDirect()
+			if fallback {
+				w.fallback = true
+			}
+			w.mu.Unlock()
+			if fallback {
+				w.logger.Warnln("WARP traffic goes directly until WARP recovers")
+			}
+			continue
+		}
+		failures = 0
+		w.healthy()
+	}
+}
+
+// healthy clears the unhealthy state and the fallback.
+func (w *Warp) healthy() {
+	w.mu.Lock()
+	fallback := w.fallback
+	w.unhealthy, w.fallback = false, false
+	w.mu.Unlock()
+	if fallback {
+		w.logger.Infoln("WARP is healthy again, WARP traffic goes through WARP")
+		return
+	}
+	w.logger.Infoln("WARP is healthy again")
+}
+
+// check opens a TCP connection to probe through the running device.
+func (w *Warp) check(probe netip.AddrPort) error {
+	w.mu.RLock()
+	tnet := w.tnet
+	w.mu.RUnlock()
+	if tnet == nil {
+		return errors.New("warp is not running")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), warpProbeTimeout)
+	defer cancel()
+	c, err := tnet.DialContextTCPAddrPort(ctx, probe)
+	if err != nil {
+		return err
+	}
+	_ = c.Close()
+	return nil
+}
+
+// recover restarts the device with the first endpoint completing a handshake, trying the current account
+// before the others. When none does, an auto current account is registered again at most once per
+// warpReregisterWait, as Cloudflare may have dropped the registration.
+func (w *Warp) recover(reregistered *time.Time) error {
+	w.mu.RLock()
+	current := w.profile
+	w.mu.RUnlock()
+
+	profiles := []warpProfile{current}
+	for _, profile := range w.profiles() {
+		if profile.account != current.account && profile.account.complete() {
+			profiles = append(profiles, profile)
+		}
+	}
+	profile, endpoint, err := w.connect(profiles)
+	if err == nil {
+		if err = w.start(profile, endpoint); err != nil {
+			return err
+		}
+		w.logger.Infoln("WARP switched to account %s through %s", profile.name, endpoint)
+		return nil
+	}
+
+	if !current.account.Auto || time.Since(*reregistered) < warpReregisterWait {
+		return err
+	}
+	*reregistered = time.Now()
+	w.logger.Warnln("Registering WARP account %s again", current.name)
+	account := &WarpAccount{Auto: true, License: current.account.License}
+	saved := &WarpAccount{}
+	w.prepare(current.name, account, saved)
+	if !account.complete() {
+		return fmt.Errorf("failed to register WARP account %s again", current.name)
+	}
+	if endpoint, err = w.probe(account, w.candidates(account)); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	*current.account = *account
+	w.mu.Unlock()
+	w.saveAccount(current.index, saved)
+	if err = w.start(current, endpoint); err != nil {
+		return err
+	}
+	w.logger.Infoln("WARP account %s registered again, using %s", current.name, endpoint)
+	return nil
+}
+
+// saveAccount replaces the registration at index in the state file, -1 being the top-level account.
+func (w *Warp) saveAccount(index int, account *WarpAccount) {
+	var state warpState
+	if buf, err := os.ReadFile(w.stateFile()); err == nil {
+		_ = json.Unmarshal(buf, &state)
+	}
+	if index < 0 {
+		state.WarpAccount = *account
+	} else {
+		for len(state.Accounts) <= index {
+			state.Accounts = append(state.Accounts, &WarpAccount{})
+		}
+		state.Accounts[index] = account
+	}
+	w.save(&state)
+}
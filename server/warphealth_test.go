@@ -0,0 +1,23 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWarpMonitorStopsWithContext(t *testing.T) {
+	w := &Warp{Health: &WarpHealth{Interval: 1}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.monitor(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the monitor kept running after the tunnel stopped")
+	}
+}
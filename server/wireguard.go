@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fmnx/cftun/server/cfd"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	OutboundWireGuard = "wireguard"
+
+	defaultWireGuardMTU = 1280
+)
+
+// WireGuard is a userspace WireGuard interface used as an egress outbound. Config imports a wg-quick or wgcf
+// profile, the other fields override it.
+type WireGuard struct {
+	Name       string           `yaml:"name" json:"name"`
+	Config     string           `yaml:"config" json:"config"`
+	PrivateKey string           `yaml:"private-key" json:"private-key"`
+	Address    []string         `yaml:"address" json:"address"`
+	DNS        []string         `yaml:"dns" json:"dns"`
+	MTU        int              `yaml:"mtu" json:"mtu"`
+	Port       uint16           `yaml:"port" json:"port"`
+	Reserved   []byte           `yaml:"reserved" json:"reserved"`
+	Peers      []*WireGuardPeer `yaml:"peers" json:"peers"`
+	// LocalProxy also serves the interface to the host.
+	LocalProxy *LocalProxy `yaml:"local-proxy" json:"local-proxy"`
+
+	// dev is the running device, closed when the tunnel stops.
+	dev *device.Device
+}
+
+type WireGuardPeer struct {
+	PublicKey           string   `yaml:"public-key" json:"public-key"`
+	PresharedKey        string   `yaml:"preshared-key" json:"preshared-key"`
+	Endpoint            string   `yaml:"endpoint" json:"endpoint"`
+	AllowedIPs          []string `yaml:"allowed-ips" json:"allowed-ips"`
+	PersistentKeepalive int      `yaml:"persistent-keepalive" json:"persistent-keepalive"`
+}
+
+// wgInterface is a WireGuard interface ready to be brought up on a netstack.
+type wgInterface struct {
+	privateKey *Key
+	addresses  []netip.Addr
+	dns        []netip.Addr
+	mtu        int
+	port       uint16
+	reserved   []byte
+	peers      []*wgPeer
+}
+
+type wgPeer struct {
+	publicKey    *Key
+	presharedKey *Key
+	// endpoint is an ip:port, WireGuard does not resolve host names.
+	endpoint   string
+	allowedIPs []netip.Prefix
+	keepalive  int
+}
+
+// device creates the WireGuard device of the interface on a netstack.
+func (i *wgInterface) device(logLevel int) (*device.Device, *netstack.Net, error) {
+	tunDev, tnet, err := netstack.CreateNetTUN(i.addresses, i.dns, i.mtu)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bind := conn.NewStdNetBind()
+	if i.reserved != nil {
+		bind.(*conn.StdNetBind).SetReserved(i.reserved)
+	}
+	dev := device.NewDevice(tunDev, bind, device.NewLogger(logLevel, ""))
+
+	var b strings.Builder
+	// 该 wireguard-go 分支的 private_key 使用 base64，其余密钥仍为 hex。
+	fmt.Fprintf(&b, "private_key=%s\nlisten_port=%d\n", i.privateKey, i.port)
+	for _, peer := range i.peers {
+		fmt.Fprintf(&b, "public_key=%s\n", peer.publicKey.Hex())
+		if peer.presharedKey != nil {
+			fmt.Fprintf(&b, "preshared_key=%s\n", peer.presharedKey.Hex())
+		}
+		if peer.endpoint != "" {
+			fmt.Fprintf(&b, "endpoint=%s\n", peer.endpoint)
+		}
+		if peer.keepalive > 0 {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", peer.keepalive)
+		}
+		for _, prefix := range peer.allowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", prefix)
+		}
+	}
+	if err = dev.IpcSet(b.String()); err != nil {
+		dev.Close()
+		return nil, nil, err
+	}
+	return dev, tnet, nil
+}
+
+// Run brings up the interface until ctx is done and returns its outbound. Host names are resolved through the
+// dns of the interface when it has one, before dialing otherwise.
+func (wg *WireGuard) Run(ctx context.Context) (*cfd.Outbound, error) {
+	i, err := wg.build()
+	if err != nil {
+		return nil, err
+	}
+	dev, tnet, err := i.device(device.LogLevelError)
+	if err != nil {
+		return nil, err
+	}
+	wg.dev = dev
+	go func() {
+		<-ctx.Done()
+		wg.dev.Close()
+	}()
+	return &cfd.Outbound{
+		Name:      OutboundWireGuard + " " + wg.Name,
+		Dial:      tnet.Dial,
+		Resolve:   len(i.dns) == 0,
+		RemoteDNS: len(i.dns) > 0,
+	}, nil
+}
+
+// build merges the imported config with the fields and checks the result.
+func (wg *WireGuard) build() (*wgInterface, error) {
+	merged := *wg
+	if wg.Config != "" {
+		imported, err := loadWireGuardConfig(wg.Config)
+		if err != nil {
+			return nil, err
+		}
+		merged = *imported
+		if wg.PrivateKey != "" {
+			merged.PrivateKey = wg.PrivateKey
+		}
+		if len(wg.Address) > 0 {
+			merged.Address = wg.Address
+		}
+		if len(wg.DNS) > 0 {
+			merged.DNS = wg.DNS
+		}
+		if wg.MTU != 0 {
+			merged.MTU = wg.MTU
+		}
+		if wg.Port != 0 {
+			merged.Port = wg.Port
+		}
+		if wg.Reserved != nil {
+			merged.Reserved = wg.Reserved
+		}
+		if len(wg.Peers) > 0 {
+			merged.Peers = wg.Peers
+		}
+	}
+
+	i := &wgInterface{mtu: merged.MTU, port: merged.Port, reserved: merged.Reserved}
+	var err error
+	if i.privateKey, err = ParseKey(merged.PrivateKey); err != nil {
+		return nil, fmt.Errorf("invalid private-key: %w", err)
+	}
+	if i.mtu == 0 {
+		i.mtu = defaultWireGuardMTU
+	}
+	if i.mtu < 576 || i.mtu > 65535 {
+		return nil, fmt.Errorf("invalid mtu: %d", i.mtu)
+	}
+	if i.reserved != nil && len(i.reserved) != 3 {
+		return nil, errors.New("reserved must be 3 bytes")
+	}
+
+	for _, s := range merged.Address {
+		// 地址可以带前缀长度，如 10.0.0.2/32。
+		s, _, _ = strings.Cut(s, "/")
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %q", s)
+		}
+		i.addresses = append(i.addresses, addr.Unmap())
+	}
+	if len(i.addresses) == 0 {
+		return nil, errors.New("address is required")
+	}
+	for _, s := range merged.DNS {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns: %q", s)
+		}
+		i.dns = append(i.dns, addr.Unmap())
+	}
+
+	if len(merged.Peers) == 0 {
+		return nil, errors.New("at least one peer is required")
+	}
+	for _, p := range merged.Peers {
+		peer, err := p.build()
+		if err != nil {
+			return nil, err
+		}
+		i.peers = append(i.peers, peer)
+	}
+	return i, nil
+}
+
+func (p *WireGuardPeer) build() (*wgPeer, error) {
+	peer := &wgPeer{keepalive: p.PersistentKeepalive}
+	var err error
+	if peer.publicKey, err = ParseKey(p.PublicKey); err != nil {
+		return nil, fmt.Errorf("invalid peer public-key: %w", err)
+	}
+	if p.PresharedKey != "" {
+		if peer.presharedKey, err = ParseKey(p.PresharedKey); err != nil {
+			return nil, fmt.Errorf("invalid peer preshared-key: %w", err)
+		}
+	}
+	if p.Endpoint != "" {
+		if peer.endpoint, err = resolveEndpoint(p.Endpoint); err != nil {
+			return nil, fmt.Errorf("invalid peer endpoint %s: %w", p.Endpoint, err)
+		}
+	}
+	if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+		return nil, fmt.Errorf("invalid peer persistent-keepalive: %d", p.PersistentKeepalive)
+	}
+
+	allowedIPs := p.AllowedIPs
+	if len(allowedIPs) == 0 {
+		allowedIPs = []string{"0.0.0.0/0", "::/0"}
+	}
+	for _, s := range allowedIPs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer allowed-ips: %q", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		peer.allowedIPs = append(peer.allowedIPs, prefix.Masked())
+	}
+	return peer, nil
+}
+
+// loadWireGuardConfig reads the [Interface] and [Peer] sections of a wg-quick config, such as a wgcf profile.
+// Keys only wg-quick uses, e.g. Table or PostUp, are ignored.
+func loadWireGuardConfig(path string) (*WireGuard, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	wg := &WireGuard{}
+	var peer *WireGuardPeer
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				peer = &WireGuardPeer{}
+				wg.Peers = append(wg.Peers, peer)
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown section [%s]", path, n, section)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: invalid line", path, n)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch section {
+		case "interface":
+			switch key {
+			case "privatekey":
+				wg.PrivateKey = value
+			case "address":
+				wg.Address = append(wg.Address, splitList(value)...)
+			case "dns":
+				// DNS 中可以包含搜索域，只保留地址。
+				for _, s := range splitList(value) {
+					if _, err := netip.ParseAddr(s); err == nil {
+						wg.DNS = append(wg.DNS, s)
+					}
+				}
+			case "mtu":
+				if wg.MTU, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid MTU", path, n)
+				}
+			case "listenport":
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid ListenPort", path, n)
+				}
+				wg.Port = uint16(port)
+			}
+		case "peer":
+			switch key {
+			case "publickey":
+				peer.PublicKey = value
+			case "presharedkey":
+				peer.PresharedKey = value
+			case "endpoint":
+				peer.Endpoint = value
+			case "allowedips":
+				peer.AllowedIPs = append(peer.AllowedIPs, splitList(value)...)
+			case "persistentkeepalive":
+				if value == "off" {
+					continue
+				}
+				if peer.PersistentKeepalive, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid PersistentKeepalive", path, n)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: %s outside of a section", path, n, key)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return wg, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeWireGuardConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wg0.conf")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadWireGuardConfig(t *testing.T) {
+	// wgcf 生成的配置文件，加上第二个带预共享密钥的节点。
+	path := writeWireGuardConfig(t, `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 172.16.0.2/32
+Address = 2606:4700:110:8a36::1/128
+DNS = 1.1.1.1, 2606:4700:4700::1111, corp.example
+MTU = 1280
+ListenPort = 51820
+PostUp = iptables -A FORWARD -i %i -j ACCEPT ; 只有 wg-quick 使用
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+AllowedIPs = 0.0.0.0/0
+AllowedIPs = ::/0
+Endpoint = engage.cloudflareclient.com:2408
+PersistentKeepalive = off
+
+# 自建的 WireGuard 集中器
+[peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = /UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak=
+AllowedIPs = 10.10.0.0/16, 192.0.2.1
+Endpoint = 192.0.2.10:51820
+PersistentKeepalive = 25
+`)
+	wg, err := loadWireGuardConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &WireGuard{
+		PrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		Address:    []string{"172.16.0.2/32", "2606:4700:110:8a36::1/128"},
+		DNS:        []string{"1.1.1.1", "2606:4700:4700::1111"},
+		MTU:        1280,
+		Port:       51820,
+		Peers: []*WireGuardPeer{
+			{
+				PublicKey:  "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+				AllowedIPs: []string{"0.0.0.0/0", "::/0"},
+				Endpoint:   "engage.cloudflareclient.com:2408",
+			},
+			{
+				PublicKey:           "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+				PresharedKey:        "/UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak=",
+				AllowedIPs:          []string{"10.10.0.0/16", "192.0.2.1"},
+				Endpoint:            "192.0.2.10:51820",
+				PersistentKeepalive: 25,
+			},
+		},
+	}
+	if !reflect.DeepEqual(wg, want) {
+		t.Fatalf("loaded %+v, want %+v", wg, want)
+	}
+}
+
+func TestLoadWireGuardConfigErrors(t *testing.T) {
+	for name, config := range map[string]string{
+		"unknown section":   "[Tunnel]\n",
+		"outside a section": "PrivateKey = x\n",
+		"invalid line":      "[Interface]\nPrivateKey\n",
+		"invalid mtu":       "[Interface]\nMTU = big\n",
+		"invalid keepalive": "[Peer]\nPersistentKeepalive = often\n",
+	} {
+		if _, err := loadWireGuardConfig(writeWireGuardConfig(t, config)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestWireGuardBuild(t *testing.T) {
+	private, peer := NewPrivateKey(), NewPrivateKey().Public()
+	psk, _ := NewPresharedKey()
+	path := writeWireGuardConfig(t, `[Interface]
+PrivateKey = `+private.String()+`
+Address = 10.0.0.2/32
+
+[Peer]
+PublicKey = `+peer.String()+`
+PresharedKey = `+psk.String()+`
+AllowedIPs = 10.0.0.0/24, 192.0.2.1
+`)
+
+	// 字段覆盖导入的配置。
+	i, err := (&WireGuard{Config: path, MTU: 1420, Address: []string{"10.0.0.3"}}).build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.mtu != 1420 || !reflect.DeepEqual(i.addresses, []netip.Addr{netip.MustParseAddr("10.0.0.3")}) {
+		t.Fatalf("mtu %d, addresses %v", i.mtu, i.addresses)
+	}
+	if len(i.peers) != 1 || i.peers[0].presharedKey.String() != psk.String() {
+		t.Fatalf("peers %+v", i.peers)
+	}
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("192.0.2.1/32")}
+	if !reflect.DeepEqual(i.peers[0].allowedIPs, prefixes) {
+		t.Fatalf("allowed ips %v, want %v", i.peers[0].allowedIPs, prefixes)
+	}
+
+	valid := WireGuard{PrivateKey: private.String(), Address: []string{"10.0.0.2"}, Peers: []*WireGuardPeer{{PublicKey: peer.String()}}}
+	for name, modify := range map[string]func(wg *WireGuard){
+		"no address":    func(wg *WireGuard) { wg.Address = nil },
+		"no peer":       func(wg *WireGuard) { wg.Peers = nil },
+		"mtu":           func(wg *WireGuard) { wg.MTU = 100 },
+		"reserved":      func(wg *WireGuard) { wg.Reserved = []byte{1} },
+		"preshared key": func(wg *WireGuard) { wg.Peers = []*WireGuardPeer{{PublicKey: peer.String(), PresharedKey: "short"}} },
+		"allowed ips": func(wg *WireGuard) {
+			wg.Peers = []*WireGuardPeer{{PublicKey: peer.String(), AllowedIPs: []string{"10.0.0"}}}
+		},
+	} {
+		wg := valid
+		modify(&wg)
+		if _, err := wg.build(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestWireGuardRunReachesPeer(t *testing.T) {
+	private := NewPrivateKey()
+	psk, _ := NewPresharedKey()
+	peer, endpoint := wireguardPeer(t, private.Public(), psk)
+	path := writeWireGuardConfig(t, `[Interface]
+PrivateKey = `+private.String()+`
+Address = 10.9.0.2/32
+
+[Peer]
+PublicKey = `+peer.String()+`
+PresharedKey = `+psk.String()+`
+AllowedIPs = 10.9.0.0/24
+Endpoint = `+endpoint+`
+PersistentKeepalive = 25
+`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &WireGuard{Name: "test", Config: path}
+	outbound, err := wg.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := outbound.Dial("tcp", "10.9.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "peer" {
+		t.Fatalf("read %q from the peer", got)
+	}
+
+	// 隧道停止后设备随之关闭。
+	cancel()
+	select {
+	case <-wg.dev.Wait():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the device was not closed when the tunnel stopped")
+	}
+	if conn, err := outbound.Dial("tcp", "10.9.0.1:80"); err == nil {
+		_ = conn.Close()
+		t.Fatal("dialed through a closed device")
+	}
+}